@@ -0,0 +1,627 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Access control
+//
+// Every client runs its commands as a user, which can be enabled or disabled,
+// has passwords, and is only allowed to run some commands on the keys that
+// match some glob patterns. A client starts as the default user if it doesn't
+// need a password, otherwise it has to AUTH before it can run any command.
+// requirepass sets the password of the default user.
+//
+// ACL SETUSER changes a user with the same rules as Redis:
+//
+// on, off - enable or disable the user, a disabled user can't AUTH
+// >password, <password - add or remove a password
+// #hash, !hash - add or remove a password by its SHA-256 in hex
+// nopass - any password is accepted
+// resetpass - remove the passwords and nopass
+// ~pattern, allkeys - allow the keys that match the pattern, or every key
+// resetkeys - remove the key patterns
+// +command, -command - allow or disallow a command, or a subcommand like
+//                      client|kill
+// +@category, -@category - allow or disallow the commands in a category
+// allcommands, nocommands - the same as +@all and -@all
+// reset - remove everything and disable the user
+//
+// The commands are @read or @write by the writes flag of their cmdDesc, except
+// for the ones in aclCommandCategories, and the commands handled by the client
+// are @pubsub or @transaction. CLIENT has a category for each subcommand, so
+// that clients can manage their own connection without being able to kill the
+// others. The keys of a command are found the same way as
+// when they are locked, and each one has to match a pattern before the command
+// runs. Keys are matched without the prefix of their database. KEYS and SCAN
+// don't take keys, so they aren't restricted by the patterns, and neither are
+// pub/sub channels.
+//
+// With aclfile, the users are loaded from the file at startup and saved to it
+// whenever they change. Each line is a user, in the same form as ACL LIST:
+//
+//	user alice on #<sha256 of the password> ~cache:* +@read
+
+const defaultUser = "default"
+
+var (
+	ReplyNOAUTH    = rawReply("-NOAUTH Authentication required.\r\n")
+	ReplyWRONGPASS = rawReply("-WRONGPASS invalid username-password pair or user is disabled.\r\n")
+)
+
+type aclUser struct {
+	name      string
+	enabled   bool
+	nopass    bool
+	passwords []string        // the SHA-256 hex of each password
+	patterns  []string        // key glob patterns
+	allowed   map[string]bool // the commands the user can run
+	rules     []string        // the command rules that set allowed, used to describe the user
+}
+
+// the categories of the commands that aren't @read or @write by the writes flag
+// of their cmdDesc, or aren't in the command table
+var aclCommandCategories = map[string]string{
+	"acl":            "admin",
+	"client|kill":    "admin",
+	"client|list":    "admin",
+	"config":         "admin",
+	"debug":          "admin",
+	"flushall":       "admin",
+	"migrate":        "admin",
+	"shutdown":       "admin",
+	"slowlog":        "admin",
+	"swapdb":         "admin",
+	"client|getname": "connection",
+	"client|id":      "connection",
+	"client|info":    "connection",
+	"client|setname": "connection",
+	"echo":           "connection",
+	"ping":           "connection",
+	"select":         "connection",
+	"publish":        "pubsub",
+	"pubsub":         "pubsub",
+	"flushdb":        "write",
+}
+
+var (
+	commandCategory = make(map[string]string) // command -> ACL category, AUTH and QUIT are always allowed
+	aclCategories   = map[string]bool{"all": true}
+
+	aclUsers map[string]*aclUser // users are replaced when they change, never modified
+	aclMtx   = &sync.RWMutex{}
+)
+
+func init() {
+	for _, c := range commandList {
+		if c.writes {
+			commandCategory[c.name] = "write"
+		} else {
+			commandCategory[c.name] = "read"
+		}
+	}
+	for name := range pubsubCommands {
+		commandCategory[name] = "pubsub"
+	}
+	for name := range transactionCommands {
+		commandCategory[name] = "transaction"
+	}
+	for name, category := range aclCommandCategories {
+		commandCategory[name] = category
+	}
+	for _, category := range commandCategory {
+		aclCategories[category] = true
+	}
+	aclUsers = map[string]*aclUser{defaultUser: newDefaultUser()}
+}
+
+// a disabled user without passwords or permissions
+func newACLUser(name string) *aclUser {
+	return &aclUser{name: name, allowed: make(map[string]bool), rules: []string{"-@all"}}
+}
+
+func newDefaultUser() *aclUser {
+	u := newACLUser(defaultUser)
+	for _, rule := range []string{"on", "nopass", "allkeys", "allcommands"} {
+		u.applyRule(rule)
+	}
+	return u
+}
+
+func (u *aclUser) clone() *aclUser {
+	c := *u
+	c.passwords = append([]string{}, u.passwords...)
+	c.patterns = append([]string{}, u.patterns...)
+	c.rules = append([]string{}, u.rules...)
+	c.allowed = make(map[string]bool, len(u.allowed))
+	for name := range u.allowed {
+		c.allowed[name] = true
+	}
+	return &c
+}
+
+func hashPassword(password string) string {
+	h := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(h[:])
+}
+
+func (u *aclUser) applyRule(rule string) error {
+	lower := strings.ToLower(rule)
+	switch lower {
+	case "on":
+		u.enabled = true
+	case "off":
+		u.enabled = false
+	case "nopass":
+		u.nopass, u.passwords = true, nil
+	case "resetpass":
+		u.nopass, u.passwords = false, nil
+	case "allkeys":
+		u.patterns = []string{"*"}
+	case "resetkeys":
+		u.patterns = nil
+	case "allcommands":
+		return u.applyCommandRule("+@all")
+	case "nocommands":
+		return u.applyCommandRule("-@all")
+	case "reset":
+		*u = *newACLUser(u.name)
+	default:
+		if rule == "" {
+			return SyntaxError
+		}
+		switch rule[0] {
+		case '>':
+			u.addPassword(hashPassword(rule[1:]))
+		case '<':
+			return u.removePassword(hashPassword(rule[1:]))
+		case '#', '!':
+			hash := lower[1:]
+			if _, err := hex.DecodeString(hash); err != nil || len(hash) != sha256.Size*2 {
+				return fmt.Errorf("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+			}
+			if rule[0] == '!' {
+				return u.removePassword(hash)
+			}
+			u.addPassword(hash)
+		case '~':
+			pattern := rule[1:]
+			if _, err := filepath.Match(pattern, ""); err != nil || strings.ContainsAny(pattern, " \t\r\n") {
+				return fmt.Errorf("Invalid key pattern")
+			}
+			for _, p := range u.patterns {
+				if p == pattern {
+					return nil
+				}
+			}
+			u.patterns = append(u.patterns, pattern)
+		case '+', '-':
+			return u.applyCommandRule(lower)
+		default:
+			return SyntaxError
+		}
+	}
+	return nil
+}
+
+func (u *aclUser) addPassword(hash string) {
+	for _, p := range u.passwords {
+		if p == hash {
+			return
+		}
+	}
+	u.passwords = append(u.passwords, hash)
+	u.nopass = false
+}
+
+func (u *aclUser) removePassword(hash string) error {
+	for i, p := range u.passwords {
+		if p == hash {
+			u.passwords = append(u.passwords[:i], u.passwords[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no such password")
+}
+
+// Apply a +command, -command, +@category or -@category rule. A rule replaces the
+// earlier rules for the same command or category, so they are dropped from the
+// description.
+func (u *aclUser) applyCommandRule(rule string) error {
+	allow, target := rule[0] == '+', rule[1:]
+	if strings.HasPrefix(target, "@") {
+		category := target[1:]
+		if !aclCategories[category] {
+			return fmt.Errorf("Unknown command or category name in ACL")
+		}
+		for name, c := range commandCategory {
+			if category == "all" || c == category {
+				u.setAllowed(name, allow)
+			}
+		}
+		if category == "all" {
+			u.rules = []string{rule}
+			return nil
+		}
+	} else {
+		// a command with subcommands applies to all of them
+		found := false
+		for name := range commandCategory {
+			if name == target || strings.HasPrefix(name, target+"|") {
+				u.setAllowed(name, allow)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("Unknown command or category name in ACL")
+		}
+	}
+	rules := u.rules[:0]
+	for _, r := range u.rules {
+		if r[1:] != target {
+			rules = append(rules, r)
+		}
+	}
+	u.rules = append(rules, rule)
+	return nil
+}
+
+func (u *aclUser) setAllowed(name string, allow bool) {
+	if allow {
+		u.allowed[name] = true
+	} else {
+		delete(u.allowed, name)
+	}
+}
+
+func (u *aclUser) checkPassword(password string) bool {
+	if u.nopass {
+		return true
+	}
+	hash := hashPassword(password)
+	for _, p := range u.passwords {
+		if p == hash {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *aclUser) keyAllowed(key []byte) bool {
+	for _, p := range u.patterns {
+		if matched, _ := filepath.Match(p, string(key)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// the user in the form of ACL LIST and the ACL file
+func (u *aclUser) String() string {
+	parts := []string{"user", u.name, "off"}
+	if u.enabled {
+		parts[2] = "on"
+	}
+	if u.nopass {
+		parts = append(parts, "nopass")
+	}
+	for _, p := range u.passwords {
+		parts = append(parts, "#"+p)
+	}
+	for _, p := range u.patterns {
+		parts = append(parts, "~"+p)
+	}
+	return strings.Join(append(parts, u.rules...), " ")
+}
+
+func getACLUser(name string) *aclUser {
+	aclMtx.RLock()
+	defer aclMtx.RUnlock()
+	return aclUsers[name]
+}
+
+// the user that new clients are authenticated as, or an empty string if they
+// have to AUTH
+func initialUser() string {
+	if u := getACLUser(defaultUser); u != nil && u.enabled && u.nopass {
+		return defaultUser
+	}
+	return ""
+}
+
+// Set the password of the default user, an empty password removes it
+func setRequirepass(password string) {
+	aclMtx.Lock()
+	defer aclMtx.Unlock()
+	u := aclUsers[defaultUser].clone()
+	if password == "" {
+		u.applyRule("nopass")
+	} else {
+		u.applyRule("resetpass")
+		u.applyRule(">" + password)
+	}
+	aclUsers[defaultUser] = u
+}
+
+// Returns a NOAUTH or NOPERM reply if the client's user can't run the command
+// with args, or nil if it can.
+func (c *client) checkPermissions(name string, args [][]byte) rawReply {
+	u := getACLUser(c.user)
+	if u == nil {
+		return ReplyNOAUTH
+	}
+	aclName, ok := commandACLName(name, args)
+	if !ok {
+		return nil // unknown commands are rejected later
+	}
+	if !u.allowed[aclName] {
+		return rawReply(fmt.Sprintf("-NOPERM User %s has no permissions to run the '%s' command\r\n", u.name, aclName))
+	}
+	for _, k := range commandKeys(name, args) {
+		if !u.keyAllowed(k) {
+			return rawReply("-NOPERM No permissions to access a key\r\n")
+		}
+	}
+	return nil
+}
+
+// Returns the name of a command in the ACL rules, which includes the subcommand
+// for commands that have a category for each subcommand, and false if the
+// command is unknown.
+func commandACLName(name string, args [][]byte) (string, bool) {
+	if _, ok := commandCategory[name]; ok {
+		return name, true
+	}
+	if len(args) == 0 {
+		return "", false
+	}
+	name = name + "|" + strings.ToLower(string(args[0]))
+	_, ok := commandCategory[name]
+	return name, ok
+}
+
+// the keys of a command, or nil if it has the wrong number of arguments
+func commandKeys(name string, args [][]byte) [][]byte {
+	if name == "watch" {
+		return args
+	}
+	if command, ok := commands[name]; ok && validArity(command.arity, len(args)) {
+		return command.getKeys(args)
+	}
+	return nil
+}
+
+// AUTH [username] password
+func (c *client) auth(args [][]byte) interface{} {
+	name, password := defaultUser, string(args[0])
+	if len(args) == 2 {
+		name, password = string(args[0]), string(args[1])
+	} else if u := getACLUser(defaultUser); u != nil && u.nopass {
+		return fmt.Errorf("AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+	}
+	u := getACLUser(name)
+	if u == nil || !u.enabled || !u.checkPassword(password) {
+		return ReplyWRONGPASS
+	}
+	c.infoMtx.Lock()
+	c.user = name
+	c.infoMtx.Unlock()
+	return ReplyOK
+}
+
+func (c *client) acl(args [][]byte) interface{} {
+	sub := strings.ToLower(string(args[0]))
+	switch {
+	case sub == "setuser" && len(args) >= 2:
+		return setACLUser(string(args[1]), args[2:])
+	case sub == "getuser" && len(args) == 2:
+		u := getACLUser(string(args[1]))
+		if u == nil {
+			return nil
+		}
+		return describeACLUser(u)
+	case sub == "deluser" && len(args) >= 2:
+		return delACLUsers(args[1:])
+	case sub == "list" && len(args) == 1:
+		res := []interface{}{}
+		for _, u := range sortedACLUsers() {
+			res = append(res, []byte(u.String()))
+		}
+		return res
+	case sub == "users" && len(args) == 1:
+		res := []interface{}{}
+		for _, u := range sortedACLUsers() {
+			res = append(res, []byte(u.name))
+		}
+		return res
+	case sub == "whoami" && len(args) == 1:
+		return []byte(c.user)
+	case sub == "load" && len(args) == 1:
+		if config.aclfile == "" {
+			return fmt.Errorf("This server is not configured with an ACL file")
+		}
+		if err := loadACLFile(); err != nil {
+			return err
+		}
+		return ReplyOK
+	}
+	return fmt.Errorf("Unknown ACL subcommand or wrong number of arguments for '%s'", args[0])
+}
+
+// the reply of ACL GETUSER
+func describeACLUser(u *aclUser) []interface{} {
+	flags := []interface{}{[]byte("off")}
+	if u.enabled {
+		flags[0] = []byte("on")
+	}
+	if u.nopass {
+		flags = append(flags, []byte("nopass"))
+	}
+	passwords := []interface{}{}
+	for _, p := range u.passwords {
+		passwords = append(passwords, []byte(p))
+	}
+	keys := make([]string, len(u.patterns))
+	for i, p := range u.patterns {
+		keys[i] = "~" + p
+	}
+	return []interface{}{
+		[]byte("flags"), flags,
+		[]byte("passwords"), passwords,
+		[]byte("commands"), []byte(strings.Join(u.rules, " ")),
+		[]byte("keys"), []byte(strings.Join(keys, " ")),
+	}
+}
+
+// ACL SETUSER, creates the user if it doesn't exist
+func setACLUser(name string, rules [][]byte) interface{} {
+	if name == "" || strings.ContainsAny(name, " \t\r\n\x00") {
+		return fmt.Errorf("Usernames can't be empty or contain spaces or null characters")
+	}
+	aclMtx.Lock()
+	defer aclMtx.Unlock()
+	u := newACLUser(name)
+	if existing, ok := aclUsers[name]; ok {
+		u = existing.clone()
+	}
+	for _, rule := range rules {
+		if err := u.applyRule(string(rule)); err != nil {
+			return fmt.Errorf("Error in ACL SETUSER modifier '%s': %s", rule, err)
+		}
+	}
+	users := copyACLUsers()
+	users[name] = u
+	if err := saveACLFile(users); err != nil {
+		return err
+	}
+	aclUsers = users
+	return ReplyOK
+}
+
+// ACL DELUSER, returns the number of users that were deleted
+func delACLUsers(names [][]byte) interface{} {
+	aclMtx.Lock()
+	defer aclMtx.Unlock()
+	users := copyACLUsers()
+	deleted := 0
+	for _, name := range names {
+		if string(name) == defaultUser {
+			return fmt.Errorf("The 'default' user cannot be removed")
+		}
+		if _, ok := users[string(name)]; ok {
+			delete(users, string(name))
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		if err := saveACLFile(users); err != nil {
+			return err
+		}
+	}
+	aclUsers = users
+	return deleted
+}
+
+// copy the users map so that it can be changed, aclMtx must be held
+func copyACLUsers() map[string]*aclUser {
+	users := make(map[string]*aclUser, len(aclUsers))
+	for name, u := range aclUsers {
+		users[name] = u
+	}
+	return users
+}
+
+func sortedACLUsers() []*aclUser {
+	aclMtx.RLock()
+	users := make([]*aclUser, 0, len(aclUsers))
+	for _, u := range aclUsers {
+		users = append(users, u)
+	}
+	aclMtx.RUnlock()
+	sort.Sort(aclUsersByName(users))
+	return users
+}
+
+type aclUsersByName []*aclUser
+
+func (u aclUsersByName) Len() int           { return len(u) }
+func (u aclUsersByName) Less(i, j int) bool { return u[i].name < u[j].name }
+func (u aclUsersByName) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+
+// Replace the users with the ones in the ACL file. A file that doesn't exist
+// has no users, and the default user is added if the file doesn't have it.
+func loadACLFile() error {
+	if config.aclfile == "" {
+		return nil
+	}
+	users := make(map[string]*aclUser)
+	f, err := os.Open(config.aclfile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		for line := 1; s.Scan(); line++ {
+			fields := strings.Fields(s.Text())
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			if len(fields) < 2 || fields[0] != "user" {
+				return fmt.Errorf("%s:%d: should start with user <username>", config.aclfile, line)
+			}
+			u := newACLUser(fields[1])
+			for _, rule := range fields[2:] {
+				if err := u.applyRule(rule); err != nil {
+					return fmt.Errorf("%s:%d: invalid rule '%s': %s", config.aclfile, line, rule, err)
+				}
+			}
+			users[u.name] = u
+		}
+		if err := s.Err(); err != nil {
+			return err
+		}
+	}
+	if _, ok := users[defaultUser]; !ok {
+		users[defaultUser] = newDefaultUser()
+		if config.requirepass != "" {
+			users[defaultUser].applyRule("resetpass")
+			users[defaultUser].applyRule(">" + config.requirepass)
+		}
+	}
+	aclMtx.Lock()
+	aclUsers = users
+	aclMtx.Unlock()
+	return nil
+}
+
+// Write the users to the ACL file, if there is one
+func saveACLFile(users map[string]*aclUser) error {
+	if config.aclfile == "" {
+		return nil
+	}
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := make([]string, len(names))
+	for i, name := range names {
+		lines[i] = users[name].String() + "\n"
+	}
+	// replace the file in one step so that it is never partially written
+	tmp := config.aclfile + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strings.Join(lines, "")), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, config.aclfile)
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/jmhodges/levigo"
+)
+
+// A Batch collects the writes made by a command so that they can be committed
+// to LevelDB atomically.
+//
+// Normally the writes are kept in order until the batch is committed along with
+// the batches of other clients, see commit.go, and reads go to the database.
+// Transactions instead use an overlay batch, which keeps the writes in memory
+// so that reads made through the batch see the writes that haven't been
+// committed yet. Each command in a transaction gets its own overlay on top of
+// the transaction's overlay, so that the writes of a command that fails can be
+// discarded.
+//
+// A nil *Batch reads directly from the database.
+//
+// Keyspace events added to the batch are published, and clients blocked on the
+// lists that were pushed to are woken, once it has been written to the database.
+// The key counts are updated in the same write, see keycount.go.
+type Batch struct {
+	writes  batchWrites       // the writes in order, if the batch isn't an overlay
+	overlay map[string][]byte // key -> value, deleted keys have a nil value
+	parent  *Batch
+	events  []keyspaceEvent
+	pushed  [][]byte       // list keys that were pushed to
+	counted map[string]int // counted key -> the count it will be in, or -1
+}
+
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+// Create an overlay batch, the writes will be committed to parent if it is not nil
+func newOverlayBatch(parent *Batch) *Batch {
+	return &Batch{overlay: make(map[string][]byte), parent: parent}
+}
+
+func (b *Batch) Put(key, value []byte) {
+	b.countWrite(key, value)
+	if b.overlay == nil {
+		b.writes.put(key, value)
+		return
+	}
+	// the key and value buffers are often reused by the caller, so they are copied
+	b.overlay[string(key)] = append(make([]byte, 0, len(value)), value...)
+}
+
+func (b *Batch) Delete(key []byte) {
+	b.countWrite(key, nil)
+	if b.overlay == nil {
+		b.writes.delete(key)
+		return
+	}
+	b.overlay[string(key)] = nil
+}
+
+// Get a value, reading through any uncommitted writes in the batch
+func (b *Batch) Get(opts *levigo.ReadOptions, key []byte) ([]byte, error) {
+	for o := b; o != nil && o.overlay != nil; o = o.parent {
+		if v, ok := o.overlay[string(key)]; ok {
+			if v == nil {
+				return nil, nil
+			}
+			return append([]byte{}, v...), nil
+		}
+	}
+	return DB.Get(opts, key)
+}
+
+// Create an iterator that merges the uncommitted writes in the batch with the
+// database. The iterator sees the writes that were made before it was created.
+func (b *Batch) NewIterator(opts *levigo.ReadOptions) *Iterator {
+	return &Iterator{it: DB.NewIterator(opts), writes: b.sortedWrites(), forward: true}
+}
+
+// Add a keyspace event for key, if the class is enabled
+func (b *Batch) Notify(class int32, event string, key []byte) {
+	if b == nil || !notifyEnabled(class) {
+		return
+	}
+	b.events = append(b.events, keyspaceEvent{event, append([]byte{}, key...)})
+}
+
+// Record that the list key was pushed to, so that blocked clients can be woken
+func (b *Batch) ListPushed(key []byte) {
+	b.pushed = append(b.pushed, append([]byte{}, key...))
+}
+
+// Write commits the batch to its parent batch if it has one, or to the database
+func (b *Batch) Write() error {
+	if b.overlay == nil {
+		return b.commit(b.writes)
+	}
+	if b.parent != nil {
+		b.parent.events = append(b.parent.events, b.events...)
+		b.parent.pushed = append(b.parent.pushed, b.pushed...)
+		for k, v := range b.overlay {
+			if v == nil {
+				b.parent.Delete([]byte(k))
+			} else {
+				b.parent.Put([]byte(k), v)
+			}
+		}
+		return nil
+	}
+	if len(b.overlay) == 0 {
+		publishKeyspaceEvents(b.events)
+		return nil
+	}
+	writes := make(batchWrites, 0, len(b.overlay))
+	for k, v := range b.overlay {
+		writes = append(writes, batchWrite{[]byte(k), v})
+	}
+	return b.commit(writes)
+}
+
+func (b *Batch) commit(writes batchWrites) error {
+	return b.startCommit(writes)()
+}
+
+// Queue the writes to be committed and return a function that waits for them,
+// so that a client can queue the batches of several commands before it waits.
+func (b *Batch) startCommit(writes batchWrites) func() error {
+	d, err := b.countDelta()
+	if err != nil {
+		return func() error { return err }
+	}
+	var r *commitRequest
+	if len(writes) > 0 {
+		r = queueCommit(&commitRequest{writes: writes, counts: d})
+	}
+	return func() error {
+		if r != nil {
+			if err := <-r.done; err != nil {
+				return err
+			}
+		}
+		publishKeyspaceEvents(b.events)
+		signalListWaiters(b.pushed)
+		return nil
+	}
+}
+
+// Close discards the writes that haven't been committed
+func (b *Batch) Close() {
+	b.writes = nil
+}
+
+type batchWrite struct {
+	key   []byte
+	value []byte // nil if the key was deleted
+}
+
+type batchWrites []batchWrite
+
+// the key and value buffers are often reused by the caller, so they are copied
+func (w *batchWrites) put(key, value []byte) {
+	*w = append(*w, batchWrite{append([]byte{}, key...), append(make([]byte, 0, len(value)), value...)})
+}
+
+func (w *batchWrites) delete(key []byte) {
+	*w = append(*w, batchWrite{append([]byte{}, key...), nil})
+}
+
+func (w batchWrites) Len() int           { return len(w) }
+func (w batchWrites) Less(i, j int) bool { return bytes.Compare(w[i].key, w[j].key) < 0 }
+func (w batchWrites) Swap(i, j int)      { w[i], w[j] = w[j], w[i] }
+
+// Flatten the overlays into a sorted list of writes, writes in child batches
+// replace the writes from their parents
+func (b *Batch) sortedWrites() batchWrites {
+	if b == nil || b.overlay == nil {
+		return nil
+	}
+	merged := make(map[string][]byte)
+	var overlays []map[string][]byte
+	for o := b; o != nil && o.overlay != nil; o = o.parent {
+		overlays = append(overlays, o.overlay)
+	}
+	for i := len(overlays) - 1; i >= 0; i-- {
+		for k, v := range overlays[i] {
+			merged[k] = v
+		}
+	}
+	if len(merged) == 0 {
+		return nil
+	}
+	writes := make(batchWrites, 0, len(merged))
+	for k, v := range merged {
+		writes = append(writes, batchWrite{[]byte(k), v})
+	}
+	sort.Sort(writes)
+	return writes
+}
+
+// Iterator has the same interface as levigo.Iterator, merging a list of
+// uncommitted writes with the database
+type Iterator struct {
+	it      *levigo.Iterator
+	writes  batchWrites
+	i       int  // the current position in writes
+	forward bool // the direction of the last move
+	current bool // true if the current item is from writes instead of the database
+	valid   bool
+}
+
+func (it *Iterator) Valid() bool {
+	if it.writes == nil {
+		return it.it.Valid()
+	}
+	return it.valid
+}
+
+func (it *Iterator) Key() []byte {
+	if it.writes == nil || !it.current {
+		return it.it.Key()
+	}
+	return append([]byte{}, it.writes[it.i].key...)
+}
+
+func (it *Iterator) Value() []byte {
+	if it.writes == nil || !it.current {
+		return it.it.Value()
+	}
+	return append([]byte{}, it.writes[it.i].value...)
+}
+
+func (it *Iterator) Seek(key []byte) {
+	it.it.Seek(key)
+	if it.writes == nil {
+		return
+	}
+	it.forward = true
+	it.i = it.searchWrites(key)
+	it.findNext()
+}
+
+func (it *Iterator) SeekToFirst() {
+	it.it.SeekToFirst()
+	if it.writes == nil {
+		return
+	}
+	it.forward = true
+	it.i = 0
+	it.findNext()
+}
+
+func (it *Iterator) SeekToLast() {
+	it.it.SeekToLast()
+	if it.writes == nil {
+		return
+	}
+	it.forward = false
+	it.i = len(it.writes) - 1
+	it.findPrev()
+}
+
+func (it *Iterator) Next() {
+	if it.writes == nil {
+		it.it.Next()
+		return
+	}
+	if !it.forward {
+		// position both iterators after the current key
+		key := it.Key()
+		it.it.Seek(key)
+		if it.it.Valid() && bytes.Equal(it.it.Key(), key) {
+			it.it.Next()
+		}
+		it.i = it.searchWrites(key)
+		if it.i < len(it.writes) && bytes.Equal(it.writes[it.i].key, key) {
+			it.i++
+		}
+		it.forward = true
+	} else if it.current {
+		it.i++
+	} else {
+		it.it.Next()
+	}
+	it.findNext()
+}
+
+func (it *Iterator) Prev() {
+	if it.writes == nil {
+		it.it.Prev()
+		return
+	}
+	if it.forward {
+		// position both iterators before the current key
+		key := it.Key()
+		it.it.Seek(key)
+		if it.it.Valid() {
+			it.it.Prev()
+		} else {
+			it.it.SeekToLast()
+		}
+		it.i = it.searchWrites(key) - 1
+		it.forward = false
+	} else if it.current {
+		it.i--
+	} else {
+		it.it.Prev()
+	}
+	it.findPrev()
+}
+
+func (it *Iterator) GetError() error {
+	return it.it.GetError()
+}
+
+func (it *Iterator) Close() {
+	it.it.Close()
+}
+
+// returns the index of the first write that is >= key
+func (it *Iterator) searchWrites(key []byte) int {
+	return sort.Search(len(it.writes), func(i int) bool {
+		return bytes.Compare(it.writes[i].key, key) >= 0
+	})
+}
+
+// Moving forward, pick the smallest key from the database and writes.
+// Writes replace database keys, and deleted keys are skipped.
+func (it *Iterator) findNext() {
+	for {
+		dbValid := it.it.Valid()
+		writeValid := it.i >= 0 && it.i < len(it.writes)
+		if !dbValid && !writeValid {
+			it.valid = false
+			return
+		}
+		if writeValid {
+			cmp := -1
+			if dbValid {
+				cmp = bytes.Compare(it.writes[it.i].key, it.it.Key())
+			}
+			if cmp <= 0 {
+				if cmp == 0 {
+					it.it.Next()
+				}
+				if it.writes[it.i].value == nil {
+					it.i++
+					continue
+				}
+				it.current, it.valid = true, true
+				return
+			}
+		}
+		it.current, it.valid = false, true
+		return
+	}
+}
+
+// Moving backward, pick the largest key from the database and writes.
+func (it *Iterator) findPrev() {
+	for {
+		dbValid := it.it.Valid()
+		writeValid := it.i >= 0 && it.i < len(it.writes)
+		if !dbValid && !writeValid {
+			it.valid = false
+			return
+		}
+		if writeValid {
+			cmp := 1
+			if dbValid {
+				cmp = bytes.Compare(it.writes[it.i].key, it.it.Key())
+			}
+			if cmp >= 0 {
+				if cmp == 0 {
+					it.it.Prev()
+				}
+				if it.writes[it.i].value == nil {
+					it.i--
+					continue
+				}
+				it.current, it.valid = true, true
+				return
+			}
+		}
+		it.current, it.valid = false, true
+		return
+	}
+}
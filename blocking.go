@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/titanous/bconv"
+)
+
+// Blocking list pops
+//
+// A blocking command runs like a normal command, and if all of its lists are
+// empty the client registers a waiter for the lists and blocks until one of them
+// is pushed to. After a batch that pushed to a list is committed, the first
+// waiter for the list is woken and retries the command, so blocked clients are
+// served in the order that they blocked. The pop is committed by the woken
+// client's own batch.
+//
+// Only the blocked client's goroutine waits, other clients are not affected.
+
+// commands that block until they can return a reply, the last argument is the timeout
+var blockingCommands = map[string]bool{
+	"blpop":      true,
+	"brpop":      true,
+	"brpoplpush": true,
+}
+
+type listWaiter struct {
+	keys  [][]byte
+	ready chan bool // receives when one of the keys has been pushed to
+}
+
+var (
+	listWaiters    = make(map[string][]*listWaiter) // list key -> waiters in the order they blocked
+	listWaitersMtx = &sync.Mutex{}
+)
+
+// parse a blocking command timeout in seconds, 0 blocks forever
+func parseTimeout(b []byte) (time.Duration, error) {
+	n, err := bconv.ParseInt(b, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("timeout is not an integer or out of range")
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("timeout is negative")
+	}
+	return time.Duration(n) * time.Second, nil
+}
+
+// Run a blocking command, retrying it each time one of its lists is pushed to
+// until it returns a reply or times out.
+func (c *client) block(command *cmdDesc, args [][]byte) (interface{}, error) {
+	timeout, err := parseTimeout(args[len(args)-1])
+	if err != nil {
+		return err, nil
+	}
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = time.After(timeout)
+	}
+	// BRPOPLPUSH only waits on the source list
+	userKeys := args[:len(args)-1]
+	if command.name == "brpoplpush" {
+		userKeys = args[:1]
+	}
+
+	// The client can't send commands while it is blocked, so the connection is
+	// read in the background to find out if the client disconnects. The read is
+	// interrupted with a deadline once the command is done. Once the client has
+	// pipelined another command the read returns, so CLIENT KILL and shutdown
+	// stop the wait with killedCh and shuttingDown instead.
+	disconnected := make(chan error, 1)
+	go func() {
+		_, err := c.r.Peek(1)
+		disconnected <- err
+	}()
+	defer func() {
+		if disconnected != nil {
+			c.cn.SetReadDeadline(time.Now())
+			<-disconnected
+			c.cn.SetReadDeadline(time.Time{})
+		}
+	}()
+
+	front := false
+	for {
+		// the database may have been swapped or flushed since the last try
+		keys := c.dbKeys(userKeys)
+		res, err := c.call(command, args)
+		if err != nil || !emptyReply(res) {
+			// the lists may have more items for the next waiters
+			signalListWaiters(keys)
+			return res, err
+		}
+
+		// The command is retried after the waiter is registered, so that a push
+		// that happened after the first try isn't missed.
+		w := newListWaiter(keys, front)
+		res, err = c.call(command, args)
+		if err != nil || !emptyReply(res) {
+			w.cancel()
+			signalListWaiters(keys)
+			return res, err
+		}
+
+		for woken := false; !woken; {
+			select {
+			case <-w.ready:
+				woken = true
+			case <-deadline:
+				w.cancel()
+				return res, nil
+			case <-c.killedCh:
+				w.cancel()
+				return res, nil
+			case <-shuttingDown:
+				w.cancel()
+				return res, nil
+			case err := <-disconnected:
+				// if there wasn't an error, the client pipelined another command
+				// which will run once this one is done
+				disconnected = nil
+				if err != nil {
+					w.cancel()
+					return res, nil
+				}
+			}
+		}
+		// a waiter that is woken but loses the race for the item keeps its place
+		front = true
+	}
+}
+
+// returns true if res is the reply of a blocking command that didn't find anything
+func emptyReply(res interface{}) bool {
+	if l, ok := res.([]interface{}); ok {
+		return l == nil
+	}
+	return res == nil
+}
+
+// Register a waiter for keys, either at the end of the queue or at the front
+// for a waiter that was woken before.
+func newListWaiter(keys [][]byte, front bool) *listWaiter {
+	listWaitersMtx.Lock()
+	defer listWaitersMtx.Unlock()
+	w := &listWaiter{keys, make(chan bool, 1)}
+	for _, k := range keys {
+		if front {
+			listWaiters[string(k)] = append([]*listWaiter{w}, listWaiters[string(k)]...)
+		} else {
+			listWaiters[string(k)] = append(listWaiters[string(k)], w)
+		}
+	}
+	return w
+}
+
+func (w *listWaiter) cancel() {
+	listWaitersMtx.Lock()
+	defer listWaitersMtx.Unlock()
+	w.remove()
+}
+
+// remove the waiter from the queues, listWaitersMtx must be held
+func (w *listWaiter) remove() {
+	for _, k := range w.keys {
+		queue := listWaiters[string(k)]
+		n := 0
+		for _, other := range queue {
+			if other != w {
+				queue[n] = other
+				n++
+			}
+		}
+		if n == 0 {
+			delete(listWaiters, string(k))
+		} else {
+			listWaiters[string(k)] = queue[:n]
+		}
+	}
+}
+
+// Wake every waiter, they find the lists that they wait on again when they
+// retry their command.
+func wakeListWaiters() {
+	listWaitersMtx.Lock()
+	defer listWaitersMtx.Unlock()
+	for k, queue := range listWaiters {
+		for _, w := range queue {
+			// a waiter for several lists may have been woken already
+			select {
+			case w.ready <- true:
+			default:
+			}
+		}
+		delete(listWaiters, k)
+	}
+}
+
+// wake the first waiter for each of the keys
+func signalListWaiters(keys [][]byte) {
+	listWaitersMtx.Lock()
+	defer listWaitersMtx.Unlock()
+	if len(listWaiters) == 0 {
+		return
+	}
+	for _, k := range keys {
+		queue := listWaiters[string(k)]
+		if len(queue) == 0 {
+			continue
+		}
+		w := queue[0]
+		w.remove()
+		w.ready <- true
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/titanous/bconv"
+)
+
+// Client introspection
+//
+// CLIENT LIST and CLIENT INFO describe clients with a line each, like Redis:
+//
+//	id=5 addr=127.0.0.1:52174 laddr=127.0.0.1:12345 name=worker age=12 idle=0 db=0 omem=0 cmd=get user=default
+//
+// age is the number of seconds since the client connected, idle the number of
+// seconds since it sent its last command, omem the size of the replies that
+// haven't been written to it yet, and cmd the last command it sent.
+//
+// CLIENT KILL disconnects clients once they finish the command they are
+// running, and a client that is blocked on a list stops waiting. It takes the
+// address of a client, or filters like Redis:
+//
+//	CLIENT KILL [ID id] [ADDR ip:port] [LADDR ip:port] [USER username] [SKIPME yes|no]
+
+var lastClientID int64 // accessed atomically
+
+func (c *client) clientCommand(args [][]byte) interface{} {
+	sub := strings.ToLower(string(args[0]))
+	switch {
+	case sub == "id" && len(args) == 1:
+		return c.id
+	case sub == "getname" && len(args) == 1:
+		if c.name == "" {
+			return nil
+		}
+		return []byte(c.name)
+	case sub == "setname" && len(args) == 2:
+		for _, b := range args[1] {
+			if b < '!' || b > '~' {
+				return fmt.Errorf("Client names cannot contain spaces, newlines or special characters.")
+			}
+		}
+		c.infoMtx.Lock()
+		c.name = string(args[1])
+		c.infoMtx.Unlock()
+		return ReplyOK
+	case sub == "info" && len(args) == 1:
+		return []byte(c.info())
+	case sub == "list":
+		return listClients(args[1:])
+	case sub == "kill" && len(args) >= 2:
+		return c.killClients(args[1:])
+	}
+	return fmt.Errorf("Unknown CLIENT subcommand or wrong number of arguments for '%s'", args[0])
+}
+
+// record a command for CLIENT LIST, unknown commands don't replace the last one
+func (c *client) commandStarted(name string, args [][]byte) {
+	aclName, known := commandACLName(name, args)
+	c.infoMtx.Lock()
+	c.lastActive = time.Now()
+	if known {
+		c.lastCommand = aclName
+	}
+	c.infoMtx.Unlock()
+}
+
+// the client's line in CLIENT LIST
+func (c *client) info() string {
+	c.infoMtx.Lock()
+	defer c.infoMtx.Unlock()
+	now := time.Now()
+	cmd := c.lastCommand
+	if cmd == "" {
+		cmd = "NULL"
+	}
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d db=%d omem=%d cmd=%s user=%s\n",
+		c.id, c.addr, c.cn.LocalAddr(), c.name, int64(now.Sub(c.created)/time.Second),
+		int64(now.Sub(c.lastActive)/time.Second), c.db, atomic.LoadInt64(&c.writeQueueSize), cmd, c.user)
+}
+
+// Disconnect the client once it finishes the command it is running
+func (c *client) kill() {
+	if atomic.CompareAndSwapInt32(&c.killed, 0, 1) {
+		// stop the wait of a blocked command
+		close(c.killedCh)
+	}
+	// interrupt the read of the next command
+	c.cn.SetReadDeadline(time.Now())
+}
+
+// CLIENT LIST [ID id [id ...]]
+func listClients(args [][]byte) interface{} {
+	var ids map[int64]bool
+	if len(args) > 0 {
+		if len(args) < 2 || !EqualIgnoreCase(args[0], []byte("id")) {
+			return SyntaxError
+		}
+		ids = make(map[int64]bool)
+		for _, arg := range args[1:] {
+			id, err := bconv.ParseInt(arg, 10, 64)
+			if err != nil || id <= 0 {
+				return fmt.Errorf("Invalid client ID")
+			}
+			ids[id] = true
+		}
+	}
+	res := []byte{}
+	for _, c := range sortedClients() {
+		if ids == nil || ids[c.id] {
+			res = append(res, c.info()...)
+		}
+	}
+	return res
+}
+
+// CLIENT KILL, returns the number of clients that were killed when filters are
+// used
+func (c *client) killClients(args [][]byte) interface{} {
+	if len(args) == 1 {
+		for _, other := range sortedClients() {
+			if other.addr == string(args[0]) {
+				other.kill()
+				return ReplyOK
+			}
+		}
+		return fmt.Errorf("No such client")
+	}
+	if len(args)%2 != 0 {
+		return SyntaxError
+	}
+	var id int64
+	var addr, laddr, user string
+	skipme := true
+	for i := 0; i < len(args); i += 2 {
+		value := args[i+1]
+		switch strings.ToLower(string(args[i])) {
+		case "id":
+			n, err := bconv.ParseInt(value, 10, 64)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("client-id should be greater than 0")
+			}
+			id = n
+		case "addr":
+			addr = string(value)
+		case "laddr":
+			laddr = string(value)
+		case "user":
+			user = string(value)
+			if getACLUser(user) == nil {
+				return fmt.Errorf("No such user '%s'", user)
+			}
+		case "skipme":
+			switch {
+			case EqualIgnoreCase(value, []byte("yes")):
+				skipme = true
+			case EqualIgnoreCase(value, []byte("no")):
+				skipme = false
+			default:
+				return SyntaxError
+			}
+		default:
+			return SyntaxError
+		}
+	}
+
+	killed := 0
+	for _, other := range sortedClients() {
+		if id != 0 && other.id != id || addr != "" && other.addr != addr ||
+			laddr != "" && other.cn.LocalAddr().String() != laddr || skipme && other == c {
+			continue
+		}
+		if user != "" {
+			other.infoMtx.Lock()
+			otherUser := other.user
+			other.infoMtx.Unlock()
+			if otherUser != user {
+				continue
+			}
+		}
+		other.kill()
+		killed++
+	}
+	return killed
+}
+
+// the connected clients in the order they connected
+func sortedClients() []*client {
+	clientsMtx.RLock()
+	list := make([]*client, 0, len(clients))
+	for _, c := range clients {
+		list = append(list, c)
+	}
+	clientsMtx.RUnlock()
+	sort.Sort(clientsByID(list))
+	return list
+}
+
+type clientsByID []*client
+
+func (c clientsByID) Len() int           { return len(c) }
+func (c clientsByID) Less(i, j int) bool { return c[i].id < c[j].id }
+func (c clientsByID) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
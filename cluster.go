@@ -7,33 +7,42 @@ import (
 
 	"github.com/cupcake/rdb"
 	"github.com/garyburd/redigo/redis"
-	"github.com/jmhodges/levigo"
 	"github.com/titanous/bconv"
 )
 
-func Restore(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Restore(args [][]byte, wb *Batch) interface{} {
 	ttl, err := bconv.ParseInt(args[1], 10, 64)
 	if err != nil {
 		return InvalidIntError
 	}
-	err = rdb.DecodeDump(args[2], 0, args[0], ttl, &rdbDecoder{wb: wb})
+	// the decoder expects an absolute expiry time
+	var expiry int64
+	if ttl > 0 {
+		expiry = unixMilli(time.Now()) + ttl
+	}
+	d := &rdbDecoder{wb: wb}
+	err = rdb.DecodeDump(args[2], 0, args[0], expiry, d)
+	if err == nil {
+		err = d.err
+	}
 	if err != nil {
 		return err
 	}
+	wb.Notify(notifyGeneric, "restore", args[0])
 	return ReplyOK
 }
 
-func Dump(args [][]byte, wb *levigo.WriteBatch) interface{} {
-	res, err := dumpKey(args[0])
+func Dump(args [][]byte, wb *Batch) interface{} {
+	res, err := dumpKey(args[0], wb)
 	if err != nil {
 		return err
 	}
 	return res
 }
 
-func dumpKey(key []byte) ([]byte, error) {
+func dumpKey(key []byte, wb *Batch) ([]byte, error) {
 	buf := &bytes.Buffer{}
-	e := &rdbEncoder{rdb.NewEncoder(buf)}
+	e := &rdbEncoder{rdb.NewEncoder(buf), wb}
 	err := e.encodeKey(key, true)
 	if err != nil {
 		return nil, err
@@ -44,19 +53,28 @@ func dumpKey(key []byte) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func Migrate(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Migrate(args [][]byte, wb *Batch) interface{} {
 	timeout, err := bconv.ParseInt(args[4], 10, 64)
 	if err != nil {
 		return InvalidIntError
 	}
 
-	data, err := dumpKey(args[2])
+	data, err := dumpKey(args[2], wb)
 	if err != nil {
 		return err
 	}
 	if data == nil {
 		return ReplyNOKEY
 	}
+	pttl, err := ttl(args[2], wb)
+	if err != nil {
+		return err
+	}
+	if pttl < 0 {
+		pttl = 0
+	} else if pttl == 0 { // the key is about to expire, but a ttl of 0 would make it persistent
+		pttl = 1
+	}
 
 	t := time.Duration(timeout) * time.Millisecond
 	r, err := redis.DialTimeout("tcp", string(args[0])+":"+string(args[1]), t, t, t)
@@ -73,7 +91,7 @@ func Migrate(args [][]byte, wb *levigo.WriteBatch) interface{} {
 		return IOError{fmt.Errorf("error or timeout performing SELECT of database %s on target instance", args[3])}
 	}
 
-	res, err = redis.String(r.Do("RESTORE", args[2], "0", data))
+	res, err = redis.String(r.Do("RESTORE", userKey(args[2]), pttl, data))
 	if _, ok := err.(redis.Error); ok {
 		return fmt.Errorf("Target instance replied with error: %s", err)
 	}
@@ -85,6 +103,7 @@ func Migrate(args [][]byte, wb *levigo.WriteBatch) interface{} {
 	if err != nil {
 		return IOError{fmt.Errorf("error deleting key from local instance: %s", err)}
 	}
+	wb.Notify(notifyGeneric, "del", args[2])
 
 	return ReplyOK
 }
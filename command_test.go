@@ -3,8 +3,15 @@ package main
 import (
 	"bytes"
 	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
 	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/jmhodges/levigo"
 	. "launchpad.net/gocheck"
@@ -129,6 +136,30 @@ var tests = []struct {
 	{"get", "foo", []byte("bazqux")},
 	{"del", "foo", 1},
 	{"exists", "foo", 0},
+	{"set", "ttlkey foo", "OK"},
+	{"ttl", "ttlkey", int64(-1)},
+	{"ttl", "nottlkey", int64(-2)},
+	{"pttl", "nottlkey", int64(-2)},
+	{"expire", "nottlkey 100", 0},
+	{"expire", "ttlkey 100", 1},
+	{"ttl", "ttlkey", int64(100)},
+	{"persist", "ttlkey", 1},
+	{"persist", "ttlkey", 0},
+	{"ttl", "ttlkey", int64(-1)},
+	{"pexpire", "ttlkey 100000", 1},
+	{"set", "ttlkey bar", "OK"},
+	{"ttl", "ttlkey", int64(-1)},
+	{"expire", "ttlkey 9223372036854775807", fmt.Errorf("invalid expire time in 'expire' command")},
+	{"pexpire", "ttlkey 9223372036854775807", fmt.Errorf("invalid expire time in 'pexpire' command")},
+	{"expireat", "ttlkey -9223372036854775808", fmt.Errorf("invalid expire time in 'expireat' command")},
+	{"ttl", "ttlkey", int64(-1)},
+	{"expireat", "ttlkey 1", 1},
+	{"exists", "ttlkey", 0},
+	{"sadd", "ttlset a", uint32(1)},
+	{"expire", "ttlset 100", 1},
+	{"srem", "ttlset a", uint32(1)},
+	{"sadd", "ttlset a", uint32(1)},
+	{"ttl", "ttlset", int64(-1)},
 	{"zadd", "asdf 1 bar", uint32(1)},
 	{"set", "asdf foo", "OK"},
 	{"get", "asdf", []byte("foo")},
@@ -228,6 +259,31 @@ var tests = []struct {
 	{"lrange", "mylist -1 -1", []interface{}{[]byte("world")}},
 	{"lrange", "mylist -2 -5", []interface{}{}},
 	{"lrange", "mylist 1 2", []interface{}{[]byte("hello"), []byte("world")}},
+	{"lrange", "mylist -10 0", []interface{}{[]byte("test")}},
+	{"lindex", "mylist 0", []byte("test")},
+	{"lindex", "mylist -1", []byte("world")},
+	{"lindex", "mylist 3", nil},
+	{"lindex", "mylist a", InvalidIntError},
+	{"lindex", "nolist 0", nil},
+	{"lset", "mylist 1 there", "OK"},
+	{"linsert", "mylist before there hi", uint32(4)},
+	{"linsert", "mylist after world end", uint32(5)},
+	{"linsert", "mylist after nothing x", -1},
+	{"linsert", "nolist after a b", 0},
+	{"lrange", "mylist 0 -1", []interface{}{[]byte("test"), []byte("hi"), []byte("there"), []byte("world"), []byte("end")}},
+	{"lindex", "mylist 1", []byte("hi")},
+	{"lindex", "mylist 3", []byte("world")},
+	{"lrem", "mylist 0 hi", int64(1)},
+	{"lrem", "mylist -1 end", int64(1)},
+	{"lrem", "mylist 1 nothing", 0},
+	{"ltrim", "mylist 1 -1", "OK"},
+	{"lrange", "mylist 0 -1", []interface{}{[]byte("there"), []byte("world")}},
+	{"ltrim", "mylist 5 10", "OK"},
+	{"exists", "mylist", 0},
+	{"rpush", "mylist test hello world", uint32(3)},
+	{"restore", "rttl 100000 " + string(stringDump), "OK"},
+	{"ttl", "rttl", int64(100)},
+	{"get", "rttl", []byte("Hello")},
 	{"restore", "r 0 " + string(stringDump), "OK"},
 	{"dump", "r", stringDump},
 	{"get", "r", []byte("Hello")},
@@ -247,15 +303,34 @@ var tests = []struct {
 	{"dump", "r", listDump},
 	{"llen", "r", uint32(2)},
 	{"lrange", "r 0 -1", []interface{}{[]byte("Hello"), []byte("World")}},
+	{"rename", "r renamed", "OK"},
+	{"exists", "r", 0},
+	{"lrange", "renamed 0 -1", []interface{}{[]byte("Hello"), []byte("World")}},
+	{"rename", "r x", NoSuchKeyError},
+	{"rename", "renamed renamed", "OK"},
+	{"rename", "rttl rttl2", "OK"},
+	{"ttl", "rttl2", int64(100)},
+	{"get", "rttl2", []byte("Hello")},
+	{"renamenx", "rttl2 renamed", 0},
+	{"rename", "rttl2 renamed", "OK"},
+	{"type", "renamed", "string"},
+	{"ttl", "renamed", int64(100)},
+	{"exists", "rttl2", 0},
+	{"restore", "r 0 " + string(zsetDump), "OK"},
+	{"renamenx", "r renamedz", 1},
+	{"zrange", "renamedz 0 -1 withscores", []interface{}{[]byte("one"), []byte("1"), []byte("uno"), []byte("1"), []byte("two"), []byte("3")}},
+	{"zscore", "renamedz two", []byte("3")},
+	{"rename", "hash renamedhash", "OK"},
+	{"type", "renamedhash", "hash"},
+	{"renamenx", "newset renamedset", 1},
+	{"type", "renamedset", "set"},
+	{"waitaof", "1 0 0", []interface{}{1, 0}},
+	{"waitaof", "1 0 x", InvalidIntError},
 }
 
 func (s CommandSuite) TestCommands(c *C) {
 	for _, t := range tests {
 		cmd := commands[t.command]
-		var wb *levigo.WriteBatch
-		if cmd.writes {
-			wb = levigo.NewWriteBatch()
-		}
 		var args [][]byte
 		if t.args != "" {
 			if cmd.arity > 0 {
@@ -264,14 +339,8 @@ func (s CommandSuite) TestCommands(c *C) {
 				args = bytes.Split([]byte(t.args), []byte(" "))
 			}
 		}
-		cmd.lockKeys(args)
-		res := cmd.function(args, wb)
-		if cmd.writes {
-			err := DB.Write(DefaultWriteOptions, wb)
-			c.Assert(err, IsNil)
-			wb.Close()
-		}
-		cmd.unlockKeys(args)
+		res, err := (&client{}).call(&cmd, args)
+		c.Assert(err, IsNil)
 		if stream, ok := res.(*cmdReplyStream); ok {
 			items := make([]interface{}, 0, int(stream.size))
 			for item := range stream.items {
@@ -287,3 +356,638 @@ func (s CommandSuite) TestCommands(c *C) {
 		c.Assert(res, DeepEquals, t.response, Commentf("%s %s, obtained=%s expected=%s", t.command, t.args, res, t.response))
 	}
 }
+
+func (s CommandSuite) TestExpire(c *C) {
+	expired := unixMilli(time.Now()) - 1
+	wb := NewBatch()
+	for _, k := range []string{"lazy", "reaped"} {
+		c.Assert(set(testKey(k), []byte("foo"), wb), IsNil)
+		c.Assert(setExpire(testKey(k), expired, wb), IsNil)
+	}
+	c.Assert(wb.Write(), IsNil)
+	wb.Close()
+
+	// keys are deleted when they are accessed
+	c.Assert(expireKeys([][]byte{testKey("lazy")}), IsNil)
+	c.Assert(Exists([][]byte{testKey("lazy")}, nil), Equals, 0)
+	c.Assert(Exists([][]byte{testKey("reaped")}, nil), Equals, 1)
+
+	// or by the reaper
+	reapExpiredKeys()
+	c.Assert(Exists([][]byte{testKey("reaped")}, nil), Equals, 0)
+	expiry, err := getExpire(testKey("reaped"), nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(expiry, Equals, int64(0))
+}
+
+var typeDumps = []struct {
+	name string
+	dump []byte
+}{
+	{"string", stringDump},
+	{"hash", hashDump},
+	{"list", listDump},
+	{"set", setDump},
+	{"zset", zsetDump},
+}
+
+func (s CommandSuite) TestOverwrite(c *C) {
+	key := testKey("overwrite")
+	for _, from := range typeDumps {
+		// RESTORE every type over every other type
+		for _, to := range typeDumps {
+			c.Assert(writeCommand(c, Restore, key, []byte("0"), from.dump), DeepEquals, ReplyOK)
+			c.Assert(writeCommand(c, Restore, key, []byte("0"), to.dump), DeepEquals, ReplyOK, Commentf("%s over %s", to.name, from.name))
+			c.Assert(Type([][]byte{key}, nil), Equals, to.name)
+			dump, err := dumpKey(key, nil)
+			c.Assert(err, IsNil)
+			c.Assert(dump, DeepEquals, to.dump, Commentf("%s over %s", to.name, from.name))
+			c.Assert(writeCommand(c, Del, key), Equals, 1)
+			c.Assert(countKeyData(key), Equals, 0, Commentf("%s over %s", to.name, from.name))
+		}
+
+		// SET over every type
+		c.Assert(writeCommand(c, Restore, key, []byte("0"), from.dump), DeepEquals, ReplyOK)
+		c.Assert(writeCommand(c, Set, key, []byte("foo")), DeepEquals, ReplyOK)
+		c.Assert(Type([][]byte{key}, nil), Equals, "string")
+		c.Assert(Get([][]byte{key}, nil), DeepEquals, []byte("foo"))
+		c.Assert(writeCommand(c, Del, key), Equals, 1)
+		c.Assert(countKeyData(key), Equals, 0, Commentf("string over %s", from.name))
+	}
+}
+
+func (s CommandSuite) TestListOperations(c *C) {
+	key := testKey("listops")
+	var expected []string
+	check := func(op string) {
+		c.Assert(Llen([][]byte{key}, nil), Equals, uint32(len(expected)), Commentf(op))
+		items := []interface{}{}
+		if res, ok := Lrange([][]byte{key, []byte("0"), []byte("-1")}, nil).(*cmdReplyStream); ok {
+			for item := range res.items {
+				items = append(items, item)
+			}
+		}
+		c.Assert(items, HasLen, len(expected), Commentf(op))
+		for i, item := range items {
+			c.Assert(string(item.([]byte)), Equals, expected[i], Commentf(op))
+			c.Assert(string(Lindex([][]byte{key, []byte(strconv.Itoa(i))}, nil).([]byte)), Equals, expected[i], Commentf(op))
+		}
+	}
+
+	// repeated inserts in the same place use up the gap and move the list again
+	writeCommand(c, Rpush, key, []byte("a"), []byte("b"), []byte("c"))
+	expected = []string{"a", "b", "c"}
+	for i := 0; i < 50; i++ {
+		v := strconv.Itoa(i)
+		c.Assert(writeCommand(c, Linsert, key, []byte("before"), []byte("c"), []byte(v)), Equals, uint32(len(expected)+1))
+		expected = append(expected[:len(expected)-1], v, "c")
+		check("linsert " + v)
+	}
+
+	// compare random operations with a slice
+	r := rand.New(rand.NewSource(1))
+	values := []string{"w", "x", "y", "z"}
+	for i := 0; i < 1000; i++ {
+		v := values[r.Intn(len(values))]
+		var op string
+		switch n := r.Intn(8); {
+		case n == 0:
+			op = "lpush " + v
+			writeCommand(c, Lpush, key, []byte(v))
+			expected = append([]string{v}, expected...)
+		case n == 1:
+			op = "rpush " + v
+			writeCommand(c, Rpush, key, []byte(v))
+			expected = append(expected, v)
+		case n == 2 && len(expected) > 0:
+			op = "lpop"
+			writeCommand(c, Lpop, key)
+			expected = expected[1:]
+		case n == 3 && len(expected) > 0:
+			op = "rpop"
+			writeCommand(c, Rpop, key)
+			expected = expected[:len(expected)-1]
+		case n == 4 && len(expected) > 0:
+			j := r.Intn(len(expected))
+			op = "lset " + strconv.Itoa(j) + " " + v
+			writeCommand(c, Lset, key, []byte(strconv.Itoa(j)), []byte(v))
+			expected[j] = v
+		case n == 5 && len(expected) > 0:
+			// the value is inserted next to the first occurrence of the pivot
+			pivot := expected[r.Intn(len(expected))]
+			j := 0
+			for expected[j] != pivot {
+				j++
+			}
+			where := "before"
+			if r.Intn(2) == 0 {
+				where = "after"
+				j++
+			}
+			op = "linsert " + where + " " + pivot + " " + v
+			writeCommand(c, Linsert, key, []byte(where), []byte(pivot), []byte(v))
+			expected = append(expected[:j], append([]string{v}, expected[j:]...)...)
+		case n == 6 && len(expected) > 0:
+			count := r.Intn(5) - 2
+			op = "lrem " + strconv.Itoa(count) + " " + v
+			writeCommand(c, Lrem, key, []byte(strconv.Itoa(count)), []byte(v))
+			var kept []string
+			if count < 0 {
+				for j := len(expected) - 1; j >= 0; j-- {
+					if expected[j] == v && count < 0 {
+						count++
+						continue
+					}
+					kept = append([]string{expected[j]}, kept...)
+				}
+			} else {
+				remove := count == 0
+				for _, item := range expected {
+					if item == v && (remove || count > 0) {
+						count--
+						continue
+					}
+					kept = append(kept, item)
+				}
+			}
+			expected = kept
+		case n == 7 && len(expected) > 4:
+			op = "ltrim 1 -2"
+			writeCommand(c, Ltrim, key, []byte("1"), []byte("-2"))
+			expected = expected[1 : len(expected)-1]
+		}
+		check(op)
+	}
+}
+
+func (s CommandSuite) TestCopyMaxSize(c *C) {
+	defer atomic.StoreInt64(&config.copyMaxSize, config.copyMaxSize)
+	atomic.StoreInt64(&config.copyMaxSize, 200)
+	call := func(name string, args ...string) interface{} {
+		cmd := commands[name]
+		res, err := (&client{}).call(&cmd, stringArgs(args))
+		c.Assert(err, IsNil)
+		return res
+	}
+
+	for i := 0; i < 20; i++ {
+		call("hset", "copybig", fmt.Sprintf("field%02d", i), "value")
+	}
+	call("hset", "copysmall", "field", "value")
+	call("set", "copydst", "foo")
+
+	// a key that is larger than copy-max-size isn't renamed or copied
+	for _, args := range [][]string{
+		{"rename", "copybig", "copydst"},
+		{"copy", "copybig", "copydst", "replace"},
+		{"move", "copybig", "1"},
+	} {
+		c.Assert(call(args[0], args[1:]...), ErrorMatches, `the key is larger than copy-max-size \(200 bytes\)`)
+	}
+	c.Assert(call("hlen", "copybig"), Equals, uint32(20))
+	c.Assert(call("get", "copydst"), DeepEquals, []byte("foo"))
+
+	c.Assert(call("rename", "copysmall", "copydst"), DeepEquals, ReplyOK)
+	c.Assert(call("hget", "copydst", "field"), DeepEquals, []byte("value"))
+
+	atomic.StoreInt64(&config.copyMaxSize, 0)
+	c.Assert(call("rename", "copybig", "copydst"), DeepEquals, ReplyOK)
+	c.Assert(call("hlen", "copydst"), Equals, uint32(20))
+}
+
+func (s CommandSuite) TestScan(c *C) {
+	for i := 0; i < 20; i++ {
+		writeCommand(c, Set, testKey(fmt.Sprintf("scan%02d", i)), []byte("foo"))
+	}
+	writeCommand(c, Sadd, testKey("scanset"), []byte("a"), []byte("b"), []byte("c"))
+	scan := func(args ...string) interface{} {
+		return Scan(append([][]byte{testKey("")}, stringArgs(args)...), nil)
+	}
+
+	// keys that exist for the whole scan are returned once, even with writes in between
+	seen := make(map[string]int)
+	cursor := "0"
+	for i := 0; ; i++ {
+		res := scan(cursor, "match", "scan*", "count", "3").([]interface{})
+		for _, k := range res[1].([]interface{}) {
+			seen[string(k.([]byte))]++
+		}
+		cursor = string(res[0].([]byte))
+		if cursor == "0" {
+			break
+		}
+		if i == 2 {
+			writeCommand(c, Del, testKey("scan19"))
+			writeCommand(c, Set, testKey("scan20"), []byte("foo"))
+		}
+	}
+	for i := 0; i < 19; i++ {
+		c.Assert(seen[fmt.Sprintf("scan%02d", i)], Equals, 1)
+	}
+	c.Assert(seen["scanset"], Equals, 1)
+	c.Assert(seen["scan19"], Equals, 0)
+
+	res := scan("0", "match", "scan*", "type", "set", "count", "1000")
+	c.Assert(res, DeepEquals, []interface{}{[]byte("0"), []interface{}{[]byte("scanset")}})
+
+	res = Sscan([][]byte{testKey("scanset"), []byte("0"), []byte("count"), []byte("2")}, nil)
+	c.Assert(res.([]interface{})[1], DeepEquals, []interface{}{[]byte("a"), []byte("b")})
+	res = Sscan([][]byte{testKey("scanset"), res.([]interface{})[0].([]byte)}, nil)
+	c.Assert(res, DeepEquals, []interface{}{[]byte("0"), []interface{}{[]byte("c")}})
+
+	writeCommand(c, Hset, testKey("scanhash"), []byte("field"), []byte("value"))
+	res = Hscan([][]byte{testKey("scanhash"), []byte("0")}, nil)
+	c.Assert(res, DeepEquals, []interface{}{[]byte("0"), []interface{}{[]byte("field"), []byte("value")}})
+
+	writeCommand(c, Zadd, testKey("scanzset"), []byte("1.5"), []byte("one"), []byte("2"), []byte("two"))
+	res = Zscan([][]byte{testKey("scanzset"), []byte("0"), []byte("match"), []byte("t*")}, nil)
+	c.Assert(res, DeepEquals, []interface{}{[]byte("0"), []interface{}{[]byte("two"), []byte("2")}})
+
+	// cursors are unsigned 64 bit integers even when the keys are long
+	long := strings.Repeat("long", 10)
+	writeCommand(c, Sadd, testKey("scanlong"), []byte(long+"a"), []byte(long+"b"))
+	res = Sscan([][]byte{testKey("scanlong"), []byte("0"), []byte("count"), []byte("1")}, nil)
+	c.Assert(res.([]interface{})[1], DeepEquals, []interface{}{[]byte(long + "a")})
+	next := res.([]interface{})[0].([]byte)
+	_, err := strconv.ParseUint(string(next), 10, 64)
+	c.Assert(err, IsNil)
+	// a cursor only continues the scan that it came from, and only once
+	c.Assert(Hscan([][]byte{testKey("scanhash"), next}, nil), ErrorMatches, "invalid cursor")
+	res = Sscan([][]byte{testKey("scanlong"), next}, nil)
+	c.Assert(res, DeepEquals, []interface{}{[]byte("0"), []interface{}{[]byte(long + "b")}})
+	c.Assert(Sscan([][]byte{testKey("scanlong"), next}, nil), ErrorMatches, "invalid cursor")
+
+	// a long scan only holds one cursor, so it doesn't drop the cursors of
+	// other scans
+	defer func(max int) { maxScanCursors = max }(maxScanCursors)
+	maxScanCursors = 5
+	res = Sscan([][]byte{testKey("scanlong"), []byte("0"), []byte("count"), []byte("1")}, nil)
+	next = res.([]interface{})[0].([]byte)
+	steps := 0
+	for cursor := "0"; steps == 0 || cursor != "0"; steps++ {
+		cursor = string(scan(cursor, "count", "1").([]interface{})[0].([]byte))
+	}
+	c.Assert(steps > maxScanCursors, Equals, true)
+	res = Sscan([][]byte{testKey("scanlong"), next}, nil)
+	c.Assert(res, DeepEquals, []interface{}{[]byte("0"), []interface{}{[]byte(long + "b")}})
+
+	c.Assert(scan("18446744073709551615"), ErrorMatches, "invalid cursor")
+	c.Assert(scan("-1"), ErrorMatches, "invalid cursor")
+	c.Assert(scan("0", "count"), Equals, SyntaxError)
+	c.Assert(Sscan([][]byte{testKey("scanset"), []byte("0"), []byte("type"), []byte("set")}, nil), Equals, SyntaxError)
+}
+
+func (s CommandSuite) TestConfigFile(c *C) {
+	saved := config
+	defer func() { config = saved }()
+
+	path := c.MkDir() + "/setdb.conf"
+	conf := "# comment\n\nport 6380\nbind 127.0.0.1\ndir \"/var/lib/setdb\"\ncache-size 1gb\nblock-size 16k\ncompression no\n"
+	c.Assert(ioutil.WriteFile(path, []byte(conf), 0644), IsNil)
+	c.Assert(readConfigFile(path, map[string]bool{"bind": true}), IsNil)
+	c.Assert(config.port, Equals, 6380)
+	c.Assert(config.bind, Equals, "")
+	c.Assert(config.dir, Equals, "/var/lib/setdb")
+	c.Assert(config.cacheSize, Equals, 1024*1024*1024)
+	c.Assert(config.blockSize, Equals, 16000)
+	c.Assert(config.compression, Equals, false)
+	c.Assert(listenAddr(), Equals, ":6380")
+	c.Assert(validateConfig(), IsNil)
+
+	for _, conf := range []string{"port 70000", "cache-size 10xb", "compression maybe", "bloom-bits x", "sync-writes maybe", "unknown 1"} {
+		c.Assert(ioutil.WriteFile(path, []byte("# comment\n"+conf), 0644), IsNil)
+		c.Assert(readConfigFile(path, nil), ErrorMatches, path+":2: .*", Commentf(conf))
+	}
+
+	config.pprof = "localhost"
+	c.Assert(validateConfig(), ErrorMatches, "invalid pprof address: .*")
+}
+
+func (s CommandSuite) TestConfig(c *C) {
+	saved := config
+	defer func() {
+		config = saved
+		configFile = ""
+		setFsyncPolicy(config.appendfsync)
+	}()
+	configCmd := func(args ...string) interface{} {
+		b := make([][]byte, len(args))
+		for i, arg := range args {
+			b[i] = []byte(arg)
+		}
+		return Config(b, nil)
+	}
+
+	c.Assert(configCmd("get", "slowlog-*"), DeepEquals, []interface{}{
+		[]byte("slowlog-log-slower-than"), []byte("10000"),
+		[]byte("slowlog-max-len"), []byte("128"),
+	})
+	c.Assert(configCmd("get", "nothing"), DeepEquals, []interface{}{})
+	c.Assert(configCmd("set", "maxclients", "100"), DeepEquals, ReplyOK)
+	c.Assert(configCmd("get", "MaxClients"), DeepEquals, []interface{}{[]byte("maxclients"), []byte("100")})
+	c.Assert(configCmd("set", "appendfsync", "Always"), DeepEquals, ReplyOK)
+	c.Assert(configCmd("get", "appendfsync"), DeepEquals, []interface{}{[]byte("appendfsync"), []byte("always")})
+	c.Assert(configCmd("set", "appendfsync", "sometimes"), ErrorMatches, "Invalid argument 'sometimes' for CONFIG SET 'appendfsync': .*")
+	// sync-writes is a deprecated alias of appendfsync
+	c.Assert(configCmd("set", "sync-writes", "no"), DeepEquals, ReplyOK)
+	c.Assert(configCmd("get", "*sync*"), DeepEquals, []interface{}{[]byte("appendfsync"), []byte("no")})
+	c.Assert(configCmd("set", "sync-writes", "yes"), DeepEquals, ReplyOK)
+	c.Assert(alwaysSync(), Equals, true)
+	c.Assert(configCmd("set", "client-output-buffer-limit", "pubsub 1mb 512kb 10"), DeepEquals, ReplyOK)
+	c.Assert(configCmd("get", "client-output-buffer-limit"), DeepEquals, []interface{}{
+		[]byte("client-output-buffer-limit"), []byte("normal 0 0 0 pubsub 1048576 524288 10"),
+	})
+	c.Assert(configCmd("set", "client-output-buffer-limit", "replica 0 0 0"), ErrorMatches, ".*'replica' must be normal or pubsub")
+	c.Assert(configCmd("set", "client-output-buffer-limit", "normal 1mb"), ErrorMatches, ".*the limits must be .*")
+	c.Assert(configCmd("set", "client-output-buffer-limit", "pubsub 32mb 8mb 60"), DeepEquals, ReplyOK)
+	c.Assert(configCmd("set", "maxclients", "0"), ErrorMatches, "Invalid argument '0' for CONFIG SET 'maxclients': .*")
+	c.Assert(configCmd("set", "port", "6380"), ErrorMatches, "CONFIG SET failed, port can't be changed while the server is running")
+	c.Assert(configCmd("set", "unknown", "1"), ErrorMatches, "Unsupported CONFIG parameter: unknown")
+	c.Assert(configCmd("rewrite"), ErrorMatches, "Rewriting config file: the server is running without a config file")
+
+	configFile = c.MkDir() + "/setdb.conf"
+	c.Assert(ioutil.WriteFile(configFile, []byte("# comment\nport 6380\nmaxclients 10\nmaxclients 20\nsync-writes no\n"), 0644), IsNil)
+	c.Assert(configCmd("rewrite"), DeepEquals, ReplyOK)
+	data, err := ioutil.ReadFile(configFile)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "# comment\nport 12345\nmaxclients 100\nappendfsync always\n")
+
+	// every command is slower than 0 microseconds
+	c.Assert(configCmd("set", "slowlog-log-slower-than", "0"), DeepEquals, ReplyOK)
+	c.Assert(configCmd("set", "slowlog-max-len", "2"), DeepEquals, ReplyOK)
+	c.Assert(Slowlog([][]byte{[]byte("reset")}, nil), DeepEquals, ReplyOK)
+	cmd := commands["get"]
+	for _, key := range []string{"a", "b", "c"} {
+		(&client{}).call(&cmd, [][]byte{[]byte(key)})
+	}
+	c.Assert(Slowlog([][]byte{[]byte("len")}, nil), Equals, 2)
+	res := Slowlog([][]byte{[]byte("get"), []byte("1")}, nil).([]interface{})
+	c.Assert(res, HasLen, 1)
+	c.Assert(res[0].([]interface{})[3], DeepEquals, []interface{}{[]byte("get"), []byte("c")})
+
+	// passwords aren't kept in the slow log or returned by CONFIG GET
+	for _, cmd := range []struct{ args, logged string }{
+		{"auth user pass", "auth (redacted) (redacted)"},
+		{"config set requirepass pass", "config set requirepass (redacted)"},
+		{"config set maxclients 100", "config set maxclients 100"},
+		{"acl setuser user on >pass #" + strings.Repeat("a", 64) + " ~* +@all", "acl setuser user on (redacted) (redacted) ~* +@all"},
+	} {
+		args := bytes.Split([]byte(cmd.args), []byte(" "))
+		logSlowCommand(string(args[0]), args[1:], time.Now())
+		res := Slowlog([][]byte{[]byte("get"), []byte("1")}, nil).([]interface{})
+		logged := res[0].([]interface{})[3].([]interface{})
+		words := make([]string, len(logged))
+		for i, arg := range logged {
+			words[i] = string(arg.([]byte))
+		}
+		c.Assert(strings.Join(words, " "), Equals, cmd.logged)
+	}
+	c.Assert(configCmd("get", "requirepass"), DeepEquals, []interface{}{[]byte("requirepass"), []byte("")})
+	config.requirepass = "pass"
+	c.Assert(configCmd("get", "requirepass"), DeepEquals, []interface{}{[]byte("requirepass"), []byte("(redacted)")})
+	config.requirepass = ""
+}
+
+func (s CommandSuite) TestInfo(c *C) {
+	info := func(args ...string) string {
+		b := make([][]byte, len(args))
+		for i, arg := range args {
+			b[i] = []byte(arg)
+		}
+		return string(Info(b, nil).([]byte))
+	}
+
+	res := info()
+	c.Assert(res, Matches, "(?s)# Server\r\nsetdb_version:.*\r\n\r\n# Clients\r\n.*# LevelDB\r\n.*leveldb_approximate_size_string:\\d+\r\n.*")
+	c.Assert(strings.Contains(res, "# Commandstats"), Equals, false)
+	c.Assert(info("nothing"), Equals, "")
+
+	writeCommand(c, Set, testKey("infokey"), []byte("foo"))
+	c.Assert(info("KEYSPACE"), Matches, "# Keyspace\r\ndb0:keys=\\d+,expires=\\d+,string=\\d+,hash=\\d+,list=\\d+,set=\\d+,zset=\\d+\r\n")
+
+	cmd := commands["get"]
+	(&client{}).call(&cmd, [][]byte{[]byte("infokey")})
+	c.Assert(info("commandstats"), Matches, "(?s).*\r\ncmdstat_get:calls=\\d+,usec=\\d+,usec_per_call=\\d+\\.\\d\\d\r\n.*")
+}
+
+func (s CommandSuite) TestKeyCounts(c *C) {
+	// the counts kept by every test that has run match a full scan
+	before := allKeyCounts()
+	c.Assert(Debug([][]byte{[]byte("recount")}, nil), DeepEquals, ReplyOK)
+	c.Assert(allKeyCounts(), DeepEquals, before)
+
+	id := keyDB(testKey(""))
+	key := testKey("countkey")
+	writeCommand(c, Del, key)
+	db0 := currentKeyCounts(id)
+	expect := func(string, hash, expires int64) {
+		c.Assert(Dbsize([][]byte{testKey("")}, nil), Equals, db0.keys()+string+hash)
+		now := currentKeyCounts(id)
+		c.Assert(now[countString]-db0[countString], Equals, string)
+		c.Assert(now[countHash]-db0[countHash], Equals, hash)
+		c.Assert(now[countExpires]-db0[countExpires], Equals, expires)
+	}
+
+	writeCommand(c, Set, key, []byte("foo"))
+	expect(1, 0, 0)
+	writeCommand(c, Set, key, []byte("bar"))
+	expect(1, 0, 0)
+	writeCommand(c, Expire, key, []byte("100"))
+	expect(1, 0, 1)
+	writeCommand(c, Restore, key, []byte("0"), hashDump)
+	expect(0, 1, 0)
+	writeCommand(c, Hdel, key, []byte("field1"), []byte("field2"))
+	expect(0, 0, 0)
+
+	// a transaction counts the final state of each key
+	tx := newOverlayBatch(nil)
+	for _, v := range []string{"a", "b"} {
+		wb := newOverlayBatch(tx)
+		Sadd([][]byte{key, []byte(v)}, wb)
+		c.Assert(wb.Write(), IsNil)
+	}
+	wb := newOverlayBatch(tx)
+	Set([][]byte{key, []byte("foo")}, wb)
+	c.Assert(wb.Write(), IsNil)
+	c.Assert(tx.Write(), IsNil)
+	expect(1, 0, 0)
+
+	// a recount fixes counts that are wrong
+	countsMtx.Lock()
+	wrong := counts[id]
+	wrong[countString] += 10
+	counts[id] = wrong
+	countsMtx.Unlock()
+	c.Assert(Debug([][]byte{[]byte("recount")}, nil), DeepEquals, ReplyOK)
+	expect(1, 0, 0)
+	c.Assert(loadKeyCounts(), IsNil)
+	expect(1, 0, 0)
+}
+
+// run a write command and commit the batch
+func writeCommand(c *C, f cmdFunc, args ...[]byte) interface{} {
+	wb := NewBatch()
+	defer wb.Close()
+	res := f(args, wb)
+	c.Assert(wb.Write(), IsNil)
+	return res
+}
+
+// returns key in database 0
+func testKey(key string) []byte {
+	return dbKey(currentDatabases().prefix(0), []byte(key))
+}
+
+func stringArgs(args []string) [][]byte {
+	b := make([][]byte, len(args))
+	for i, arg := range args {
+		b[i] = []byte(arg)
+	}
+	return b
+}
+
+// count the data keys of every type that are stored for key
+func countKeyData(key []byte) int {
+	var n int
+	res, _ := DB.Get(DefaultReadOptions, stringKey(key))
+	if res != nil {
+		n++
+	}
+	it := DB.NewIterator(DefaultReadOptions)
+	defer it.Close()
+	for _, t := range []byte{HashKey, ListKey, SetKey, ZSetKey, ZScoreKey} {
+		iterKey := NewKeyBuffer(t, key, 0)
+		for it.Seek(iterKey.Key()); it.Valid() && iterKey.IsPrefixOf(it.Key()); it.Next() {
+			n++
+		}
+	}
+	return n
+}
+
+func (s CommandSuite) TestGetKeys(c *C) {
+	tests := []struct {
+		command string
+		args    string
+		keys    [][]byte
+	}{
+		{"get", "foo", [][]byte{[]byte("foo")}},
+		{"del", "foo bar baz", [][]byte{[]byte("foo"), []byte("bar"), []byte("baz")}},
+		{"smove", "foo bar baz", [][]byte{[]byte("foo"), []byte("bar")}},
+		{"copy", "foo bar db 1 replace", [][]byte{[]byte("foo"), []byte("bar")}},
+		{"move", "foo 1", [][]byte{[]byte("foo")}},
+		{"migrate", "host port foo 0 100", [][]byte{[]byte("foo")}},
+		{"zunionstore", "dest 2 foo bar weights 1 2", [][]byte{[]byte("dest"), []byte("foo"), []byte("bar")}},
+		{"ping", "", nil},
+	}
+	for _, t := range tests {
+		cmd := commands[t.command]
+		var args [][]byte
+		if t.args != "" {
+			args = bytes.Split([]byte(t.args), []byte(" "))
+		}
+		c.Assert(cmd.getKeys(args), DeepEquals, t.keys, Commentf("%s %s", t.command, t.args))
+	}
+}
+
+func (s CommandSuite) TestMigrateKeys(c *C) {
+	// a string with an expiry in the layout from before there were databases,
+	// with the first phase of the migration done
+	key := []byte("oldkey")
+	oldStringKey := append([]byte{StringKey, 0, 0, 0, byte(len(key))}, key...)
+	oldExpireTimeKey := append([]byte{ExpireTimeKey, 0, 0, 0, 0, 0, 0, 0, 1}, key...)
+	for k, v := range map[string][]byte{
+		string(append([]byte{MetaKey}, key...)):   {StringLengthValue, 0, 0, 0, 3},
+		string(oldStringKey):                      []byte("old"),
+		string(append([]byte{ExpireKey}, key...)): {0, 0, 0, 0, 0, 0, 0, 1},
+		string(oldExpireTimeKey):                  nil,
+	} {
+		c.Assert(DB.Put(DefaultWriteOptions, append([]byte{MigrationKey}, k...), v), IsNil)
+	}
+	c.Assert(DB.Put(DefaultWriteOptions, []byte{MigrationKey}, []byte{}), IsNil)
+
+	c.Assert(migrateKeys(dbPrefix(100)), IsNil)
+	c.Assert(DB.Delete(DefaultWriteOptions, []byte{MigrationKey}), IsNil)
+	k := dbKey(dbPrefix(100), key)
+	res, err := DB.Get(DefaultReadOptions, stringKey(k))
+	c.Assert(err, IsNil)
+	c.Assert(res, DeepEquals, []byte("old"))
+	res, err = DB.Get(DefaultReadOptions, metaKey(k))
+	c.Assert(err, IsNil)
+	c.Assert(res, DeepEquals, []byte{StringLengthValue, 0, 0, 0, 3})
+	res, err = DB.Get(DefaultReadOptions, expireTimeKey(k, 1))
+	c.Assert(err, IsNil)
+	c.Assert(res, NotNil)
+
+	it := DB.NewIterator(DefaultReadOptions)
+	defer it.Close()
+	it.Seek([]byte{MigrationKey})
+	c.Assert(it.Valid() && it.Key()[0] == MigrationKey, Equals, false)
+	c.Assert(deleteDatabase(100), IsNil)
+}
+
+// Compare committing the batches of many clients at once in separate writes
+// with committing them in groups.
+func BenchmarkCommit(b *testing.B) {
+	if DB == nil {
+		os.RemoveAll("db")
+		openDB()
+	}
+	commit := map[string]func(wb *Batch) error{
+		"separate": func(wb *Batch) error {
+			d, err := wb.countDelta()
+			if err != nil {
+				return err
+			}
+			lwb := levigo.NewWriteBatch()
+			defer lwb.Close()
+			for _, w := range wb.writes {
+				if w.value == nil {
+					lwb.Delete(w.key)
+				} else {
+					lwb.Put(w.key, w.value)
+				}
+			}
+			opts := DefaultWriteOptions
+			if alwaysSync() {
+				opts = SyncWriteOptions
+			}
+			if d != nil {
+				return writeWithCounts(lwb, d, opts)
+			}
+			return DB.Write(opts, lwb)
+		},
+		"grouped": func(wb *Batch) error {
+			return wb.Write()
+		},
+	}
+	var n int64
+	defer setFsyncPolicy(config.appendfsync)
+	for _, sync := range []bool{false, true} {
+		if sync {
+			setFsyncPolicy("always")
+		} else {
+			setFsyncPolicy("no")
+		}
+		for _, name := range []string{"separate", "grouped"} {
+			f := commit[name]
+			if sync {
+				name += "-sync"
+			}
+			b.Run(name, func(b *testing.B) {
+				b.SetParallelism(16)
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						key := testKey(fmt.Sprintf("commit-%d", atomic.AddInt64(&n, 1)))
+						wb := NewBatch()
+						if err := set(key, []byte("value"), wb); err != nil {
+							b.Fatal(err)
+						}
+						if err := f(wb); err != nil {
+							b.Fatal(err)
+						}
+					}
+				})
+			})
+		}
+	}
+}
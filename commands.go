@@ -8,7 +8,6 @@ import (
 	"time"
 
 	"github.com/cupcake/setdb/lockring"
-	"github.com/jmhodges/levigo"
 	"github.com/titanous/bconv"
 )
 
@@ -28,6 +27,11 @@ const (
 	ListLengthValue
 	SetCardValue
 	ZCardValue
+	ExpireKey
+	ExpireTimeKey
+	CountKey
+	DatabasesKey
+	MigrationKey
 )
 
 var (
@@ -38,9 +42,10 @@ var (
 )
 
 var (
-	ReplyOK    = rawReply("+OK\r\n")
-	ReplyPONG  = rawReply("+PONG\r\n")
-	ReplyNOKEY = rawReply("+NOKEY\r\n")
+	ReplyOK     = rawReply("+OK\r\n")
+	ReplyPONG   = rawReply("+PONG\r\n")
+	ReplyNOKEY  = rawReply("+NOKEY\r\n")
+	ReplyQUEUED = rawReply("+QUEUED\r\n")
 )
 
 type IOError struct{ error }
@@ -67,23 +72,25 @@ type rawReply []byte
 // nil []interface{} - nil multi-bulk reply, serialized as "*-1\r\n"
 // map[string]bool - multi-bulk reply (used by SUNION)
 // *cmdReplyStream - multi-bulk reply sent over a channel
-type cmdFunc func(args [][]byte, wb *levigo.WriteBatch) interface{}
+type cmdFunc func(args [][]byte, wb *Batch) interface{}
 
 type cmdDesc struct {
 	name      string
 	function  cmdFunc
-	arity     int                     // the number of required arguments, -n means >= n
-	writes    bool                    // false if the command doesn't write data (the WriteBatch will not be passed in)
-	firstKey  int                     // first argument that is a key (-1 for none)
-	lastKey   int                     // last argument that is a key (-1 for unbounded)
-	keyStep   int                     // step to get all the keys from first to last. For instance MSET is 2 since the arguments are KEY VAL KEY VAL...
-	keyLookup func([][]byte) [][]byte // function that extracts the keys from the args
+	arity     int                  // the number of required arguments, -n means >= n
+	writes    bool                 // false if the command doesn't write data (the WriteBatch will not be passed in)
+	firstKey  int                  // first argument that is a key (-1 for none)
+	lastKey   int                  // last argument that is a key (negative counts from the end, -1 for unbounded)
+	keyStep   int                  // step to get all the keys from first to last. For instance MSET is 2 since the arguments are KEY VAL KEY VAL...
+	keyLookup func([][]byte) []int // function that returns the indexes of the keys in the args
 }
 
 var commandList = []cmdDesc{
 	{"del", Del, -1, true, 0, -1, 1, nil},
 	{"echo", Echo, 1, false, -1, 0, 0, nil},
 	{"exists", Exists, 1, false, 0, 0, 0, nil},
+	{"expire", Expire, 2, true, 0, 0, 0, nil},
+	{"expireat", Expireat, 2, true, 0, 0, 0, nil},
 	{"get", Get, 1, false, 0, 0, 0, nil},
 	{"hdel", Hdel, -2, true, 0, 0, 0, nil},
 	{"hexists", Hexists, 2, false, 0, 0, 0, nil},
@@ -99,6 +106,10 @@ var commandList = []cmdDesc{
 	{"hsetnx", Hsetnx, 3, true, 0, 0, 0, nil},
 	{"hvals", Hvals, 1, false, 0, 0, 0, nil},
 	{"keys", Keys, 1, false, -1, 0, 0, nil},
+	{"scan", Scan, -1, false, -1, 0, 0, nil},
+	{"sscan", Sscan, -2, false, 0, 0, 0, nil},
+	{"hscan", Hscan, -2, false, 0, 0, 0, nil},
+	{"zscan", Zscan, -2, false, 0, 0, 0, nil},
 	{"llen", Llen, 1, false, 0, 0, 0, nil},
 	{"lpush", Lpush, -2, true, 0, 0, 0, nil},
 	{"lpushx", Lpushx, 2, true, 0, 0, 0, nil},
@@ -108,8 +119,27 @@ var commandList = []cmdDesc{
 	{"rpop", Rpop, 1, true, 0, 0, 0, nil},
 	{"rpoplpush", Rpoplpush, 2, true, 0, 1, 0, nil},
 	{"lrange", Lrange, 3, false, 0, 0, 0, nil},
+	{"lindex", Lindex, 2, false, 0, 0, 0, nil},
+	{"lset", Lset, 3, true, 0, 0, 0, nil},
+	{"linsert", Linsert, 4, true, 0, 0, 0, nil},
+	{"lrem", Lrem, 3, true, 0, 0, 0, nil},
+	{"ltrim", Ltrim, 3, true, 0, 0, 0, nil},
+	{"persist", Persist, 1, true, 0, 0, 0, nil},
+	{"pexpire", Pexpire, 2, true, 0, 0, 0, nil},
+	{"pexpireat", Pexpireat, 2, true, 0, 0, 0, nil},
 	{"ping", Ping, 0, false, -1, 0, 0, nil},
+	{"pttl", Pttl, 1, false, 0, 0, 0, nil},
+	{"publish", Publish, 2, false, -1, 0, 0, nil},
+	{"pubsub", Pubsub, -1, false, -1, 0, 0, nil},
+	{"config", Config, -1, false, -1, 0, 0, nil},
+	{"slowlog", Slowlog, -1, false, -1, 0, 0, nil},
+	{"info", Info, 0, false, -1, 0, 0, nil},
+	{"dbsize", Dbsize, 0, false, -1, 0, 0, nil},
+	{"debug", Debug, -1, false, -1, 0, 0, nil},
 	{"append", Append, 2, true, 0, 0, 0, nil},
+	{"blpop", Blpop, -2, true, 0, -2, 1, nil},
+	{"brpop", Brpop, -2, true, 0, -2, 1, nil},
+	{"brpoplpush", Brpoplpush, 3, true, 0, 1, 0, nil},
 	{"set", Set, 2, true, 0, 0, 0, nil},
 	{"sadd", Sadd, -2, true, 0, 0, 0, nil},
 	{"scard", Scard, 1, false, 0, 0, 0, nil},
@@ -125,7 +155,9 @@ var commandList = []cmdDesc{
 	{"sdiff", Sdiff, -1, false, 0, -1, 1, nil},
 	{"sdiffstore", Sdiffstore, -2, true, 0, -1, 1, nil},
 	{"time", Time, 0, false, -1, 0, 0, nil},
+	{"ttl", Ttl, 1, false, 0, 0, 0, nil},
 	{"type", Type, 1, false, 0, 0, 0, nil},
+	{"unwatch", Unwatch, 0, false, -1, 0, 0, nil},
 	{"zadd", Zadd, -3, true, 0, 0, 0, nil},
 	{"zcard", Zcard, 1, false, 0, 0, 0, nil},
 	{"zincrby", Zincrby, 3, true, 0, 0, 0, nil},
@@ -144,26 +176,26 @@ var commandList = []cmdDesc{
 	{"restore", Restore, 3, true, 0, 0, 0, nil},
 	{"dump", Dump, 1, false, 0, 0, 0, nil},
 	{"migrate", Migrate, 5, true, 2, 2, 0, nil},
-	{"select", Select, 1, false, 0, 0, 0, nil},
+	{"rename", Rename, 2, true, 0, 1, 0, nil},
+	{"renamenx", Renamenx, 2, true, 0, 1, 0, nil},
+	{"copy", Copy, -2, true, 0, 1, 0, nil},
+	{"move", Move, 2, true, 0, 0, 0, moveKeys},
+	{"waitaof", Waitaof, 3, false, -1, 0, 0, nil},
 }
 
 // extract the keys from the command args
 func (c *cmdDesc) getKeys(args [][]byte) [][]byte {
-	// if a key lookup function was specified, use it
-	if c.keyLookup != nil {
-		return c.keyLookup(args)
-	}
-	// if no keys are expected, or the argument with the first key doesn't exist
-	if c.firstKey < 0 || len(args) <= c.firstKey {
-		return nil
-	}
-	// shortcut: if the keystep is 0 or 1, we can slice the array
-	if c.keyStep <= 1 {
-		return args[c.firstKey : c.lastKey+1]
+	// shortcut: if the keys are consecutive arguments, we can slice the array
+	if c.keyLookup == nil && c.keyStep <= 1 {
+		first, last := c.keyRange(args)
+		if last < first {
+			return nil
+		}
+		return args[first : last+1]
 	}
 	keys := make([][]byte, 0, 1)
 keyloop:
-	for i := c.firstKey; i < len(args) && (c.lastKey == -1 || i <= c.lastKey); i += c.keyStep {
+	for _, i := range c.keyIndexes(args) {
 		for _, k := range keys {
 			// skip keys that are already in the array
 			if bytes.Equal(k, args[i]) {
@@ -175,44 +207,85 @@ keyloop:
 	return keys
 }
 
+// returns the indexes of the arguments that are keys
+func (c *cmdDesc) keyIndexes(args [][]byte) []int {
+	// if a key lookup function was specified, use it
+	if c.keyLookup != nil {
+		return c.keyLookup(args)
+	}
+	first, last := c.keyRange(args)
+	step := c.keyStep
+	if step < 1 {
+		step = 1
+	}
+	var indexes []int
+	for i := first; i <= last; i += step {
+		indexes = append(indexes, i)
+	}
+	return indexes
+}
+
+// returns the first and last arguments that are keys, last is less than first
+// if there aren't any
+func (c *cmdDesc) keyRange(args [][]byte) (first, last int) {
+	// if no keys are expected, or the argument with the first key doesn't exist
+	if c.firstKey < 0 || len(args) <= c.firstKey {
+		return 0, -1
+	}
+	last = c.lastKey
+	if last < 0 {
+		last += len(args)
+	}
+	if last >= len(args) {
+		last = len(args) - 1
+	}
+	return c.firstKey, last
+}
+
 // acquires a read or write lock for the keys in arguments using the cmdDesc
 func (c *cmdDesc) lockKeys(args [][]byte) {
-	if !c.writes {
+	keys := c.getKeys(args)
+	if len(keys) == 0 {
 		return
 	}
-	for _, k := range c.getKeys(args) {
-		KeyMutex.Lock(k)
+	if c.writes {
+		KeyMutex.LockMany(keys)
+	} else {
+		KeyMutex.RLockMany(keys)
 	}
 }
 
 func (c *cmdDesc) unlockKeys(args [][]byte) {
-	if !c.writes {
+	keys := c.getKeys(args)
+	if len(keys) == 0 {
 		return
 	}
-	for _, k := range c.getKeys(args) {
-		KeyMutex.Unlock(k)
+	if c.writes {
+		KeyMutex.UnlockMany(keys)
+	} else {
+		KeyMutex.RUnlockMany(keys)
 	}
 }
 
 var commands = make(map[string]cmdDesc, len(commandList))
 
-func Ping(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Ping(args [][]byte, wb *Batch) interface{} {
 	return ReplyPONG
 }
 
-func Echo(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Echo(args [][]byte, wb *Batch) interface{} {
 	return args[0]
 }
 
-func Time(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Time(args [][]byte, wb *Batch) interface{} {
 	now := time.Now()
 	secs := strconv.AppendInt(nil, now.Unix(), 10)
 	micros := strconv.AppendInt(nil, int64(now.Nanosecond()/1000), 10)
 	return []interface{}{secs, micros}
 }
 
-func Exists(args [][]byte, wb *levigo.WriteBatch) interface{} {
-	res, err := DB.Get(DefaultReadOptions, metaKey(args[0]))
+func Exists(args [][]byte, wb *Batch) interface{} {
+	res, err := wb.Get(DefaultReadOptions, metaKey(args[0]))
 	if err != nil {
 		return err
 	}
@@ -222,8 +295,8 @@ func Exists(args [][]byte, wb *levigo.WriteBatch) interface{} {
 	return 1
 }
 
-func Type(args [][]byte, wb *levigo.WriteBatch) interface{} {
-	res, err := DB.Get(DefaultReadOptions, metaKey(args[0]))
+func Type(args [][]byte, wb *Batch) interface{} {
+	res, err := wb.Get(DefaultReadOptions, metaKey(args[0]))
 	if err != nil {
 		return err
 	}
@@ -233,7 +306,18 @@ func Type(args [][]byte, wb *levigo.WriteBatch) interface{} {
 	if len(res) == 0 {
 		return InvalidDataError
 	}
-	switch res[0] {
+	if t := typeName(res); t != "" {
+		return t
+	}
+	panic("unknown type")
+}
+
+// returns the name of the type of the metadata value v
+func typeName(v []byte) string {
+	if len(v) == 0 {
+		return ""
+	}
+	switch v[0] {
 	case StringLengthValue:
 		return "string"
 	case HashLengthValue:
@@ -245,39 +329,45 @@ func Type(args [][]byte, wb *levigo.WriteBatch) interface{} {
 	case ZCardValue:
 		return "zset"
 	}
-	panic("unknown type")
+	return ""
 }
 
-func Keys(args [][]byte, wb *levigo.WriteBatch) interface{} {
-	it := DB.NewIterator(ReadWithoutCacheFill)
+// KEYS is a keyspace command, args[0] is the prefix of the database
+func Keys(args [][]byte, wb *Batch) interface{} {
+	it := wb.NewIterator(ReadWithoutCacheFill)
 	defer it.Close()
 	keys := []interface{}{}
-	pattern := string(args[0])
+	prefix := append([]byte{MetaKey}, args[0]...)
+	pattern := string(args[1])
+	now := unixMilli(time.Now())
 
-	for it.Seek([]byte{MetaKey}); it.Valid(); it.Next() {
+	for it.Seek(prefix); it.Valid(); it.Next() {
 		k := it.Key()
-		// if the first byte isn't MetaKey, we've reached the end
-		if len(k) < 2 || k[0] != MetaKey {
+		// if the key isn't in the database, we've reached the end
+		if !bytes.HasPrefix(k, prefix) {
 			break
 		}
 		// filepatch.Match() implements the same pattern syntax as we want
-		matched, err := filepath.Match(pattern, string(k[1:]))
+		matched, err := filepath.Match(pattern, string(k[len(prefix):]))
 		if err != nil {
 			return fmt.Errorf("invalid pattern for 'keys' command")
 		}
 		if matched {
-			keys = append(keys, k[1:])
+			// skip keys that have expired but haven't been reaped yet
+			expiry, err := getExpire(k[1:], nil, wb)
+			if err != nil {
+				return err
+			}
+			if expiry > 0 && expiry <= now {
+				continue
+			}
+			keys = append(keys, k[len(prefix):])
 		}
 	}
 	return keys
 }
 
-// No-op for now
-func Select(args [][]byte, wb *levigo.WriteBatch) interface{} {
-	return ReplyOK
-}
-
-func Del(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Del(args [][]byte, wb *Batch) interface{} {
 	deleted := 0
 	k := make([]byte, 1, len(args[0])) // make a reusable slice with room for the first metakey
 
@@ -288,14 +378,15 @@ func Del(args [][]byte, wb *levigo.WriteBatch) interface{} {
 			return err
 		}
 		if d {
+			wb.Notify(notifyGeneric, "del", key)
 			deleted++
 		}
 	}
 	return deleted
 }
 
-func delKey(key []byte, wb *levigo.WriteBatch) (deleted bool, err error) {
-	res, err := DB.Get(ReadWithoutCacheFill, key)
+func delKey(key []byte, wb *Batch) (deleted bool, err error) {
+	res, err := wb.Get(ReadWithoutCacheFill, key)
 	if err != nil {
 		return
 	}
@@ -306,16 +397,21 @@ func delKey(key []byte, wb *levigo.WriteBatch) (deleted bool, err error) {
 		return false, InvalidDataError
 	}
 	del(key[1:], res[0], wb)
-	wb.Delete(key)
+	err = delMetaKey(key, wb)
+	if err != nil {
+		return
+	}
 	return true, nil
 }
 
-func del(key []byte, t byte, wb *levigo.WriteBatch) {
+func del(key []byte, t byte, wb *Batch) {
 	switch t {
 	case StringLengthValue:
 		DelString(key, wb)
 	case HashLengthValue:
 		DelHash(key, wb)
+	case ListLengthValue:
+		DelList(key, wb)
 	case SetCardValue:
 		DelSet(key, wb)
 	case ZCardValue:
@@ -325,6 +421,12 @@ func del(key []byte, t byte, wb *levigo.WriteBatch) {
 	}
 }
 
+// delete the metakey mk along with any expiry set on the key
+func delMetaKey(mk []byte, wb *Batch) error {
+	wb.Delete(mk)
+	return delExpire(mk[1:], wb)
+}
+
 // set buf to the metaKey for key
 func bufMetaKey(buf []byte, key []byte) []byte {
 	buf[0] = MetaKey
@@ -349,12 +451,15 @@ func parseRange(args [][]byte, length int64) (int64, int64, error) {
 	// so add it to the length to get the absolute index
 	if start < 0 {
 		start += length
+		if start < 0 {
+			start = 0
+		}
 	}
 	if end < 0 {
 		end += length
 	}
 
-	if end > length { // limit the end to the last member
+	if end >= length { // limit the end to the last member
 		end = length - 1
 	}
 
@@ -368,35 +473,11 @@ func init() {
 }
 
 // Keys
-// EXPIRE
-// EXPIREAT
-// MOVE
 // OBJECT?
-// PERSIST
-// PEXPIRE
-// PEXPIREAT
-// PTTL
 // RANDOMKEY
-// RENAME
-// RENAMENX
 // SORT
-// TTL
 // TYPE
 //
-// Pub/Sub
-// PSUBSCRIBE
-// PUNSUBSCRIBE
-// UNSUBSCRIBE
-// PUBLISH
-// SUBSCRIBE
-//
-// Transactions
-// DISCARD
-// MULTI
-// EXEC
-// WATCH
-// UNWATCH
-//
 // Scripting
 // EVAL
 // EVALSHA
@@ -405,24 +486,9 @@ func init() {
 // SCRIPT FLUSH
 // SCRIPT LOAD
 //
-// Connection
-// AUTH
-// SELECT
-// QUIT
-//
 // Server
-// FLUSHALL
-// FLUSHDB
 // SYNC
 // CONFIG RESETSTAT
-// INFO
-// DBSIZE
-// CLIENT LIST
-// CLIENT KILL
 // MONITOR
-// CONFIG GET
-// CONFIG SET
 // SLAVEOF
-// SHUTDOWN
 // SAVE
-// SLOWLOG
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmhodges/levigo"
+	"github.com/titanous/bconv"
+)
+
+// Group commit
+//
+// The writes of every Batch are committed by a single committer goroutine.
+// While it's writing a group, the batches of the other clients queue up, and
+// they are all committed together in the next LevelDB write, so many clients
+// writing at once share each write instead of each doing their own.
+//
+// A client waits for its batch to be written before it gets the reply and
+// its keys are unlocked, so the batches in a group never write the same keys,
+// and a client's replies and writes stay in the order of its commands. When a
+// client pipelines write commands, the batches of the commands that are already
+// buffered are all queued before it waits for the first one, so a bulk load
+// from a single client is grouped as well, see callPipeline.
+//
+// appendfsync decides when the writes are synced to disk, like Redis:
+//
+// always - every group is synced before the clients get their replies
+// everysec - once a second, if there were writes, an empty synced write syncs
+//            the LevelDB log with the writes before it
+// no - the OS writes the log to disk when it wants to
+//
+// The writes that aren't made by commands, like the changes to the databases,
+// the deletion of flushed databases and DEBUG RECOUNT, are committed the same
+// way so that they follow appendfsync too.
+//
+// WAITAOF syncs the writes that were made before it, so a client can make its
+// writes durable when they matter more than the others.
+
+// the most batches that are committed in one write
+const maxCommitGroup = 512
+
+const (
+	fsyncNo int32 = iota
+	fsyncEverysec
+	fsyncAlways
+)
+
+type commitRequest struct {
+	writes batchWrites
+	counts map[uint16]keyCounts // the changes to the key counts, or nil
+	sync   bool                 // the group must be synced
+	close  bool                 // close the database after the group is written
+	done   chan error
+}
+
+var (
+	commitQueue = make(chan *commitRequest, maxCommitGroup)
+
+	fsyncPolicy      = fsyncEverysec // accessed atomically
+	unsynced         int32           // 1 if there are writes that haven't been synced, accessed atomically
+	batchesCommitted int64           // accessed atomically
+	groupsCommitted  int64           // accessed atomically
+)
+
+// set the appendfsync policy
+func setFsyncPolicy(s string) error {
+	var policy int32
+	switch strings.ToLower(s) {
+	case "always":
+		policy = fsyncAlways
+	case "everysec":
+		policy = fsyncEverysec
+	case "no":
+		policy = fsyncNo
+	default:
+		return fmt.Errorf("'%s' must be always, everysec or no", s)
+	}
+	atomic.StoreInt32(&fsyncPolicy, policy)
+	return nil
+}
+
+// returns true if every write is synced
+func alwaysSync() bool {
+	return atomic.LoadInt32(&fsyncPolicy) == fsyncAlways
+}
+
+// write writes that aren't made by a command, along with the batches of the
+// clients that are being committed
+func commitWrites(writes batchWrites) error {
+	return commit(&commitRequest{writes: writes})
+}
+
+// sync the writes that have been committed to disk
+func syncWrites() error {
+	return commit(&commitRequest{sync: true})
+}
+
+// Close the database once the writes that are being committed are written,
+// syncing them if sync is set. Writes committed after it fail.
+func closeWrites(sync bool) error {
+	return commit(&commitRequest{sync: sync, close: true})
+}
+
+func commit(r *commitRequest) error {
+	return <-queueCommit(r).done
+}
+
+// queue r to be committed without waiting for it, its done channel receives
+// the result once it's written
+func queueCommit(r *commitRequest) *commitRequest {
+	r.done = make(chan error, 1)
+	commitQueue <- r
+	return r
+}
+
+// sync the writes once a second with appendfsync everysec
+func syncer() {
+	tick := time.Tick(time.Second)
+	for {
+		select {
+		case <-tick:
+		case <-shuttingDown:
+			return
+		}
+		if atomic.LoadInt32(&fsyncPolicy) != fsyncEverysec || atomic.LoadInt32(&unsynced) == 0 {
+			continue
+		}
+		if err := syncWrites(); err != nil {
+			log.Printf("Error syncing writes: %s", err)
+		}
+	}
+}
+
+func committer() {
+	closed := false
+	for r := range commitQueue {
+		group := []*commitRequest{r}
+	collect:
+		for len(group) < maxCommitGroup {
+			select {
+			case r := <-commitQueue:
+				group = append(group, r)
+			default:
+				break collect
+			}
+		}
+		err := ShuttingDownError
+		if !closed {
+			err = writeGroup(group)
+			for _, r := range group {
+				if r.close {
+					closeDB()
+					closed = true
+					break
+				}
+			}
+		}
+		for _, r := range group {
+			r.done <- err
+		}
+	}
+}
+
+func writeGroup(group []*commitRequest) error {
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+	var counts map[uint16]keyCounts
+	sync := alwaysSync()
+	for _, r := range group {
+		sync = sync || r.sync
+		for _, w := range r.writes {
+			if w.value == nil {
+				wb.Delete(w.key)
+			} else {
+				wb.Put(w.key, w.value)
+			}
+		}
+		if r.counts != nil {
+			if counts == nil {
+				counts = make(map[uint16]keyCounts)
+			}
+			addKeyCounts(counts, r.counts)
+		}
+	}
+
+	opts := DefaultWriteOptions
+	if sync {
+		opts = SyncWriteOptions
+	}
+	var err error
+	if counts != nil {
+		err = writeWithCounts(wb, counts, opts)
+	} else {
+		err = DB.Write(opts, wb)
+	}
+	if err != nil {
+		return err
+	}
+	if sync {
+		atomic.StoreInt32(&unsynced, 0)
+	} else {
+		atomic.StoreInt32(&unsynced, 1)
+	}
+	atomic.AddInt64(&batchesCommitted, int64(len(group)))
+	atomic.AddInt64(&groupsCommitted, 1)
+	return nil
+}
+
+// WAITAOF numlocal numreplicas timeout
+//
+// Syncs the writes that have been made and replies with the number of synced
+// copies and the number of replicas that acknowledged them, which is always 0
+// since there are no replicas, so the timeout is never needed.
+func Waitaof(args [][]byte, wb *Batch) interface{} {
+	for _, arg := range args {
+		if n, err := bconv.ParseInt(arg, 10, 64); err != nil || n < 0 {
+			return InvalidIntError
+		}
+	}
+	if err := syncWrites(); err != nil {
+		return err
+	}
+	return []interface{}{1, 0}
+}
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Configuration
+//
+// Options are read from a redis.conf-style file, given as the first argument or
+// with -config, and from command line flags of the same name, which override
+// the file:
+//
+//	setdb /etc/setdb.conf -port 6380
+//
+// Each line of the file is an option name followed by its value, and lines
+// starting with # are comments. Sizes can use the same units as Redis, like
+// 128mb. Every option is checked when it is set, and the combination is checked
+// by validateConfig before the server starts.
+//
+// CONFIG GET returns the current values, CONFIG SET changes the options that
+// are marked as mutable, and CONFIG REWRITE writes the current values back to
+// the config file.
+
+var config = struct {
+	bind                 string
+	port                 int
+	dir                  string
+	databases            int
+	cacheSize            int
+	bloomBits            int
+	writeBufferSize      int
+	blockSize            int
+	compression          bool
+	maxOpenFiles         int
+	pprof                string
+	notifyKeyspaceEvents string
+	appendfsync          string
+	requirepass          string
+	aclfile              string
+	tlsPort              int
+	tlsCertFile          string
+	tlsKeyFile           string
+	tlsCACertFile        string
+	tlsAuthClients       string
+	tlsAuthClientsUser   string
+	unixSocket           string
+	unixSocketPerm       int
+
+	// read by clients while they can be changed, so they are accessed atomically
+	slowlogSlowerThan int64
+	slowlogMaxLen     int64
+	maxClients        int64
+	copyMaxSize       int64
+
+	clientOutputBufferLimits [numClientClasses]outputBufferLimit
+}{
+	port:            12345,
+	dir:             "db",
+	databases:       16,
+	cacheSize:       128 * 1024 * 1024,
+	bloomBits:       10,
+	writeBufferSize: 4 * 1024 * 1024,
+	blockSize:       4096,
+	compression:     true,
+	maxOpenFiles:    1000,
+	pprof:           "localhost:6060",
+	appendfsync:     "everysec",
+
+	tlsAuthClients:     "yes",
+	tlsAuthClientsUser: "off",
+
+	slowlogSlowerThan: 10000,
+	slowlogMaxLen:     128,
+	maxClients:        10000,
+	copyMaxSize:       64 * 1024 * 1024,
+
+	clientOutputBufferLimits: [numClientClasses]outputBufferLimit{
+		pubsubClient: {hard: 32 * 1024 * 1024, soft: 8 * 1024 * 1024, softSeconds: 60},
+	},
+}
+
+var configFileFlag = flag.String("config", "", "the config file to read options from")
+
+var (
+	configFile string // the absolute path of the config file, if there is one
+	configMtx  = &sync.Mutex{}
+)
+
+type configOption struct {
+	name    string
+	usage   string
+	set     func(string) error
+	get     func() string
+	boolean bool
+	mutable bool   // can be changed with CONFIG SET
+	alias   string // the option that a deprecated option sets instead
+	secret  bool   // CONFIG GET and the slow log don't show the value
+	def     string // the default value
+}
+
+var configOptions = []*configOption{
+	stringConfig("bind", &config.bind, "the address to listen on, empty for all interfaces"),
+	intConfig("port", &config.port, 0, 65535, "the port to listen on, 0 disables the plain listener"),
+	stringConfig("dir", &config.dir, "the LevelDB data directory"),
+	intConfig("databases", &config.databases, 1, 1<<15, "the number of databases that clients can SELECT"),
+	sizeConfig("cache-size", &config.cacheSize, 0, "the size of the LevelDB block cache, 0 disables the cache"),
+	intConfig("bloom-bits", &config.bloomBits, 0, 64, "the bits per key of the LevelDB bloom filter, 0 disables the filter"),
+	sizeConfig("write-buffer-size", &config.writeBufferSize, 64*1024, "the size of the LevelDB write buffer"),
+	sizeConfig("block-size", &config.blockSize, 1024, "the size of LevelDB blocks"),
+	boolConfig("compression", &config.compression, "compress LevelDB blocks with snappy"),
+	intConfig("max-open-files", &config.maxOpenFiles, 64, 1<<20, "the number of files LevelDB can keep open"),
+	stringConfig("pprof", &config.pprof, "the address of the pprof HTTP server, empty to disable it"),
+	{
+		name:  "notify-keyspace-events",
+		usage: "the classes of keyspace events to publish, like Redis' notify-keyspace-events",
+		set: func(s string) error {
+			if err := setNotifyFlags(s); err != nil {
+				return err
+			}
+			config.notifyKeyspaceEvents = s
+			return nil
+		},
+		get:     func() string { return config.notifyKeyspaceEvents },
+		mutable: true,
+	},
+	{
+		name:    "appendfsync",
+		usage:   "when writes are synced to disk: always before replying, everysec in the background, or no to leave it to the OS",
+		set:     setAppendfsync,
+		get:     func() string { return config.appendfsync },
+		mutable: true,
+	},
+	{
+		name:  "sync-writes",
+		usage: "deprecated, yes is appendfsync always and no is appendfsync no",
+		set: func(s string) error {
+			switch strings.ToLower(s) {
+			case "yes", "true":
+				return setAppendfsync("always")
+			case "no", "false":
+				return setAppendfsync("no")
+			}
+			return fmt.Errorf("'%s' must be yes or no", s)
+		},
+		get: func() string {
+			if config.appendfsync == "always" {
+				return "yes"
+			}
+			return "no"
+		},
+		boolean: true,
+		mutable: true,
+		alias:   "appendfsync",
+	},
+	{
+		name:  "requirepass",
+		usage: "the password of the default user, empty if it doesn't need one",
+		set: func(s string) error {
+			setRequirepass(s)
+			config.requirepass = s
+			return nil
+		},
+		get:     func() string { return config.requirepass },
+		mutable: true,
+		secret:  true,
+	},
+	stringConfig("aclfile", &config.aclfile, "the file that the ACL users are loaded from at startup and saved to when they change"),
+	stringConfig("unixsocket", &config.unixSocket, "the path of a unix socket to listen on, empty to disable it"),
+	{
+		name:  "unixsocketperm",
+		usage: "the permissions of the unix socket in octal, like 700, 0 to leave them to the umask",
+		set: func(s string) error {
+			n, err := strconv.ParseInt(s, 8, 32)
+			if err != nil || n < 0 || n > 0777 {
+				return fmt.Errorf("'%s' is not octal permissions", s)
+			}
+			config.unixSocketPerm = int(n)
+			return nil
+		},
+		get: func() string { return strconv.FormatInt(int64(config.unixSocketPerm), 8) },
+	},
+	intConfig("tls-port", &config.tlsPort, 0, 65535, "the port to listen on for TLS connections, 0 disables TLS"),
+	stringConfig("tls-cert-file", &config.tlsCertFile, "the server's TLS certificate"),
+	stringConfig("tls-key-file", &config.tlsKeyFile, "the key of the server's TLS certificate"),
+	stringConfig("tls-ca-cert-file", &config.tlsCACertFile, "the CA certificates that client certificates are verified with"),
+	choiceConfig("tls-auth-clients", &config.tlsAuthClients, []string{"yes", "optional", "no"}, "whether TLS clients need a certificate"),
+	choiceConfig("tls-auth-clients-user", &config.tlsAuthClientsUser, []string{"off", "cn"}, "cn authenticates TLS clients as the ACL user named by their certificate's Common Name"),
+	atomicIntConfig("slowlog-log-slower-than", &config.slowlogSlowerThan, -1, math.MaxInt64, "log commands that take longer than this many microseconds, -1 disables the slow log"),
+	atomicIntConfig("slowlog-max-len", &config.slowlogMaxLen, 0, math.MaxInt64, "the number of entries kept in the slow log"),
+	atomicIntConfig("maxclients", &config.maxClients, 1, math.MaxInt64, "the maximum number of connected clients"),
+	atomicIntConfig("copy-max-size", &config.copyMaxSize, 0, math.MaxInt64, "the most bytes of elements that RENAME, COPY and MOVE rewrite, 0 for no limit"),
+	{
+		name:    "client-output-buffer-limit",
+		usage:   "the output buffer limits of a class of clients: <normal|pubsub> <hard limit> <soft limit> <soft seconds>",
+		set:     setOutputBufferLimits,
+		get:     outputBufferLimitsString,
+		mutable: true,
+	},
+}
+
+func init() {
+	for _, o := range configOptions {
+		o.def = o.get()
+		flag.Var(o, o.name, o.usage)
+	}
+}
+
+func findConfigOption(name string) *configOption {
+	for _, o := range configOptions {
+		if o.name == name {
+			return o
+		}
+	}
+	return nil
+}
+
+// configOption is a flag.Value, so that flags and the config file share parsing
+func (o *configOption) Set(s string) error {
+	return o.set(s)
+}
+
+func (o *configOption) String() string {
+	if o == nil || o.get == nil {
+		return ""
+	}
+	return o.get()
+}
+
+func stringConfig(name string, p *string, usage string) *configOption {
+	return &configOption{
+		name:  name,
+		usage: usage,
+		set:   func(s string) error { *p = s; return nil },
+		get:   func() string { return *p },
+	}
+}
+
+func intConfig(name string, p *int, min, max int, usage string) *configOption {
+	return &configOption{
+		name:  name,
+		usage: usage,
+		set: func(s string) error {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return fmt.Errorf("'%s' is not an integer", s)
+			}
+			if n < min || n > max {
+				return fmt.Errorf("%d is out of range, it must be between %d and %d", n, min, max)
+			}
+			*p = n
+			return nil
+		},
+		get: func() string { return strconv.Itoa(*p) },
+	}
+}
+
+// An integer option that can be changed with CONFIG SET while it is being read
+// by other goroutines.
+func atomicIntConfig(name string, p *int64, min, max int64, usage string) *configOption {
+	return &configOption{
+		name:  name,
+		usage: usage,
+		set: func(s string) error {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return fmt.Errorf("'%s' is not an integer", s)
+			}
+			if n < min || n > max {
+				return fmt.Errorf("%d is out of range, it must be between %d and %d", n, min, max)
+			}
+			atomic.StoreInt64(p, n)
+			return nil
+		},
+		get:     func() string { return strconv.FormatInt(atomic.LoadInt64(p), 10) },
+		mutable: true,
+	}
+}
+
+func sizeConfig(name string, p *int, min int, usage string) *configOption {
+	return &configOption{
+		name:  name,
+		usage: usage,
+		set: func(s string) error {
+			n, err := parseSize(s)
+			if err != nil {
+				return err
+			}
+			if n < min {
+				return fmt.Errorf("%d is too small, it must be at least %d", n, min)
+			}
+			*p = n
+			return nil
+		},
+		get: func() string { return strconv.Itoa(*p) },
+	}
+}
+
+func boolConfig(name string, p *bool, usage string) *configOption {
+	return &configOption{
+		name:  name,
+		usage: usage,
+		set: func(s string) error {
+			switch strings.ToLower(s) {
+			case "yes", "true":
+				*p = true
+			case "no", "false":
+				*p = false
+			default:
+				return fmt.Errorf("'%s' must be yes or no", s)
+			}
+			return nil
+		},
+		get: func() string {
+			if *p {
+				return "yes"
+			}
+			return "no"
+		},
+		boolean: true,
+	}
+}
+
+// a config option that must be one of values, stored lowercased
+func choiceConfig(name string, p *string, values []string, usage string) *configOption {
+	return &configOption{
+		name:  name,
+		usage: usage,
+		set: func(s string) error {
+			s = strings.ToLower(s)
+			for _, v := range values {
+				if s == v {
+					*p = s
+					return nil
+				}
+			}
+			return fmt.Errorf("'%s' must be %s or %s", s, strings.Join(values[:len(values)-1], ", "), values[len(values)-1])
+		},
+		get: func() string { return *p },
+	}
+}
+
+func setAppendfsync(s string) error {
+	if err := setFsyncPolicy(s); err != nil {
+		return err
+	}
+	config.appendfsync = strings.ToLower(s)
+	return nil
+}
+
+// a boolean flag like -compression doesn't need a value
+func (o *configOption) IsBoolFlag() bool {
+	return o.boolean
+}
+
+var sizeUnits = map[string]int{
+	"":   1,
+	"b":  1,
+	"k":  1000,
+	"kb": 1024,
+	"m":  1000 * 1000,
+	"mb": 1024 * 1024,
+	"g":  1000 * 1000 * 1000,
+	"gb": 1024 * 1024 * 1024,
+}
+
+// parse a size in bytes with an optional unit, like 128mb
+func parseSize(s string) (int, error) {
+	s = strings.ToLower(s)
+	i := strings.IndexFunc(s, func(c rune) bool { return c < '0' || c > '9' })
+	if i < 0 {
+		i = len(s)
+	}
+	unit, ok := sizeUnits[s[i:]]
+	n, err := strconv.Atoi(s[:i])
+	if !ok || err != nil {
+		return 0, fmt.Errorf("'%s' is not a size", s)
+	}
+	return n * unit, nil
+}
+
+// Parse the command line and the config file, and validate the options.
+func loadConfig() error {
+	flag.Parse()
+	path := *configFileFlag
+	if flag.NArg() > 0 {
+		// flags can come after the config file
+		path = flag.Arg(0)
+		flag.CommandLine.Parse(flag.Args()[1:])
+		if flag.NArg() > 0 {
+			return fmt.Errorf("unexpected argument '%s'", flag.Arg(0))
+		}
+	}
+	if path != "" {
+		var err error
+		if configFile, err = filepath.Abs(path); err != nil {
+			return err
+		}
+		// options on the command line override the file
+		set := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		if err := readConfigFile(path, set); err != nil {
+			return err
+		}
+	}
+	return validateConfig()
+}
+
+// Set the options in the config file at path, except for the ones in skip.
+func readConfigFile(path string, skip map[string]bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		name, value := parseConfigLine(s.Text())
+		if name == "" {
+			continue
+		}
+		o := findConfigOption(name)
+		if o == nil {
+			return fmt.Errorf("%s:%d: unknown option '%s'", path, line, name)
+		}
+		if skip[name] {
+			continue
+		}
+		if err := o.Set(value); err != nil {
+			return fmt.Errorf("%s:%d: invalid %s: %s", path, line, name, err)
+		}
+		if o.alias != "" {
+			log.Printf("%s:%d: %s is deprecated, use %s", path, line, name, o.alias)
+		}
+	}
+	return s.Err()
+}
+
+// Returns the option name and value of a config file line, or an empty name for
+// comments and blank lines.
+func parseConfigLine(line string) (string, string) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", ""
+	}
+	name, value := line, ""
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		name, value = line[:i], strings.TrimSpace(line[i:])
+	}
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	return strings.ToLower(name), value
+}
+
+// Write the current options to the config file. Options that are already in the
+// file are updated in place, and other options are added at the end if they
+// aren't set to the default. Comments and the order of the file are kept.
+func rewriteConfig() error {
+	if configFile == "" {
+		return fmt.Errorf("the server is running without a config file")
+	}
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var lines []string
+	written := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		name, _ := parseConfigLine(line)
+		o := findConfigOption(name)
+		if o == nil {
+			lines = append(lines, line)
+			continue
+		}
+		// deprecated options are replaced by the option they set
+		if o.alias != "" {
+			o = findConfigOption(o.alias)
+		}
+		// only the first line for an option is kept
+		if !written[o.name] {
+			lines = append(lines, configLine(o))
+			written[o.name] = true
+		}
+	}
+	for _, o := range configOptions {
+		if !written[o.name] && o.alias == "" && o.get() != o.def {
+			lines = append(lines, configLine(o))
+		}
+	}
+
+	// replace the file in one step so that it is never partially written
+	tmp := configFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, configFile)
+}
+
+func configLine(o *configOption) string {
+	value := o.get()
+	if value == "" || strings.ContainsAny(value, " \t") {
+		value = `"` + value + `"`
+	}
+	return o.name + " " + value
+}
+
+func Config(args [][]byte, wb *Batch) interface{} {
+	configMtx.Lock()
+	defer configMtx.Unlock()
+	switch {
+	case EqualIgnoreCase(args[0], []byte("get")) && len(args) == 2:
+		pattern := strings.ToLower(string(args[1]))
+		res := []interface{}{}
+		for _, o := range configOptions {
+			if matched, _ := filepath.Match(pattern, o.name); !matched || o.alias != "" {
+				continue
+			}
+			value := []byte(o.get())
+			if o.secret && len(value) > 0 {
+				value = redacted
+			}
+			res = append(res, []byte(o.name), value)
+		}
+		return res
+	case EqualIgnoreCase(args[0], []byte("set")) && len(args) == 3:
+		name := strings.ToLower(string(args[1]))
+		o := findConfigOption(name)
+		if o == nil {
+			return fmt.Errorf("Unsupported CONFIG parameter: %s", name)
+		}
+		if !o.mutable {
+			return fmt.Errorf("CONFIG SET failed, %s can't be changed while the server is running", name)
+		}
+		if err := o.Set(string(args[2])); err != nil {
+			return fmt.Errorf("Invalid argument '%s' for CONFIG SET '%s': %s", args[2], name, err)
+		}
+		return ReplyOK
+	case EqualIgnoreCase(args[0], []byte("rewrite")) && len(args) == 1:
+		if err := rewriteConfig(); err != nil {
+			return fmt.Errorf("Rewriting config file: %s", err)
+		}
+		return ReplyOK
+	}
+	return fmt.Errorf("Unknown CONFIG subcommand or wrong number of arguments for '%s'", args[0])
+}
+
+// check the options that can't be checked on their own
+func validateConfig() error {
+	if config.dir == "" {
+		return fmt.Errorf("dir can't be empty")
+	}
+	if fi, err := os.Stat(config.dir); err == nil && !fi.IsDir() {
+		return fmt.Errorf("dir %s is not a directory", config.dir)
+	}
+	if config.bind != "" && net.ParseIP(config.bind) == nil {
+		if _, err := net.LookupHost(config.bind); err != nil {
+			return fmt.Errorf("invalid bind address %s: %s", config.bind, err)
+		}
+	}
+	if config.port == 0 && config.tlsPort == 0 && config.unixSocket == "" {
+		return fmt.Errorf("there must be a port, tls-port or unixsocket to listen on")
+	}
+	if config.tlsPort != 0 {
+		if config.tlsPort == config.port {
+			return fmt.Errorf("tls-port can't be the same as port")
+		}
+		if config.tlsCertFile == "" || config.tlsKeyFile == "" {
+			return fmt.Errorf("tls-port needs tls-cert-file and tls-key-file")
+		}
+		if config.tlsAuthClients != "no" && config.tlsCACertFile == "" {
+			return fmt.Errorf("tls-auth-clients %s needs tls-ca-cert-file", config.tlsAuthClients)
+		}
+	}
+	if config.pprof != "" {
+		if _, _, err := net.SplitHostPort(config.pprof); err != nil {
+			return fmt.Errorf("invalid pprof address: %s", err)
+		}
+		if config.pprof == listenAddr() {
+			return fmt.Errorf("pprof can't use the same address as the server")
+		}
+	}
+	return nil
+}
+
+// the address that the server listens on
+func listenAddr() string {
+	return net.JoinHostPort(config.bind, strconv.Itoa(config.port))
+}
@@ -0,0 +1,612 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+
+	"github.com/jmhodges/levigo"
+	"github.com/titanous/bconv"
+)
+
+// Databases
+//
+// Clients SELECT one of config.databases numbered databases. Each database has
+// a uint16 id, and every key that is passed to a command starts with the id of
+// the client's database, so the data types don't need to know about databases.
+// The id comes right after the type of every LevelDB key except the expiry time
+// index, so the keys of a database are next to each other:
+//
+// MetaKey | id | key
+// StringKey, HashKey, ListKey, SetKey, ZSetKey, ZScoreKey | id | uint32 key length | key | suffix
+// ExpireKey | id | key
+// ExpireTimeKey | int64 expiry time | id | key
+//
+// The id is added to the key arguments when a command is run, and removed from
+// the keys in replies and keyspace events. KEYS, SCAN and DBSIZE don't take
+// keys, so they get the id as an extra first argument.
+//
+// The database numbers are mapped to ids, so that SWAPDB only swaps two ids,
+// and FLUSHDB and FLUSHALL move the databases to unused ids and then delete the
+// keys of the old ones in batches, before the client gets the reply or in the
+// background with ASYNC:
+//
+// DatabasesKey = uint16 number of databases | uint16 id of each database |
+//                uint16 ids whose keys are being deleted...
+//
+// Commands hold dbBarrier for reading while they run, so that the ids can't
+// change between adding them to the keys and committing the writes.
+
+const dbPrefixSize = 2
+
+// the number of keys that are written in each batch when keys are migrated or
+// deleted
+const dbChunkSize = 10000
+
+type dbState struct {
+	ids      []uint16       // database number -> id
+	flushing []uint16       // ids whose keys are being deleted
+	numbers  map[uint16]int // id -> database number
+}
+
+var (
+	databases    *dbState // replaced when the databases change, protected by databasesMtx
+	databasesMtx = &sync.RWMutex{}
+	dbBarrier    = &sync.RWMutex{}
+	databasesKey = []byte{DatabasesKey}
+)
+
+// commands that change the client's database or the databases, and their arity
+var databaseCommands = map[string]int{
+	"select":   1,
+	"swapdb":   2,
+	"flushdb":  0,
+	"flushall": 0,
+}
+
+// commands that use the keys of the client's database without taking keys,
+// they get the prefix of the database as the first argument
+var keyspaceCommands = map[string]bool{
+	"keys":   true,
+	"scan":   true,
+	"dbsize": true,
+}
+
+func dbPrefix(id uint16) []byte {
+	b := make([]byte, dbPrefixSize)
+	binary.BigEndian.PutUint16(b, id)
+	return b
+}
+
+// add a database prefix to key
+func dbKey(prefix, key []byte) []byte {
+	return append(append(make([]byte, 0, len(prefix)+len(key)), prefix...), key...)
+}
+
+// returns the database id of a key with a database prefix
+func keyDB(k []byte) uint16 {
+	return binary.BigEndian.Uint16(k)
+}
+
+// remove the database prefix from a key
+func userKey(k []byte) []byte {
+	return k[dbPrefixSize:]
+}
+
+// the range of the keys of type t in the database id
+func dbKeyRange(t byte, id uint16) (start, limit []byte) {
+	start = append([]byte{t}, dbPrefix(id)...)
+	if id == math.MaxUint16 {
+		return start, []byte{t + 1}
+	}
+	return start, append([]byte{t}, dbPrefix(id+1)...)
+}
+
+func currentDatabases() *dbState {
+	databasesMtx.RLock()
+	defer databasesMtx.RUnlock()
+	return databases
+}
+
+// the key prefix of database n
+func (s *dbState) prefix(n int) []byte {
+	return dbPrefix(s.ids[n])
+}
+
+func (s *dbState) copy() *dbState {
+	return &dbState{
+		ids:      append([]uint16{}, s.ids...),
+		flushing: append([]uint16{}, s.flushing...),
+	}
+}
+
+// returns n ids that aren't used by a database
+func (s *dbState) unusedIDs(n int) []uint16 {
+	used := make(map[uint16]bool)
+	for _, id := range s.ids {
+		used[id] = true
+	}
+	for _, id := range s.flushing {
+		used[id] = true
+	}
+	var ids []uint16
+	for id := 0; len(ids) < n && id <= math.MaxUint16; id++ {
+		if !used[uint16(id)] {
+			ids = append(ids, uint16(id))
+		}
+	}
+	return ids
+}
+
+func (s *dbState) encode() []byte {
+	b := make([]byte, 2+2*len(s.ids)+2*len(s.flushing))
+	binary.BigEndian.PutUint16(b, uint16(len(s.ids)))
+	for i, id := range s.ids {
+		binary.BigEndian.PutUint16(b[2+2*i:], id)
+	}
+	for i, id := range s.flushing {
+		binary.BigEndian.PutUint16(b[2+2*len(s.ids)+2*i:], id)
+	}
+	return b
+}
+
+func decodeDBState(b []byte) (*dbState, error) {
+	if len(b) < 2 || len(b)%2 != 0 {
+		return nil, InvalidDataError
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	ids := make([]uint16, (len(b)-2)/2)
+	if n > len(ids) {
+		return nil, InvalidDataError
+	}
+	for i := range ids {
+		ids[i] = binary.BigEndian.Uint16(b[2+2*i:])
+	}
+	return &dbState{ids: ids[:n], flushing: ids[n:]}, nil
+}
+
+// Write s to the database along with writes and make it the current state.
+// databasesMtx must be held for writing.
+func setDatabases(s *dbState, writes batchWrites) error {
+	writes.put(databasesKey, s.encode())
+	if err := commitWrites(writes); err != nil {
+		return err
+	}
+	s.numbers = make(map[uint16]int, len(s.ids))
+	for n, id := range s.ids {
+		s.numbers[id] = n
+	}
+	databases = s
+	return nil
+}
+
+// Load the databases, creating them if the LevelDB database is new or was
+// written before there were databases, and resume deleting the keys of flushed
+// databases in the background.
+func loadDatabases() error {
+	res, err := DB.Get(DefaultReadOptions, databasesKey)
+	if err != nil {
+		return err
+	}
+	s := &dbState{}
+	var writes batchWrites
+	if res == nil {
+		// the keys that already exist are moved into database 0, which gets id 0
+		if err := migrateKeys(dbPrefix(0)); err != nil {
+			return err
+		}
+		writes.delete([]byte{MigrationKey})
+	} else if s, err = decodeDBState(res); err != nil {
+		return err
+	}
+	if len(s.ids) < config.databases {
+		s.ids = append(s.ids, s.unusedIDs(config.databases-len(s.ids))...)
+	}
+
+	databasesMtx.Lock()
+	err = setDatabases(s, writes)
+	databasesMtx.Unlock()
+	if err != nil {
+		return err
+	}
+	go deleteDatabases(s.flushing)
+	return nil
+}
+
+// Move the keys written before there were databases into the database with
+// prefix. The old keys could look like keys with a database id, so they are
+// first moved under MigrationKey, and a MigrationKey marker is written when
+// they have all been moved. Then they are moved back with the prefix. The
+// keys are written in batches, and the migration continues where it stopped if
+// the server is restarted while it runs. The caller removes the marker.
+func migrateKeys(prefix []byte) error {
+	marker := []byte{MigrationKey}
+	moved, err := DB.Get(DefaultReadOptions, marker)
+	if err != nil {
+		return err
+	}
+	if moved == nil {
+		n, err := rewriteRange([]byte{MetaKey}, []byte{DatabasesKey}, func(k, v []byte, writes *batchWrites) {
+			// the key counts are counted again for each database
+			if k[0] != CountKey {
+				writes.put(append([]byte{MigrationKey}, k...), v)
+			}
+			writes.delete(k)
+		})
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			log.Printf("Moving %d LevelDB keys into database 0", n)
+		}
+		if err := commitWrites(batchWrites{{marker, []byte{}}}); err != nil {
+			return err
+		}
+	}
+	_, err = rewriteRange([]byte{MigrationKey, 0}, []byte{MigrationKey + 1}, func(k, v []byte, writes *batchWrites) {
+		writes.put(migratedKey(k[1:], prefix), v)
+		writes.delete(k)
+	})
+	return err
+}
+
+// add the database prefix to a key written before there were databases
+func migratedKey(k, prefix []byte) []byte {
+	// the expiry time comes before the key in the expiry time index
+	at := 1
+	if k[0] == ExpireTimeKey && len(k) >= 9 {
+		at = 9
+	}
+	key := make([]byte, 0, len(k)+len(prefix))
+	return append(append(append(key, k[:at]...), prefix...), k[at:]...)
+}
+
+// Call f with each key in [start, limit) and its value, committing the writes
+// that it makes after every dbChunkSize keys. Returns the number of keys.
+func rewriteRange(start, limit []byte, f func(k, v []byte, writes *batchWrites)) (int, error) {
+	it := DB.NewIterator(ReadWithoutCacheFill)
+	defer it.Close()
+	var writes batchWrites
+	n := 0
+	for it.Seek(start); it.Valid() && bytes.Compare(it.Key(), limit) < 0; it.Next() {
+		f(it.Key(), it.Value(), &writes)
+		n++
+		if n%dbChunkSize == 0 {
+			if err := commitWrites(writes); err != nil {
+				return n, err
+			}
+			writes = writes[:0]
+			if isShuttingDown() {
+				return n, ShuttingDownError
+			}
+		}
+	}
+	if err := it.GetError(); err != nil {
+		return n, err
+	}
+	if len(writes) == 0 {
+		return n, nil
+	}
+	return n, commitWrites(writes)
+}
+
+// returns the key prefix of the client's database
+func (c *client) dbPrefix() []byte {
+	return currentDatabases().prefix(c.db)
+}
+
+// Returns a copy of the args of command with the prefix of the client's
+// database added to the keys, or as the first argument of keyspace commands.
+func (c *client) dbArgs(command *cmdDesc, args [][]byte) [][]byte {
+	return argsInDB(c.db, command, args)
+}
+
+// dbArgs for a command run in database db
+func argsInDB(db int, command *cmdDesc, args [][]byte) [][]byte {
+	s := currentDatabases()
+	prefix := s.prefix(db)
+	dbArgs := make([][]byte, len(args), len(args)+1)
+	copy(dbArgs, args)
+	for _, i := range command.keyIndexes(args) {
+		dbArgs[i] = dbKey(prefix, args[i])
+	}
+	// COPY with DB and MOVE use a key in another database, the commands check
+	// the database again if it's invalid
+	switch command.name {
+	case "copy":
+		if n, _, err := parseCopyOptions(args[2:]); err == nil && n >= 0 {
+			dbArgs[1] = dbKey(s.prefix(n), args[1])
+		}
+	case "move":
+		if n, err := parseDBIndex(args[1]); err == nil {
+			dbArgs = append(dbArgs, dbKey(s.prefix(n), args[0]))
+		}
+	}
+	if keyspaceCommands[command.name] {
+		dbArgs = append([][]byte{prefix}, dbArgs...)
+	}
+	return dbArgs
+}
+
+// returns keys with the prefix of the client's database
+func (c *client) dbKeys(keys [][]byte) [][]byte {
+	prefix := c.dbPrefix()
+	dbKeys := make([][]byte, len(keys))
+	for i, k := range keys {
+		dbKeys[i] = dbKey(prefix, k)
+	}
+	return dbKeys
+}
+
+func parseDBIndex(b []byte) (int, error) {
+	n, err := bconv.Atoi(b)
+	if err != nil {
+		return 0, fmt.Errorf("invalid DB index")
+	}
+	if n < 0 || n >= config.databases {
+		return 0, fmt.Errorf("DB index is out of range")
+	}
+	return n, nil
+}
+
+// Run a database command, only SELECT can be used inside MULTI and EXEC runs it
+func (c *client) database(name string, args [][]byte) interface{} {
+	switch name {
+	case "select":
+		n, err := parseDBIndex(args[0])
+		if err != nil {
+			return err
+		}
+		c.infoMtx.Lock()
+		c.db = n
+		c.infoMtx.Unlock()
+		return ReplyOK
+	case "swapdb":
+		return swapDatabases(args)
+	}
+
+	// FLUSHDB and FLUSHALL [ASYNC|SYNC]
+	var async bool
+	if len(args) > 1 {
+		return SyntaxError
+	} else if len(args) == 1 {
+		switch {
+		case EqualIgnoreCase(args[0], []byte("async")):
+			async = true
+		case !EqualIgnoreCase(args[0], []byte("sync")):
+			return SyntaxError
+		}
+	}
+	numbers := []int{c.db}
+	if name == "flushall" {
+		numbers = make([]int, config.databases)
+		for n := range numbers {
+			numbers[n] = n
+		}
+	}
+	ids, err := flushDatabases(numbers)
+	if err != nil {
+		return fmt.Errorf("data write error: %s", err)
+	}
+	if async {
+		go deleteDatabases(ids)
+		return ReplyOK
+	}
+	if err := deleteDatabases(ids); err != nil {
+		return fmt.Errorf("data write error: %s", err)
+	}
+	return ReplyOK
+}
+
+// MOVE key db
+//
+// dbArgs adds the key in the destination database as the last argument.
+func Move(args [][]byte, wb *Batch) interface{} {
+	if _, err := parseDBIndex(args[1]); err != nil {
+		return err
+	}
+	if len(args) != 3 {
+		return SyntaxError
+	}
+	src, dst := args[0], args[2]
+	if bytes.Equal(src, dst) {
+		return fmt.Errorf("source and destination objects are the same")
+	}
+	copied, err := copyKey(src, dst, false, wb)
+	if err != nil {
+		return err
+	}
+	if !copied {
+		return 0
+	}
+	if _, err := delKey(metaKey(src), wb); err != nil {
+		return err
+	}
+	wb.Notify(notifyGeneric, "move_from", src)
+	wb.Notify(notifyGeneric, "move_to", dst)
+	return 1
+}
+
+// the keys of MOVE, including the key in the destination database once dbArgs
+// has added it
+func moveKeys(args [][]byte) []int {
+	if len(args) == 3 {
+		return []int{0, 2}
+	}
+	return []int{0}
+}
+
+// COPY source destination [DB destination-db] [REPLACE]
+//
+// The destination has the prefix of the destination database, see dbArgs.
+func Copy(args [][]byte, wb *Batch) interface{} {
+	_, replace, err := parseCopyOptions(args[2:])
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(args[0], args[1]) {
+		return fmt.Errorf("source and destination objects are the same")
+	}
+	copied, err := copyKey(args[0], args[1], replace, wb)
+	if err != nil {
+		return err
+	}
+	if !copied {
+		return 0
+	}
+	wb.Notify(notifyGeneric, "copy_to", args[1])
+	return 1
+}
+
+// Parse the options of COPY, n is -1 if there isn't a DB option
+func parseCopyOptions(args [][]byte) (n int, replace bool, err error) {
+	n = -1
+	for i := 0; i < len(args); i++ {
+		switch {
+		case EqualIgnoreCase(args[i], []byte("db")) && i+1 < len(args):
+			if n, err = parseDBIndex(args[i+1]); err != nil {
+				return
+			}
+			i++
+		case EqualIgnoreCase(args[i], []byte("replace")):
+			replace = true
+		default:
+			return n, replace, SyntaxError
+		}
+	}
+	return
+}
+
+func swapDatabases(args [][]byte) interface{} {
+	a, err := parseDBIndex(args[0])
+	if err != nil {
+		return err
+	}
+	b, err := parseDBIndex(args[1])
+	if err != nil {
+		return err
+	}
+
+	dbBarrier.Lock()
+	defer dbBarrier.Unlock()
+	databasesMtx.Lock()
+	s := databases.copy()
+	s.ids[a], s.ids[b] = s.ids[b], s.ids[a]
+	err = setDatabases(s, nil)
+	databasesMtx.Unlock()
+	if err != nil {
+		return fmt.Errorf("data write error: %s", err)
+	}
+	databasesChanged(s.ids[a], s.ids[b])
+	return ReplyOK
+}
+
+// Move the databases numbers to unused ids so that they're empty, and return
+// the ids of their keys, which must be deleted with deleteDatabase.
+func flushDatabases(numbers []int) ([]uint16, error) {
+	dbBarrier.Lock()
+	defer dbBarrier.Unlock()
+	databasesMtx.Lock()
+	s := databases.copy()
+	unused := s.unusedIDs(len(numbers))
+	if len(unused) < len(numbers) {
+		databasesMtx.Unlock()
+		return nil, fmt.Errorf("too many databases are being flushed")
+	}
+	ids := make([]uint16, len(numbers))
+	for i, n := range numbers {
+		ids[i] = s.ids[n]
+		s.ids[n] = unused[i]
+	}
+	s.flushing = append(s.flushing, ids...)
+	err := setDatabases(s, nil)
+	databasesMtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	databasesChanged(ids...)
+	return ids, nil
+}
+
+// The databases with ids have different keys, so the clients watching their
+// keys and the clients blocked on their lists are told. dbBarrier must be
+// held for writing.
+func databasesChanged(ids ...uint16) {
+	touchDatabases(ids)
+	wakeListWaiters()
+}
+
+// Delete the keys of each of the flushed database ids, logging the errors. The
+// deletion stops when the server shuts down, and continues when it restarts.
+func deleteDatabases(ids []uint16) error {
+	dbClose.RLock()
+	defer dbClose.RUnlock()
+	if isShuttingDown() {
+		return ShuttingDownError
+	}
+	var firstErr error
+	for _, id := range ids {
+		err := deleteDatabase(id)
+		if err == ShuttingDownError {
+			return err
+		}
+		if err != nil {
+			log.Printf("Error deleting the keys of flushed database id %d: %s", id, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Delete the keys of the database id after it has been flushed, in batches so
+// that a large database isn't deleted in one write. The ranges are compacted
+// afterwards so that LevelDB doesn't have to skip the deleted keys.
+func deleteDatabase(id uint16) error {
+	types := []byte{MetaKey, StringKey, HashKey, ListKey, SetKey, ZSetKey, ZScoreKey, ExpireKey}
+	deleted := 0
+	for _, t := range types {
+		start, limit := dbKeyRange(t, id)
+		n, err := rewriteRange(start, limit, func(k, v []byte, writes *batchWrites) {
+			writes.delete(k)
+			if k[0] == ExpireKey && len(v) == 8 {
+				writes.delete(expireTimeKey(k[1:], int64(binary.BigEndian.Uint64(v))))
+			}
+		})
+		if err != nil {
+			return err
+		}
+		deleted += n
+	}
+	if deleted > 0 {
+		for _, t := range types {
+			start, limit := dbKeyRange(t, id)
+			DB.CompactRange(levigo.Range{Start: start, Limit: limit})
+		}
+	}
+
+	// the id can be used again once its counts are removed, nothing writes to it
+	// until then since databasesMtx is held
+	databasesMtx.Lock()
+	defer databasesMtx.Unlock()
+	s := databases.copy()
+	s.flushing = s.flushing[:0]
+	for _, flushing := range databases.flushing {
+		if flushing != id {
+			s.flushing = append(s.flushing, flushing)
+		}
+	}
+	var writes batchWrites
+	writes.delete(countKey(id))
+	if err := setDatabases(s, writes); err != nil {
+		return err
+	}
+	countsMtx.Lock()
+	delete(counts, id)
+	countsMtx.Unlock()
+	return nil
+}
@@ -14,19 +14,57 @@ import (
 var DB *levigo.DB
 var DefaultReadOptions = levigo.NewReadOptions()
 var DefaultWriteOptions = levigo.NewWriteOptions()
+var SyncWriteOptions = levigo.NewWriteOptions()
 var ReadWithoutCacheFill = levigo.NewReadOptions()
 
+// closed along with the database
+var (
+	dbOptions *levigo.Options
+	dbCache   *levigo.Cache
+	dbFilter  *levigo.FilterPolicy
+)
+
 func openDB() {
 	opts := levigo.NewOptions()
-	cache := levigo.NewLRUCache(128 * 1024 * 1024) // 128MB cache
-	opts.SetCache(cache)
-	filter := levigo.NewBloomFilter(10)
-	opts.SetFilterPolicy(filter)
+	dbOptions = opts
+	if config.cacheSize > 0 {
+		dbCache = levigo.NewLRUCache(config.cacheSize)
+		opts.SetCache(dbCache)
+	}
+	if config.bloomBits > 0 {
+		dbFilter = levigo.NewBloomFilter(config.bloomBits)
+		opts.SetFilterPolicy(dbFilter)
+	}
+	opts.SetWriteBufferSize(config.writeBufferSize)
+	opts.SetBlockSize(config.blockSize)
+	if config.compression {
+		opts.SetCompression(levigo.SnappyCompression)
+	} else {
+		opts.SetCompression(levigo.NoCompression)
+	}
+	opts.SetMaxOpenFiles(config.maxOpenFiles)
 	opts.SetCreateIfMissing(true)
 
 	var err error
-	DB, err = levigo.Open("db", opts)
+	DB, err = levigo.Open(config.dir, opts)
 	maybeFatal(err)
+	go committer()
+	go syncer()
+	maybeFatal(loadDatabases())
+	maybeFatal(loadKeyCounts())
+}
+
+// close the database and the cache and filter policy that it uses, nothing can
+// use the database after this
+func closeDB() {
+	DB.Close()
+	dbOptions.Close()
+	if dbCache != nil {
+		dbCache.Close()
+	}
+	if dbFilter != nil {
+		dbFilter.Close()
+	}
 }
 
 func maybeFatal(err error) {
@@ -37,14 +75,22 @@ func maybeFatal(err error) {
 }
 
 func main() {
+	maybeFatal(loadConfig())
+	maybeFatal(loadACLFile())
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	openDB()
-	go func() {
-		log.Println(http.ListenAndServe("localhost:6060", nil))
-	}()
+	go expireReaper()
+	if config.pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(config.pprof, nil))
+		}()
+	}
+	handleSignals()
 	listen()
+	<-shutdownDone
 }
 
 func init() {
 	ReadWithoutCacheFill.SetFillCache(false)
+	SyncWriteOptions.SetSync(true)
 }
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/jmhodges/levigo"
+	"github.com/titanous/bconv"
+)
+
+// Keys stored in LevelDB for key expiration
+//
+// ExpireKey | key = int64 expiry time in unix milliseconds
+//
+// The expiry times are also indexed by time so that the reaper can find the
+// keys that need to be expired without scanning every key:
+// ExpireTimeKey | int64 expiry time in unix milliseconds | key = empty
+
+// how often the background reaper looks for expired keys
+const expireReapInterval = 100 * time.Millisecond
+
+func Expire(args [][]byte, wb *Batch) interface{} {
+	return expireCommand("expire", args, time.Second, false, wb)
+}
+
+func Pexpire(args [][]byte, wb *Batch) interface{} {
+	return expireCommand("pexpire", args, time.Millisecond, false, wb)
+}
+
+func Expireat(args [][]byte, wb *Batch) interface{} {
+	return expireCommand("expireat", args, time.Second, true, wb)
+}
+
+func Pexpireat(args [][]byte, wb *Batch) interface{} {
+	return expireCommand("pexpireat", args, time.Millisecond, true, wb)
+}
+
+func expireCommand(name string, args [][]byte, unit time.Duration, absolute bool, wb *Batch) interface{} {
+	n, err := bconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return InvalidIntError
+	}
+	// an expiry that overflows would wrap around to the past and delete the key
+	invalid := fmt.Errorf("invalid expire time in '%s' command", name)
+	scale := int64(unit / time.Millisecond)
+	if n > math.MaxInt64/scale || n < math.MinInt64/scale {
+		return invalid
+	}
+	expiry := n * scale
+	if !absolute {
+		now := unixMilli(time.Now())
+		if expiry > math.MaxInt64-now {
+			return invalid
+		}
+		expiry += now
+	}
+
+	mk := metaKey(args[0])
+	res, err := wb.Get(DefaultReadOptions, mk)
+	if err != nil {
+		return err
+	}
+	if res == nil {
+		return 0
+	}
+
+	// an expiry in the past deletes the key immediately
+	if expiry <= unixMilli(time.Now()) {
+		_, err = delKey(mk, wb)
+		if err != nil {
+			return err
+		}
+		wb.Notify(notifyGeneric, "del", args[0])
+		return 1
+	}
+	err = setExpire(args[0], expiry, wb)
+	if err != nil {
+		return err
+	}
+	wb.Notify(notifyGeneric, "expire", args[0])
+	return 1
+}
+
+func Ttl(args [][]byte, wb *Batch) interface{} {
+	res, err := ttl(args[0], wb)
+	if err != nil {
+		return err
+	}
+	if res < 0 {
+		return res
+	}
+	// round to the nearest second
+	return (res + 500) / 1000
+}
+
+func Pttl(args [][]byte, wb *Batch) interface{} {
+	res, err := ttl(args[0], wb)
+	if err != nil {
+		return err
+	}
+	return res
+}
+
+// returns the time to live of key in milliseconds, -2 if the key doesn't
+// exist, or -1 if the key exists but has no expiry
+func ttl(key []byte, wb *Batch) (int64, error) {
+	res, err := wb.Get(DefaultReadOptions, metaKey(key))
+	if err != nil {
+		return 0, err
+	}
+	if res == nil {
+		return -2, nil
+	}
+	expiry, err := getExpire(key, nil, wb)
+	if err != nil {
+		return 0, err
+	}
+	if expiry == 0 {
+		return -1, nil
+	}
+	remaining := expiry - unixMilli(time.Now())
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining, nil
+}
+
+func Persist(args [][]byte, wb *Batch) interface{} {
+	expiry, err := getExpire(args[0], nil, wb)
+	if err != nil {
+		return err
+	}
+	if expiry == 0 {
+		return 0
+	}
+	delExpireTime(args[0], expiry, wb)
+	wb.Notify(notifyGeneric, "persist", args[0])
+	return 1
+}
+
+// returns the expiry time of key in unix milliseconds, or 0 if it doesn't have one
+func getExpire(key []byte, opts *levigo.ReadOptions, wb *Batch) (int64, error) {
+	if opts == nil {
+		opts = DefaultReadOptions
+	}
+	res, err := wb.Get(opts, expireKey(key))
+	if err != nil {
+		return 0, err
+	}
+	if res == nil {
+		return 0, nil
+	}
+	if len(res) != 8 {
+		return 0, InvalidDataError
+	}
+	return int64(binary.BigEndian.Uint64(res)), nil
+}
+
+// set the expiry time of key to expiry unix milliseconds, replacing any existing expiry
+func setExpire(key []byte, expiry int64, wb *Batch) error {
+	err := delExpire(key, wb)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(expiry))
+	wb.Put(expireKey(key), data)
+	wb.Put(expireTimeKey(key, expiry), []byte{})
+	return nil
+}
+
+// remove the expiry from key if it has one
+func delExpire(key []byte, wb *Batch) error {
+	expiry, err := getExpire(key, nil, wb)
+	if err != nil {
+		return err
+	}
+	if expiry > 0 {
+		delExpireTime(key, expiry, wb)
+	}
+	return nil
+}
+
+func delExpireTime(key []byte, expiry int64, wb *Batch) {
+	wb.Delete(expireKey(key))
+	wb.Delete(expireTimeKey(key, expiry))
+}
+
+// Lazily delete any of the keys that have expired. This must be called before
+// the keys are locked by the command that is accessing them.
+func expireKeys(keys [][]byte) error {
+	now := unixMilli(time.Now())
+	for _, k := range keys {
+		expiry, err := getExpire(k, nil, nil)
+		if err != nil {
+			return err
+		}
+		if expiry == 0 || expiry > now {
+			continue
+		}
+		err = reapKey(k, expiry)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delete key if its expiry is still set to expiry
+func reapKey(key []byte, expiry int64) error {
+	KeyMutex.Lock(key)
+	defer KeyMutex.Unlock(key)
+
+	// the expiry may have been changed or removed before we got the lock
+	current, err := getExpire(key, nil, nil)
+	if err != nil || current != expiry {
+		return err
+	}
+
+	wb := NewBatch()
+	defer wb.Close()
+	_, err = delKey(metaKey(key), wb)
+	if err != nil {
+		return err
+	}
+	wb.Notify(notifyExpired, "expired", key)
+	err = wb.Write()
+	if err != nil {
+		return err
+	}
+	touchKeys([][]byte{key}, nil)
+	return nil
+}
+
+// Actively delete expired keys in the background so that keys that are never
+// accessed again don't stay in the database forever.
+func expireReaper() {
+	tick := time.Tick(expireReapInterval)
+	for {
+		select {
+		case <-tick:
+		case <-shuttingDown:
+			return
+		}
+		dbClose.RLock()
+		if !isShuttingDown() {
+			reapExpiredKeys()
+		}
+		dbClose.RUnlock()
+	}
+}
+
+func reapExpiredKeys() {
+	it := DB.NewIterator(ReadWithoutCacheFill)
+	defer it.Close()
+	now := unixMilli(time.Now())
+
+	for it.Seek([]byte{ExpireTimeKey}); it.Valid(); it.Next() {
+		k := it.Key()
+		// if the first byte isn't ExpireTimeKey, we've reached the end
+		if len(k) < 9 || k[0] != ExpireTimeKey {
+			break
+		}
+		expiry := int64(binary.BigEndian.Uint64(k[1:]))
+		// the index is sorted by time, so the rest of the keys haven't expired yet
+		if expiry > now || isShuttingDown() {
+			break
+		}
+		// the keys of flushed databases are deleted along with the database
+		dbBarrier.RLock()
+		if _, ok := currentDatabases().numbers[keyDB(k[9:])]; ok {
+			if err := reapKey(k[9:], expiry); err != nil {
+				log.Printf("Error reaping expired key: %s", err)
+			}
+		}
+		dbBarrier.RUnlock()
+	}
+}
+
+func expireKey(k []byte) []byte {
+	key := make([]byte, 1+len(k))
+	key[0] = ExpireKey
+	copy(key[1:], k)
+	return key
+}
+
+func expireTimeKey(k []byte, expiry int64) []byte {
+	key := make([]byte, 9+len(k))
+	key[0] = ExpireTimeKey
+	binary.BigEndian.PutUint64(key[1:], uint64(expiry))
+	copy(key[9:], k)
+	return key
+}
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -16,30 +16,31 @@ import (
 // For each field:
 // HashKey | key length uint32 | key | field = value
 
-func Hset(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Hset(args [][]byte, wb *Batch) interface{} {
 	return hset(args, true, wb)
 }
 
-func Hsetnx(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Hsetnx(args [][]byte, wb *Batch) interface{} {
 	return hset(args, false, wb)
 }
 
-func hset(args [][]byte, overwrite bool, wb *levigo.WriteBatch) interface{} {
+func hset(args [][]byte, overwrite bool, wb *Batch) interface{} {
 	mk := metaKey(args[0])
-	length, err := hlen(mk, nil)
+	length, err := hlen(mk, nil, wb)
 	if err != nil {
 		return err
 	}
 	var res []byte
 	key := NewKeyBufferWithSuffix(HashKey, args[0], args[1]).Key()
 	if length > 0 {
-		res, err = DB.Get(DefaultReadOptions, key)
+		res, err = wb.Get(DefaultReadOptions, key)
 		if err != nil {
 			return err
 		}
 	}
 	if overwrite || res == nil {
 		wb.Put(key, args[2])
+		wb.Notify(notifyHash, "hset", args[0])
 	}
 	if res == nil {
 		setHlen(mk, length+1, wb)
@@ -48,16 +49,16 @@ func hset(args [][]byte, overwrite bool, wb *levigo.WriteBatch) interface{} {
 	return 0
 }
 
-func Hget(args [][]byte, wb *levigo.WriteBatch) interface{} {
-	res, err := DB.Get(DefaultReadOptions, NewKeyBufferWithSuffix(HashKey, args[0], args[1]).Key())
+func Hget(args [][]byte, wb *Batch) interface{} {
+	res, err := wb.Get(DefaultReadOptions, NewKeyBufferWithSuffix(HashKey, args[0], args[1]).Key())
 	if err != nil {
 		return err
 	}
 	return res
 }
 
-func Hexists(args [][]byte, wb *levigo.WriteBatch) interface{} {
-	res, err := DB.Get(DefaultReadOptions, NewKeyBufferWithSuffix(HashKey, args[0], args[1]).Key())
+func Hexists(args [][]byte, wb *Batch) interface{} {
+	res, err := wb.Get(DefaultReadOptions, NewKeyBufferWithSuffix(HashKey, args[0], args[1]).Key())
 	if err != nil {
 		return err
 	}
@@ -67,17 +68,17 @@ func Hexists(args [][]byte, wb *levigo.WriteBatch) interface{} {
 	return 1
 }
 
-func Hlen(args [][]byte, wb *levigo.WriteBatch) interface{} {
-	length, err := hlen(metaKey(args[0]), nil)
+func Hlen(args [][]byte, wb *Batch) interface{} {
+	length, err := hlen(metaKey(args[0]), nil, wb)
 	if err != nil {
 		return err
 	}
 	return length
 }
 
-func Hdel(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Hdel(args [][]byte, wb *Batch) interface{} {
 	mk := metaKey(args[0])
-	length, err := hlen(mk, nil)
+	length, err := hlen(mk, nil, wb)
 	if err != nil {
 		return err
 	}
@@ -89,7 +90,7 @@ func Hdel(args [][]byte, wb *levigo.WriteBatch) interface{} {
 	key := NewKeyBuffer(HashKey, args[0], len(args[1]))
 	for _, field := range args[1:] {
 		key.SetSuffix(field)
-		res, err := DB.Get(ReadWithoutCacheFill, key.Key())
+		res, err := wb.Get(ReadWithoutCacheFill, key.Key())
 		if err != nil {
 			return err
 		}
@@ -99,21 +100,28 @@ func Hdel(args [][]byte, wb *levigo.WriteBatch) interface{} {
 		wb.Delete(key.Key())
 		deleted++
 	}
+	if deleted > 0 {
+		wb.Notify(notifyHash, "hdel", args[0])
+	}
 	if deleted == length {
-		wb.Delete(mk)
+		err = delMetaKey(mk, wb)
+		if err != nil {
+			return err
+		}
+		wb.Notify(notifyGeneric, "del", args[0])
 	} else if deleted > 0 {
 		setHlen(mk, length-deleted, wb)
 	}
 	return deleted
 }
 
-func Hmset(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Hmset(args [][]byte, wb *Batch) interface{} {
 	if (len(args)-1)%2 != 0 {
 		return fmt.Errorf("wrong number of arguments for 'hmset' command")
 	}
 
 	mk := metaKey(args[0])
-	length, err := hlen(mk, nil)
+	length, err := hlen(mk, nil, wb)
 	if err != nil {
 		return err
 	}
@@ -124,7 +132,7 @@ func Hmset(args [][]byte, wb *levigo.WriteBatch) interface{} {
 		key.SetSuffix(args[i])
 		var res []byte
 		if length > 0 {
-			res, err = DB.Get(DefaultReadOptions, key.Key())
+			res, err = wb.Get(DefaultReadOptions, key.Key())
 			if err != nil {
 				return err
 			}
@@ -137,17 +145,18 @@ func Hmset(args [][]byte, wb *levigo.WriteBatch) interface{} {
 	if added > 0 {
 		setHlen(mk, length+added, wb)
 	}
+	wb.Notify(notifyHash, "hset", args[0])
 	return ReplyOK
 }
 
-func Hmget(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Hmget(args [][]byte, wb *Batch) interface{} {
 	stream := &cmdReplyStream{int64(len(args) - 1), make(chan interface{})}
 	go func() {
 		defer close(stream.items)
 		key := NewKeyBuffer(HashKey, args[0], len(args[1]))
 		for _, field := range args[1:] {
 			key.SetSuffix(field)
-			res, err := DB.Get(DefaultReadOptions, key.Key())
+			res, err := wb.Get(DefaultReadOptions, key.Key())
 			if err != nil {
 				stream.items <- err
 				continue
@@ -158,14 +167,14 @@ func Hmget(args [][]byte, wb *levigo.WriteBatch) interface{} {
 	return stream
 }
 
-func Hincrby(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Hincrby(args [][]byte, wb *Batch) interface{} {
 	mk := metaKey(args[0])
-	length, err := hlen(mk, nil)
+	length, err := hlen(mk, nil, wb)
 	if err != nil {
 		return err
 	}
 	key := NewKeyBufferWithSuffix(HashKey, args[0], args[1]).Key()
-	res, err := DB.Get(DefaultReadOptions, key)
+	res, err := wb.Get(DefaultReadOptions, key)
 	if err != nil {
 		return err
 	}
@@ -188,17 +197,18 @@ func Hincrby(args [][]byte, wb *levigo.WriteBatch) interface{} {
 	if res == nil {
 		setHlen(mk, length+1, wb)
 	}
+	wb.Notify(notifyHash, "hincrby", args[0])
 	return result
 }
 
-func Hincrbyfloat(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Hincrbyfloat(args [][]byte, wb *Batch) interface{} {
 	mk := metaKey(args[0])
-	length, err := hlen(mk, nil)
+	length, err := hlen(mk, nil, wb)
 	if err != nil {
 		return err
 	}
 	key := NewKeyBufferWithSuffix(HashKey, args[0], args[1]).Key()
-	res, err := DB.Get(DefaultReadOptions, key)
+	res, err := wb.Get(DefaultReadOptions, key)
 	if err != nil {
 		return err
 	}
@@ -221,28 +231,29 @@ func Hincrbyfloat(args [][]byte, wb *levigo.WriteBatch) interface{} {
 	if res == nil {
 		setHlen(mk, length+1, wb)
 	}
+	wb.Notify(notifyHash, "hincrbyfloat", args[0])
 	return result
 }
 
-func Hgetall(args [][]byte, wb *levigo.WriteBatch) interface{} {
-	return hgetall(args[0], true, true)
+func Hgetall(args [][]byte, wb *Batch) interface{} {
+	return hgetall(args[0], true, true, wb)
 }
 
-func Hkeys(args [][]byte, wb *levigo.WriteBatch) interface{} {
-	return hgetall(args[0], true, false)
+func Hkeys(args [][]byte, wb *Batch) interface{} {
+	return hgetall(args[0], true, false, wb)
 }
 
-func Hvals(args [][]byte, wb *levigo.WriteBatch) interface{} {
-	return hgetall(args[0], false, true)
+func Hvals(args [][]byte, wb *Batch) interface{} {
+	return hgetall(args[0], false, true, wb)
 }
 
-func hgetall(key []byte, fields bool, values bool) interface{} {
+func hgetall(key []byte, fields bool, values bool, wb *Batch) interface{} {
 	// use a snapshot so that the length is consistent with the iterator
 	snapshot := DB.NewSnapshot()
 	opts := levigo.NewReadOptions()
 	opts.SetSnapshot(snapshot)
 
-	length, err := hlen(metaKey(key), opts)
+	length, err := hlen(metaKey(key), opts, wb)
 	if err != nil {
 		return err
 		DB.ReleaseSnapshot(snapshot)
@@ -262,7 +273,7 @@ func hgetall(key []byte, fields bool, values bool) interface{} {
 	go func() {
 		defer close(stream.items)
 		iterKey := NewKeyBuffer(HashKey, key, 0)
-		it := DB.NewIterator(opts)
+		it := wb.NewIterator(opts)
 		for it.Seek(iterKey.Key()); it.Valid(); it.Next() {
 			k := it.Key()
 			if !iterKey.IsPrefixOf(k) {
@@ -281,8 +292,8 @@ func hgetall(key []byte, fields bool, values bool) interface{} {
 	return stream
 }
 
-func DelHash(key []byte, wb *levigo.WriteBatch) {
-	it := DB.NewIterator(ReadWithoutCacheFill)
+func DelHash(key []byte, wb *Batch) {
+	it := wb.NewIterator(ReadWithoutCacheFill)
 	defer it.Close()
 	iterKey := NewKeyBuffer(HashKey, key, 0)
 	for it.Seek(iterKey.Key()); it.Valid(); it.Next() {
@@ -294,11 +305,11 @@ func DelHash(key []byte, wb *levigo.WriteBatch) {
 	}
 }
 
-func hlen(key []byte, opts *levigo.ReadOptions) (uint32, error) {
+func hlen(key []byte, opts *levigo.ReadOptions, wb *Batch) (uint32, error) {
 	if opts == nil {
 		opts = DefaultReadOptions
 	}
-	res, err := DB.Get(opts, key)
+	res, err := wb.Get(opts, key)
 	if err != nil {
 		return 0, err
 	}
@@ -314,7 +325,7 @@ func hlen(key []byte, opts *levigo.ReadOptions) (uint32, error) {
 	return binary.BigEndian.Uint32(res[1:]), nil
 }
 
-func setHlen(key []byte, length uint32, wb *levigo.WriteBatch) {
+func setHlen(key []byte, length uint32, wb *Batch) {
 	data := make([]byte, 5)
 	data[0] = HashLengthValue
 	binary.BigEndian.PutUint32(data[1:], length)
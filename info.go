@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmhodges/levigo"
+)
+
+// INFO
+//
+// INFO returns the default sections, INFO all returns every section, and INFO
+// <section> returns one section. Each line is a field:value pair, and each
+// section starts with a # <Section> header, like Redis.
+//
+// Counters are kept as commands run, everything else is read when INFO is
+// called.
+
+const version = "0.1.0"
+
+var startTime = time.Now()
+
+type commandStats struct {
+	calls int64 // accessed atomically
+	usec  int64 // total time spent running the command, accessed atomically
+}
+
+var (
+	cmdStats            = make(map[string]*commandStats) // command name -> stats, not modified after init
+	totalConnections    int64                            // accessed atomically
+	rejectedConnections int64                            // accessed atomically
+)
+
+func init() {
+	for _, c := range commandList {
+		cmdStats[c.name] = &commandStats{}
+	}
+	// the commands that clients run themselves
+	for _, names := range []map[string]int{pubsubCommands, transactionCommands, databaseCommands} {
+		for name := range names {
+			cmdStats[name] = &commandStats{}
+		}
+	}
+	for _, name := range []string{"auth", "acl", "client", "shutdown"} {
+		cmdStats[name] = &commandStats{}
+	}
+}
+
+// update the stats and the slow log after a command has run
+func recordCommand(name string, args [][]byte, start time.Time) {
+	if s := cmdStats[name]; s != nil {
+		atomic.AddInt64(&s.calls, 1)
+		atomic.AddInt64(&s.usec, int64(time.Since(start)/time.Microsecond))
+	}
+	logSlowCommand(name, args, start)
+}
+
+type infoSection struct {
+	name      string
+	title     string
+	isDefault bool // included in INFO without a section
+	write     func(w io.Writer)
+}
+
+var infoSections = []infoSection{
+	{"server", "Server", true, infoServer},
+	{"clients", "Clients", true, infoClients},
+	{"stats", "Stats", true, infoStats},
+	{"commandstats", "Commandstats", false, infoCommandStats},
+	{"keyspace", "Keyspace", true, infoKeyspace},
+	{"leveldb", "LevelDB", true, infoLevelDB},
+}
+
+func Info(args [][]byte, wb *Batch) interface{} {
+	section := "default"
+	if len(args) > 0 {
+		if len(args) > 1 {
+			return SyntaxError
+		}
+		section = strings.ToLower(string(args[0]))
+	}
+	var buf bytes.Buffer
+	for _, s := range infoSections {
+		if section != s.name && section != "all" && !(section == "default" && s.isDefault) {
+			continue
+		}
+		if buf.Len() > 0 {
+			buf.WriteString("\r\n")
+		}
+		fmt.Fprintf(&buf, "# %s\r\n", s.title)
+		s.write(&buf)
+	}
+	return buf.Bytes()
+}
+
+func infoServer(w io.Writer) {
+	uptime := int64(time.Since(startTime) / time.Second)
+	fmt.Fprintf(w, "setdb_version:%s\r\n", version)
+	fmt.Fprintf(w, "go_version:%s\r\n", runtime.Version())
+	fmt.Fprintf(w, "os:%s %s\r\n", runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(w, "process_id:%d\r\n", os.Getpid())
+	fmt.Fprintf(w, "tcp_port:%d\r\n", config.port)
+	fmt.Fprintf(w, "uptime_in_seconds:%d\r\n", uptime)
+	fmt.Fprintf(w, "uptime_in_days:%d\r\n", uptime/(24*60*60))
+	fmt.Fprintf(w, "config_file:%s\r\n", configFile)
+}
+
+func infoClients(w io.Writer) {
+	clientsMtx.RLock()
+	connected := len(clients)
+	clientsMtx.RUnlock()
+
+	// a client waiting on several lists is in several queues
+	listWaitersMtx.Lock()
+	blocked := make(map[*listWaiter]bool)
+	for _, queue := range listWaiters {
+		for _, waiter := range queue {
+			blocked[waiter] = true
+		}
+	}
+	listWaitersMtx.Unlock()
+
+	fmt.Fprintf(w, "connected_clients:%d\r\n", connected)
+	fmt.Fprintf(w, "blocked_clients:%d\r\n", len(blocked))
+}
+
+func infoStats(w io.Writer) {
+	var commands int64
+	for _, s := range cmdStats {
+		commands += atomic.LoadInt64(&s.calls)
+	}
+	pubsubMtx.RLock()
+	channels, patterns := len(pubsubChannels), len(pubsubPatterns)
+	pubsubMtx.RUnlock()
+
+	fmt.Fprintf(w, "total_connections_received:%d\r\n", atomic.LoadInt64(&totalConnections))
+	fmt.Fprintf(w, "rejected_connections:%d\r\n", atomic.LoadInt64(&rejectedConnections))
+	fmt.Fprintf(w, "client_output_buffer_limit_disconnections:%d\r\n", atomic.LoadInt64(&outputBufferDisconnections))
+	fmt.Fprintf(w, "total_commands_processed:%d\r\n", commands)
+	fmt.Fprintf(w, "total_batches_committed:%d\r\n", atomic.LoadInt64(&batchesCommitted))
+	fmt.Fprintf(w, "total_group_commits:%d\r\n", atomic.LoadInt64(&groupsCommitted))
+	fmt.Fprintf(w, "pubsub_channels:%d\r\n", channels)
+	fmt.Fprintf(w, "pubsub_patterns:%d\r\n", patterns)
+}
+
+func infoCommandStats(w io.Writer) {
+	names := make([]string, 0, len(cmdStats))
+	for name := range cmdStats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		calls := atomic.LoadInt64(&cmdStats[name].calls)
+		if calls == 0 {
+			continue
+		}
+		usec := atomic.LoadInt64(&cmdStats[name].usec)
+		fmt.Fprintf(w, "cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f\r\n", name, calls, usec, float64(usec)/float64(calls))
+	}
+}
+
+func infoKeyspace(w io.Writer) {
+	all := allKeyCounts()
+	for n, id := range currentDatabases().ids {
+		c := all[id]
+		if c.keys() == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "db%d:keys=%d,expires=%d,string=%d,hash=%d,list=%d,set=%d,zset=%d\r\n",
+			n, c.keys(), c[countExpires], c[countString], c[countHash], c[countList], c[countSet], c[countZset])
+	}
+}
+
+// the key types reported by the approximate size of their data
+var infoKeyTypes = []struct {
+	name string
+	t    byte
+}{
+	{"meta", MetaKey},
+	{"string", StringKey},
+	{"hash", HashKey},
+	{"list", ListKey},
+	{"set", SetKey},
+	{"zset", ZSetKey},
+	{"zscore", ZScoreKey},
+	{"expire", ExpireKey},
+	{"expire_time", ExpireTimeKey},
+}
+
+func infoLevelDB(w io.Writer) {
+	ranges := make([]levigo.Range, len(infoKeyTypes))
+	for i, t := range infoKeyTypes {
+		ranges[i] = levigo.Range{Start: []byte{t.t}, Limit: []byte{t.t + 1}}
+	}
+	sizes := DB.GetApproximateSizes(ranges)
+	for i, t := range infoKeyTypes {
+		fmt.Fprintf(w, "leveldb_approximate_size_%s:%d\r\n", t.name, sizes[i])
+	}
+
+	// the number of sstables and their total size, from lines like " 12:34567['a' .. 'b']"
+	var tables, tableBytes int64
+	s := bufio.NewScanner(strings.NewReader(DB.PropertyValue("leveldb.sstables")))
+	for s.Scan() {
+		var number, size int64
+		if n, _ := fmt.Sscanf(strings.TrimSpace(s.Text()), "%d:%d[", &number, &size); n == 2 {
+			tables++
+			tableBytes += size
+		}
+	}
+	fmt.Fprintf(w, "leveldb_sstables:%d\r\n", tables)
+	fmt.Fprintf(w, "leveldb_sstables_bytes:%d\r\n", tableBytes)
+
+	// the compaction stats table has a row for each level with files, size,
+	// time, read and write columns
+	s = bufio.NewScanner(strings.NewReader(DB.PropertyValue("leveldb.stats")))
+	for s.Scan() {
+		fields := strings.Fields(strings.Replace(s.Text(), "|", " ", -1))
+		if len(fields) != 6 {
+			continue
+		}
+		if _, err := strconv.Atoi(fields[0]); err != nil {
+			continue
+		}
+		fmt.Fprintf(w, "leveldb_level_%s:files=%s,size_mb=%s,time_sec=%s,read_mb=%s,write_mb=%s\r\n",
+			fields[0], fields[1], fields[2], fields[3], fields[4], fields[5])
+	}
+}
@@ -5,9 +5,12 @@ import (
 	"encoding/binary"
 )
 
-const keyPrefixSize = 5
+// type | database id | uint32 key length
+const keyPrefixSize = 1 + dbPrefixSize + 4
 
-// KeyBuffer is a reusable key for LevelDB
+// KeyBuffer is a reusable key for LevelDB. The key starts with the id of its
+// database, which is placed before the length so that the keys of a database
+// are next to each other, see database.go.
 type KeyBuffer struct {
 	buf        []byte
 	keyLen     int
@@ -34,9 +37,10 @@ func (b *KeyBuffer) SetKey(key []byte) {
 	if len(key) == 0 {
 		return
 	}
-	b.keyLen = len(key)
-	binary.BigEndian.PutUint32(b.buf[1:], uint32(len(key)))
-	b.buf = append(b.buf[:keyPrefixSize], key...)
+	b.keyLen = len(key) - dbPrefixSize
+	copy(b.buf[1:], key[:dbPrefixSize])
+	binary.BigEndian.PutUint32(b.buf[1+dbPrefixSize:], uint32(b.keyLen))
+	b.buf = append(b.buf[:keyPrefixSize], key[dbPrefixSize:]...)
 }
 
 // Add extra after the key, will overwrite any existing extra
@@ -83,6 +87,11 @@ func (b *KeyBuffer) ReverseIterKey() {
 	}
 }
 
+// returns the suffix of k, a KeyBuffer key for key
+func keySuffix(key, k []byte) []byte {
+	return k[keyPrefixSize+len(key)-dbPrefixSize:]
+}
+
 func (b *KeyBuffer) Type() byte {
 	return b.buf[0]
 }
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/jmhodges/levigo"
+)
+
+// Key counts
+//
+// The number of keys of each type, and the number of keys with an expiry, are
+// kept in memory for each database id and persisted in the same WriteBatch as
+// the writes that change them:
+//
+// CountKey | id = int64 count for each of string, hash, list, set, zset, expires
+//
+// A batch records the final state of each MetaKey and ExpireKey that it writes,
+// and when it's committed the states are compared with the database to find the
+// keys that were created, deleted or changed type. Commits that change the
+// counts are serialized so that the persisted counts are always consistent.
+//
+// DEBUG RECOUNT recomputes the counts with a full scan. The scan reads a
+// snapshot, and the changes committed while it runs are added to the result.
+// The difference from the current counts is then committed like the changes
+// made by a batch.
+
+const (
+	countString = iota
+	countHash
+	countList
+	countSet
+	countZset
+	countExpires
+	numCounts
+)
+
+type keyCounts [numCounts]int64
+
+var (
+	counts       = make(map[uint16]keyCounts) // database id -> counts, protected by countsMtx
+	countsMtx    = &sync.Mutex{}
+	recounting   bool                 // a recount is running, commits are added to recountDelta
+	recountDelta map[uint16]keyCounts // protected by countsMtx
+	recountMtx   = &sync.Mutex{}
+)
+
+func countKey(id uint16) []byte {
+	return append([]byte{CountKey}, dbPrefix(id)...)
+}
+
+// returns the count that a key with the metadata type t is included in, or -1
+func countIndex(t byte) int {
+	switch t {
+	case StringLengthValue:
+		return countString
+	case HashLengthValue:
+		return countHash
+	case ListLengthValue:
+		return countList
+	case SetCardValue:
+		return countSet
+	case ZCardValue:
+		return countZset
+	}
+	return -1
+}
+
+// Returns the count that a MetaKey or ExpireKey with value is included in, or -1
+// if the key isn't counted.
+func countIndexFor(key, value []byte) int {
+	if len(value) == 0 {
+		return -1
+	}
+	if key[0] == ExpireKey {
+		return countExpires
+	}
+	return countIndex(value[0])
+}
+
+// the number of keys of every type
+func (c *keyCounts) keys() int64 {
+	var n int64
+	for i := countString; i <= countZset; i++ {
+		n += c[i]
+	}
+	return n
+}
+
+func (c keyCounts) add(d keyCounts) keyCounts {
+	for i := range c {
+		c[i] += d[i]
+	}
+	return c
+}
+
+func (c *keyCounts) encode() []byte {
+	b := make([]byte, 8*numCounts)
+	for i, n := range c {
+		binary.BigEndian.PutUint64(b[8*i:], uint64(n))
+	}
+	return b
+}
+
+func decodeKeyCounts(b []byte) (keyCounts, error) {
+	var c keyCounts
+	if len(b) != 8*numCounts {
+		return c, InvalidDataError
+	}
+	for i := range c {
+		c[i] = int64(binary.BigEndian.Uint64(b[8*i:]))
+	}
+	return c, nil
+}
+
+// returns a copy of the current counts of the database id
+func currentKeyCounts(id uint16) keyCounts {
+	countsMtx.Lock()
+	defer countsMtx.Unlock()
+	return counts[id]
+}
+
+// returns a copy of the current counts of every database id
+func allKeyCounts() map[uint16]keyCounts {
+	countsMtx.Lock()
+	defer countsMtx.Unlock()
+	all := make(map[uint16]keyCounts, len(counts))
+	for id, c := range counts {
+		all[id] = c
+	}
+	return all
+}
+
+func addKeyCounts(to map[uint16]keyCounts, d map[uint16]keyCounts) {
+	for id, c := range d {
+		to[id] = to[id].add(c)
+	}
+}
+
+// Record a write to key if it's a key that is counted, the last write to the
+// key in the batch decides whether it's counted when the batch is committed.
+func (b *Batch) countWrite(key, value []byte) {
+	if len(key) == 0 || (key[0] != MetaKey && key[0] != ExpireKey) {
+		return
+	}
+	if b.counted == nil {
+		b.counted = make(map[string]int)
+	}
+	b.counted[string(key)] = countIndexFor(key, value)
+}
+
+// the changes to the counts of each database id that committing the batch will
+// make, nil if there aren't any
+func (b *Batch) countDelta() (map[uint16]keyCounts, error) {
+	var d map[uint16]keyCounts
+	for k, i := range b.counted {
+		old, err := DB.Get(DefaultReadOptions, []byte(k))
+		if err != nil {
+			return nil, err
+		}
+		oldIndex := countIndexFor([]byte(k), old)
+		if i == oldIndex {
+			continue
+		}
+		if d == nil {
+			d = make(map[uint16]keyCounts)
+		}
+		id := keyDB([]byte(k[1:]))
+		c := d[id]
+		if oldIndex >= 0 {
+			c[oldIndex]--
+		}
+		if i >= 0 {
+			c[i]++
+		}
+		d[id] = c
+	}
+	return d, nil
+}
+
+// write wb to the database with opts along with the counts changed by d
+func writeWithCounts(wb *levigo.WriteBatch, d map[uint16]keyCounts, opts *levigo.WriteOptions) error {
+	countsMtx.Lock()
+	defer countsMtx.Unlock()
+	updated := make(map[uint16]keyCounts, len(d))
+	for id, delta := range d {
+		c := counts[id].add(delta)
+		wb.Put(countKey(id), c.encode())
+		updated[id] = c
+	}
+	if err := DB.Write(opts, wb); err != nil {
+		return err
+	}
+	for id, c := range updated {
+		counts[id] = c
+	}
+	if recounting {
+		addKeyCounts(recountDelta, d)
+	}
+	return nil
+}
+
+// Load the persisted counts, if there aren't any and the database isn't empty
+// they are counted.
+func loadKeyCounts() error {
+	c := make(map[uint16]keyCounts)
+	it := DB.NewIterator(ReadWithoutCacheFill)
+	defer it.Close()
+	for it.Seek([]byte{CountKey}); it.Valid(); it.Next() {
+		k := it.Key()
+		if k[0] != CountKey {
+			break
+		}
+		if len(k) != 1+dbPrefixSize {
+			return InvalidDataError
+		}
+		n, err := decodeKeyCounts(it.Value())
+		if err != nil {
+			return err
+		}
+		c[keyDB(k[1:])] = n
+	}
+	if err := it.GetError(); err != nil {
+		return err
+	}
+	if len(c) > 0 {
+		countsMtx.Lock()
+		counts = c
+		countsMtx.Unlock()
+		return nil
+	}
+
+	it.Seek([]byte{MetaKey})
+	if it.Valid() && it.Key()[0] == MetaKey {
+		log.Println("Counting keys")
+		return recountKeys()
+	}
+	return nil
+}
+
+// recompute the counts by scanning every MetaKey and ExpireKey
+func recountKeys() error {
+	recountMtx.Lock()
+	defer recountMtx.Unlock()
+
+	countsMtx.Lock()
+	snapshot := DB.NewSnapshot()
+	recounting = true
+	recountDelta = make(map[uint16]keyCounts)
+	countsMtx.Unlock()
+
+	opts := levigo.NewReadOptions()
+	opts.SetSnapshot(snapshot)
+	opts.SetFillCache(false)
+	it := DB.NewIterator(opts)
+	c := make(map[uint16]keyCounts)
+	for _, t := range []byte{MetaKey, ExpireKey} {
+		for it.Seek([]byte{t}); it.Valid(); it.Next() {
+			k := it.Key()
+			if k[0] != t {
+				break
+			}
+			if i := countIndexFor(k, it.Value()); i >= 0 {
+				id := keyDB(k[1:])
+				n := c[id]
+				n[i]++
+				c[id] = n
+			}
+		}
+	}
+	err := it.GetError()
+	it.Close()
+	opts.Close()
+	DB.ReleaseSnapshot(snapshot)
+
+	countsMtx.Lock()
+	recounting = false
+	if err != nil {
+		countsMtx.Unlock()
+		return err
+	}
+	addKeyCounts(c, recountDelta)
+	// the changes committed after this are added to the counts as usual, so
+	// the difference stays correct until it's committed
+	d := c
+	for id, n := range counts {
+		delta := d[id]
+		for i := range delta {
+			delta[i] -= n[i]
+		}
+		d[id] = delta
+	}
+	countsMtx.Unlock()
+	return commit(&commitRequest{counts: d})
+}
+
+// DBSIZE is a keyspace command, args[0] is the prefix of the database
+func Dbsize(args [][]byte, wb *Batch) interface{} {
+	c := currentKeyCounts(keyDB(args[0]))
+	return c.keys()
+}
+
+func Debug(args [][]byte, wb *Batch) interface{} {
+	if EqualIgnoreCase(args[0], []byte("recount")) && len(args) == 1 {
+		if err := recountKeys(); err != nil {
+			return err
+		}
+		return ReplyOK
+	}
+	return fmt.Errorf("Unknown DEBUG subcommand or wrong number of arguments for '%s'", args[0])
+}
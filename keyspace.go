@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Keyspace notifications
+//
+// Commands that modify a key add an event to their batch, and the events are
+// published once the batch has been committed:
+//
+// __keyspace@<db>__:<key> = event
+// __keyevent@<db>__:<event> = key
+//
+// notify-keyspace-events selects which classes of events are published, using
+// the same characters as Redis.
+
+const (
+	notifyKeyspace = 1 << iota // K
+	notifyKeyevent             // E
+	notifyGeneric              // g
+	notifyString               // $
+	notifyList                 // l
+	notifySet                  // s
+	notifyHash                 // h
+	notifyZset                 // z
+	notifyExpired              // x
+	notifyEvicted              // e
+	notifyAll      = notifyGeneric | notifyString | notifyList | notifySet | notifyHash | notifyZset | notifyExpired | notifyEvicted
+)
+
+// the enabled classes, accessed atomically since it can be changed at runtime
+var notifyKeyspaceEvents int32
+
+type keyspaceEvent struct {
+	event string
+	key   []byte
+}
+
+// parse the notify-keyspace-events classes
+func parseNotifyFlags(s string) (int32, error) {
+	var flags int32
+	for _, c := range s {
+		switch c {
+		case 'K':
+			flags |= notifyKeyspace
+		case 'E':
+			flags |= notifyKeyevent
+		case 'g':
+			flags |= notifyGeneric
+		case '$':
+			flags |= notifyString
+		case 'l':
+			flags |= notifyList
+		case 's':
+			flags |= notifySet
+		case 'h':
+			flags |= notifyHash
+		case 'z':
+			flags |= notifyZset
+		case 'x':
+			flags |= notifyExpired
+		case 'e':
+			flags |= notifyEvicted
+		case 'A':
+			flags |= notifyAll
+		default:
+			return 0, fmt.Errorf("invalid notify-keyspace-events class '%c'", c)
+		}
+	}
+	return flags, nil
+}
+
+func setNotifyFlags(s string) error {
+	flags, err := parseNotifyFlags(s)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&notifyKeyspaceEvents, flags)
+	return nil
+}
+
+// returns true if events of class should be published
+func notifyEnabled(class int32) bool {
+	flags := atomic.LoadInt32(&notifyKeyspaceEvents)
+	return flags&class != 0 && flags&(notifyKeyspace|notifyKeyevent) != 0
+}
+
+func publishKeyspaceEvents(events []keyspaceEvent) {
+	if len(events) == 0 {
+		return
+	}
+	flags := atomic.LoadInt32(&notifyKeyspaceEvents)
+	dbs := currentDatabases()
+	for _, e := range events {
+		// the keys of a database that has been flushed don't have a number
+		n, ok := dbs.numbers[keyDB(e.key)]
+		if !ok {
+			continue
+		}
+		key := userKey(e.key)
+		if flags&notifyKeyspace != 0 {
+			publish(append([]byte(fmt.Sprintf("__keyspace@%d__:", n)), key...), []byte(e.event))
+		}
+		if flags&notifyKeyevent != 0 {
+			publish([]byte(fmt.Sprintf("__keyevent@%d__:%s", n, e.event)), key)
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
 	"math"
 
 	"github.com/jmhodges/levigo"
+	"github.com/titanous/bconv"
 )
 
 // Keys stored in LevelDB for lists
@@ -13,6 +16,16 @@ import (
 //
 // For each list item:
 // ListKey | key length uint32 | key | int64 sequence number = value
+//
+// Pushes take the sequence number next to the leftmost or rightmost item, so
+// the items of a list that has only been pushed to and popped from have
+// contiguous sequence numbers and the item at an index can be found directly.
+//
+// LINSERT and LREM leave gaps between sequence numbers, which sets the
+// listLooseSeq flag, and indexes are then found by walking the list from the
+// nearest end. An insert goes halfway between its neighbours, and if they are
+// adjacent the shorter side of the list is moved outwards by listSeqGap, so
+// that later inserts in the same place don't have to move it again.
 
 type listDetails struct {
 	flags  byte
@@ -25,12 +38,14 @@ const (
 	listLooseSeq byte = 1 << iota
 )
 
-func Lrange(args [][]byte, wb *levigo.WriteBatch) interface{} {
+const listSeqGap = 1 << 20
+
+func Lrange(args [][]byte, wb *Batch) interface{} {
 	snapshot := DB.NewSnapshot()
 	opts := levigo.NewReadOptions()
 	opts.SetSnapshot(snapshot)
 
-	l, err := llen(metaKey(args[0]), opts)
+	l, err := llen(metaKey(args[0]), opts, wb)
 	if err != nil {
 		DB.ReleaseSnapshot(snapshot)
 		opts.Close()
@@ -44,6 +59,8 @@ func Lrange(args [][]byte, wb *levigo.WriteBatch) interface{} {
 
 	start, end, err := parseRange(args[1:], int64(l.length))
 	if err != nil {
+		DB.ReleaseSnapshot(snapshot)
+		opts.Close()
 		return err
 	}
 	// the start comes after the end, so we're not going to find anything
@@ -58,12 +75,10 @@ func Lrange(args [][]byte, wb *levigo.WriteBatch) interface{} {
 
 	go func() {
 		defer close(stream.items)
-		it := DB.NewIterator(opts)
+		it := wb.NewIterator(opts)
 		defer it.Close()
 
-		iterKey := NewKeyBuffer(ListKey, args[0], 8)
-		binary.BigEndian.PutUint64(iterKey.SuffixForRead(8), uint64(l.left+1+start-math.MinInt64))
-		it.Seek(iterKey.Key())
+		seekListIndex(it, args[0], l, start)
 		for i := int64(0); it.Valid() && i < count; i++ {
 			stream.items <- it.Value()
 			it.Next()
@@ -74,8 +89,8 @@ func Lrange(args [][]byte, wb *levigo.WriteBatch) interface{} {
 	return stream
 }
 
-func Llen(args [][]byte, wb *levigo.WriteBatch) interface{} {
-	l, err := llen(metaKey(args[0]), nil)
+func Llen(args [][]byte, wb *Batch) interface{} {
+	l, err := llen(metaKey(args[0]), nil, wb)
 	if err != nil {
 		return err
 	}
@@ -84,7 +99,7 @@ func Llen(args [][]byte, wb *levigo.WriteBatch) interface{} {
 
 // A LPUSH onto a list takes the seq number of the leftmost element,
 // decrements it and inserts the item.
-func Lpush(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Lpush(args [][]byte, wb *Batch) interface{} {
 	res, err := lpush(args, true, true, wb)
 	if err != nil {
 		return err
@@ -92,7 +107,7 @@ func Lpush(args [][]byte, wb *levigo.WriteBatch) interface{} {
 	return res
 }
 
-func Lpushx(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Lpushx(args [][]byte, wb *Batch) interface{} {
 	res, err := lpush(args, true, false, wb)
 	if err != nil {
 		return err
@@ -100,7 +115,7 @@ func Lpushx(args [][]byte, wb *levigo.WriteBatch) interface{} {
 	return res
 }
 
-func Rpush(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Rpush(args [][]byte, wb *Batch) interface{} {
 	res, err := lpush(args, false, true, wb)
 	if err != nil {
 		return err
@@ -108,7 +123,7 @@ func Rpush(args [][]byte, wb *levigo.WriteBatch) interface{} {
 	return res
 }
 
-func Rpushx(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Rpushx(args [][]byte, wb *Batch) interface{} {
 	res, err := lpush(args, false, false, wb)
 	if err != nil {
 		return err
@@ -116,9 +131,9 @@ func Rpushx(args [][]byte, wb *levigo.WriteBatch) interface{} {
 	return res
 }
 
-func lpush(args [][]byte, left bool, create bool, wb *levigo.WriteBatch) (interface{}, error) {
+func lpush(args [][]byte, left bool, create bool, wb *Batch) (interface{}, error) {
 	mk := metaKey(args[0])
-	l, err := llen(mk, nil)
+	l, err := llen(mk, nil, wb)
 	if err != nil {
 		return nil, err
 	}
@@ -134,17 +149,20 @@ func lpush(args [][]byte, left bool, create bool, wb *levigo.WriteBatch) (interf
 				seq = l.right
 				l.right++
 			}
-			// To sort negative ints in order before positive, we subtract math.MinInt64
-			// which wraps the numbers around and sorts correctly
-			binary.BigEndian.PutUint64(key.SuffixForRead(8), uint64(seq-math.MinInt64))
-			wb.Put(key.Key(), value)
+			wb.Put(listItemKey(key, seq), value)
 		}
 		setLlen(mk, l, wb)
+		wb.ListPushed(args[0])
+		if left {
+			wb.Notify(notifyList, "lpush", args[0])
+		} else {
+			wb.Notify(notifyList, "rpush", args[0])
+		}
 	}
 	return l.length, nil
 }
 
-func Lpop(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Lpop(args [][]byte, wb *Batch) interface{} {
 	res, err := lpop(args[0], true, wb)
 	if err != nil {
 		return err
@@ -152,7 +170,7 @@ func Lpop(args [][]byte, wb *levigo.WriteBatch) interface{} {
 	return res
 }
 
-func Rpop(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Rpop(args [][]byte, wb *Batch) interface{} {
 	res, err := lpop(args[0], false, wb)
 	if err != nil {
 		return err
@@ -160,7 +178,7 @@ func Rpop(args [][]byte, wb *levigo.WriteBatch) interface{} {
 	return res
 }
 
-func Rpoplpush(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Rpoplpush(args [][]byte, wb *Batch) interface{} {
 	res, err := lpop(args[0], false, wb)
 	if err != nil {
 		return err
@@ -175,9 +193,43 @@ func Rpoplpush(args [][]byte, wb *levigo.WriteBatch) interface{} {
 	return res
 }
 
-func lpop(key []byte, left bool, wb *levigo.WriteBatch) (interface{}, error) {
+// The blocking pops only pop from the lists here. If all of the lists are empty,
+// the client blocks and retries the command when one of them is pushed to, see
+// blocking.go.
+func Blpop(args [][]byte, wb *Batch) interface{} {
+	return blpop(args, true, wb)
+}
+
+func Brpop(args [][]byte, wb *Batch) interface{} {
+	return blpop(args, false, wb)
+}
+
+func blpop(args [][]byte, left bool, wb *Batch) interface{} {
+	if _, err := parseTimeout(args[len(args)-1]); err != nil {
+		return err
+	}
+	for _, key := range args[:len(args)-1] {
+		res, err := lpop(key, left, wb)
+		if err != nil {
+			return err
+		}
+		if res != nil {
+			return []interface{}{userKey(key), res}
+		}
+	}
+	return []interface{}(nil)
+}
+
+func Brpoplpush(args [][]byte, wb *Batch) interface{} {
+	if _, err := parseTimeout(args[2]); err != nil {
+		return err
+	}
+	return Rpoplpush(args[:2], wb)
+}
+
+func lpop(key []byte, left bool, wb *Batch) (interface{}, error) {
 	mk := metaKey(key)
-	l, err := llen(mk, nil)
+	l, err := llen(mk, nil, wb)
 	if err != nil {
 		return nil, err
 	}
@@ -186,7 +238,7 @@ func lpop(key []byte, left bool, wb *levigo.WriteBatch) (interface{}, error) {
 	}
 
 	iterKey := NewKeyBuffer(ListKey, key, 0)
-	it := DB.NewIterator(ReadWithoutCacheFill)
+	it := wb.NewIterator(ReadWithoutCacheFill)
 	defer it.Close()
 	if !left {
 		iterKey.ReverseIterKey()
@@ -205,12 +257,20 @@ func lpop(key []byte, left bool, wb *levigo.WriteBatch) (interface{}, error) {
 	res := it.Value()
 
 	wb.Delete(k)
+	if left {
+		wb.Notify(notifyList, "lpop", key)
+	} else {
+		wb.Notify(notifyList, "rpop", key)
+	}
 	l.length--
 	if l.length == 0 {
-		wb.Delete(mk)
+		err = delMetaKey(mk, wb)
+		if err != nil {
+			return nil, err
+		}
+		wb.Notify(notifyGeneric, "del", key)
 	} else {
-		// decode the sequence number from the list item key
-		seq := int64(binary.BigEndian.Uint64(k[len(key)+5:])) + math.MinInt64
+		seq := listItemSeq(key, k)
 		if left {
 			l.left = seq
 		} else {
@@ -222,11 +282,26 @@ func lpop(key []byte, left bool, wb *levigo.WriteBatch) (interface{}, error) {
 	return res, nil
 }
 
-func llen(key []byte, opts *levigo.ReadOptions) (*listDetails, error) {
+func DelList(key []byte, wb *Batch) {
+	it := wb.NewIterator(ReadWithoutCacheFill)
+	defer it.Close()
+	iterKey := NewKeyBuffer(ListKey, key, 0)
+	for it.Seek(iterKey.Key()); it.Valid(); it.Next() {
+		k := it.Key()
+		// If the prefix of the current key doesn't match the iteration key,
+		// we have reached the end of the list
+		if !iterKey.IsPrefixOf(k) {
+			break
+		}
+		wb.Delete(k)
+	}
+}
+
+func llen(key []byte, opts *levigo.ReadOptions, wb *Batch) (*listDetails, error) {
 	if opts == nil {
 		opts = DefaultReadOptions
 	}
-	res, err := DB.Get(opts, key)
+	res, err := wb.Get(opts, key)
 	if err != nil {
 		return nil, err
 	}
@@ -244,7 +319,13 @@ func llen(key []byte, opts *levigo.ReadOptions) (*listDetails, error) {
 	return l, nil
 }
 
-func setLlen(key []byte, l *listDetails, wb *levigo.WriteBatch) {
+func setLlen(key []byte, l *listDetails, wb *Batch) {
+	// the sequence numbers are contiguous if the items fill the range between left and right
+	if l.right-l.left-1 == int64(l.length) {
+		l.flags &^= listLooseSeq
+	} else {
+		l.flags |= listLooseSeq
+	}
 	data := make([]byte, 22)
 	data[0] = ListLengthValue
 	binary.BigEndian.PutUint32(data[1:], l.length)
@@ -254,12 +335,336 @@ func setLlen(key []byte, l *listDetails, wb *levigo.WriteBatch) {
 	wb.Put(key, data)
 }
 
-// BLPOP
-// BRPOP
-// BRPOPLPUSH
-// LINDEX
-// LINSERT
-// LRANGE
-// LREM
-// LSET
-// LTRIM
+func listItemKey(k *KeyBuffer, seq int64) []byte {
+	// To sort negative ints in order before positive, we subtract math.MinInt64
+	// which wraps the numbers around and sorts correctly
+	binary.BigEndian.PutUint64(k.SuffixForRead(8), uint64(seq-math.MinInt64))
+	return k.Key()
+}
+
+// decode the sequence number from the list item key k
+func listItemSeq(key []byte, k []byte) int64 {
+	return int64(binary.BigEndian.Uint64(keySuffix(key, k))) + math.MinInt64
+}
+
+// Position it at the item of the list key at index, which must be in range.
+func seekListIndex(it *Iterator, key []byte, l *listDetails, index int64) {
+	if l.flags&listLooseSeq == 0 {
+		it.Seek(listItemKey(NewKeyBuffer(ListKey, key, 8), l.left+1+index))
+		return
+	}
+	if index < int64(l.length)/2 {
+		seekListEnd(it, key, true)
+		for i := int64(0); i < index; i++ {
+			it.Next()
+		}
+	} else {
+		seekListEnd(it, key, false)
+		for i := int64(l.length) - 1; i > index; i-- {
+			it.Prev()
+		}
+	}
+}
+
+// Position it at the leftmost or rightmost item of the list key, and return a
+// key buffer to check that the iterator is still in the list.
+func seekListEnd(it *Iterator, key []byte, left bool) *KeyBuffer {
+	iterKey := NewKeyBuffer(ListKey, key, 0)
+	if left {
+		it.Seek(iterKey.Key())
+		return iterKey
+	}
+	iterKey.ReverseIterKey()
+	it.Seek(iterKey.Key())
+	if it.Valid() {
+		it.Prev()
+	} else {
+		it.SeekToLast()
+	}
+	return iterKey
+}
+
+func Lindex(args [][]byte, wb *Batch) interface{} {
+	index, err := bconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return InvalidIntError
+	}
+	l, err := llen(metaKey(args[0]), nil, wb)
+	if err != nil {
+		return err
+	}
+	if index < 0 {
+		index += int64(l.length)
+	}
+	if index < 0 || index >= int64(l.length) {
+		return nil
+	}
+
+	it := wb.NewIterator(DefaultReadOptions)
+	defer it.Close()
+	seekListIndex(it, args[0], l, index)
+	if !it.Valid() {
+		return nil
+	}
+	return it.Value()
+}
+
+func Lset(args [][]byte, wb *Batch) interface{} {
+	index, err := bconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return InvalidIntError
+	}
+	l, err := llen(metaKey(args[0]), nil, wb)
+	if err != nil {
+		return err
+	}
+	if l.length == 0 {
+		return fmt.Errorf("no such key")
+	}
+	if index < 0 {
+		index += int64(l.length)
+	}
+	if index < 0 || index >= int64(l.length) {
+		return fmt.Errorf("index out of range")
+	}
+
+	it := wb.NewIterator(ReadWithoutCacheFill)
+	defer it.Close()
+	seekListIndex(it, args[0], l, index)
+	if !it.Valid() {
+		return InvalidDataError
+	}
+	wb.Put(it.Key(), args[2])
+	wb.Notify(notifyList, "lset", args[0])
+	return ReplyOK
+}
+
+func Linsert(args [][]byte, wb *Batch) interface{} {
+	var before bool
+	if EqualIgnoreCase(args[1], []byte("before")) {
+		before = true
+	} else if !EqualIgnoreCase(args[1], []byte("after")) {
+		return SyntaxError
+	}
+	mk := metaKey(args[0])
+	l, err := llen(mk, nil, wb)
+	if err != nil {
+		return err
+	}
+	if l.length == 0 {
+		return 0
+	}
+
+	// find the pivot and the item on the side that the value is inserted
+	it := wb.NewIterator(ReadWithoutCacheFill)
+	defer it.Close()
+	iterKey := seekListEnd(it, args[0], true)
+	var index int64
+	for ; it.Valid() && iterKey.IsPrefixOf(it.Key()); it.Next() {
+		if bytes.Equal(it.Value(), args[2]) {
+			break
+		}
+		index++
+	}
+	if index == int64(l.length) {
+		return -1
+	}
+	pivot := listItemSeq(args[0], it.Key())
+	if !before {
+		index++
+	}
+
+	// the value becomes the item at index
+	var seq int64
+	switch index {
+	case 0:
+		seq = l.left
+		l.left--
+	case int64(l.length):
+		seq = l.right
+		l.right++
+	default:
+		if before {
+			it.Prev()
+		} else {
+			it.Next()
+		}
+		if !it.Valid() {
+			return InvalidDataError
+		}
+		lo, hi := pivot, listItemSeq(args[0], it.Key())
+		if before {
+			lo, hi = hi, lo
+		}
+		if hi-lo < 2 {
+			if index <= int64(l.length)-index {
+				moveListItems(args[0], index, true, wb)
+				l.left -= listSeqGap
+				lo -= listSeqGap
+			} else {
+				moveListItems(args[0], int64(l.length)-index, false, wb)
+				l.right += listSeqGap
+				hi += listSeqGap
+			}
+		}
+		seq = lo + (hi-lo)/2
+	}
+
+	wb.Put(listItemKey(NewKeyBuffer(ListKey, args[0], 8), seq), args[3])
+	l.length++
+	setLlen(mk, l, wb)
+	wb.ListPushed(args[0])
+	wb.Notify(notifyList, "linsert", args[0])
+	return l.length
+}
+
+// Move the first n items from the left or right end of the list key outwards
+// by listSeqGap, to make room for an insert after them.
+func moveListItems(key []byte, n int64, left bool, wb *Batch) {
+	it := wb.NewIterator(ReadWithoutCacheFill)
+	defer it.Close()
+	k := NewKeyBuffer(ListKey, key, 8)
+	seekListEnd(it, key, left)
+	for i := int64(0); i < n && it.Valid(); i++ {
+		seq := listItemSeq(key, it.Key())
+		wb.Delete(it.Key())
+		if left {
+			wb.Put(listItemKey(k, seq-listSeqGap), it.Value())
+			it.Next()
+		} else {
+			wb.Put(listItemKey(k, seq+listSeqGap), it.Value())
+			it.Prev()
+		}
+	}
+}
+
+// LREM removes count occurrences of the value starting from the left, or from
+// the right if count is negative. If count is 0 all of them are removed.
+func Lrem(args [][]byte, wb *Batch) interface{} {
+	count, err := bconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return InvalidIntError
+	}
+	mk := metaKey(args[0])
+	l, err := llen(mk, nil, wb)
+	if err != nil {
+		return err
+	}
+	if l.length == 0 {
+		return 0
+	}
+	left := count >= 0
+	if count < 0 {
+		count = -count
+	}
+
+	it := wb.NewIterator(ReadWithoutCacheFill)
+	defer it.Close()
+	iterKey := seekListEnd(it, args[0], left)
+	var removed int64
+	kept := false // an item has been kept, so removed items aren't at the end anymore
+	var lastKept int64
+	for it.Valid() && iterKey.IsPrefixOf(it.Key()) {
+		seq := listItemSeq(args[0], it.Key())
+		if bytes.Equal(it.Value(), args[2]) {
+			wb.Delete(it.Key())
+			removed++
+			// items removed from the end of the list move the end
+			if !kept && left {
+				l.left = seq
+			} else if !kept {
+				l.right = seq
+			}
+		} else {
+			kept = true
+			lastKept = seq
+		}
+		if removed == count && count > 0 {
+			break
+		}
+		if left {
+			it.Next()
+		} else {
+			it.Prev()
+		}
+	}
+	if removed == 0 {
+		return 0
+	}
+
+	wb.Notify(notifyList, "lrem", args[0])
+	l.length -= uint32(removed)
+	if l.length == 0 {
+		err = delMetaKey(mk, wb)
+		if err != nil {
+			return err
+		}
+		wb.Notify(notifyGeneric, "del", args[0])
+		return removed
+	}
+	// if the whole list was walked, the other end moves to the last kept item
+	if removed != count || count == 0 {
+		if left {
+			l.right = lastKept + 1
+		} else {
+			l.left = lastKept - 1
+		}
+	}
+	setLlen(mk, l, wb)
+	return removed
+}
+
+func Ltrim(args [][]byte, wb *Batch) interface{} {
+	mk := metaKey(args[0])
+	l, err := llen(mk, nil, wb)
+	if err != nil {
+		return err
+	}
+	start, end, err := parseRange(args[1:], int64(l.length))
+	if err != nil {
+		return err
+	}
+	if l.length == 0 {
+		return ReplyOK
+	}
+	wb.Notify(notifyList, "ltrim", args[0])
+	if start > end || start >= int64(l.length) {
+		DelList(args[0], wb)
+		err = delMetaKey(mk, wb)
+		if err != nil {
+			return err
+		}
+		wb.Notify(notifyGeneric, "del", args[0])
+		return ReplyOK
+	}
+
+	// delete the items before start and after end, the ends move to the last deleted items
+	if start > 0 {
+		l.left = trimList(args[0], start, true, wb)
+	}
+	if end < int64(l.length)-1 {
+		l.right = trimList(args[0], int64(l.length)-1-end, false, wb)
+	}
+	l.length = uint32(end - start + 1)
+	setLlen(mk, l, wb)
+	return ReplyOK
+}
+
+// Delete n items from the left or right end of the list key, and return the
+// sequence number of the last deleted item.
+func trimList(key []byte, n int64, left bool, wb *Batch) int64 {
+	it := wb.NewIterator(ReadWithoutCacheFill)
+	defer it.Close()
+	var seq int64
+	seekListEnd(it, key, left)
+	for i := int64(0); i < n && it.Valid(); i++ {
+		seq = listItemSeq(key, it.Key())
+		wb.Delete(it.Key())
+		if left {
+			it.Next()
+		} else {
+			it.Prev()
+		}
+	}
+	return seq
+}
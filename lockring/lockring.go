@@ -2,16 +2,17 @@ package lockring
 
 import (
 	"hash/crc32"
+	"sort"
 	"sync"
 )
 
 type LockRing struct {
 	size  uint32
-	locks []sync.Mutex
+	locks []sync.RWMutex
 }
 
 func New(n uint32) *LockRing {
-	return &LockRing{n, make([]sync.Mutex, n)}
+	return &LockRing{n, make([]sync.RWMutex, n)}
 }
 
 func (l *LockRing) Lock(k []byte) {
@@ -22,6 +23,64 @@ func (l *LockRing) Unlock(k []byte) {
 	l.lockForKey(k).Unlock()
 }
 
-func (l *LockRing) lockForKey(k []byte) *sync.Mutex {
-	return &l.locks[int(crc32.ChecksumIEEE(k)%l.size)]
+func (l *LockRing) RLock(k []byte) {
+	l.lockForKey(k).RLock()
+}
+
+func (l *LockRing) RUnlock(k []byte) {
+	l.lockForKey(k).RUnlock()
+}
+
+// LockMany acquires exclusive locks for all of the keys. Keys that share a lock
+// only lock it once, and the locks are always acquired in the same order so that
+// callers locking overlapping keys can't deadlock each other.
+func (l *LockRing) LockMany(keys [][]byte) {
+	for _, i := range l.slotsForKeys(keys) {
+		l.locks[i].Lock()
+	}
+}
+
+func (l *LockRing) UnlockMany(keys [][]byte) {
+	for _, i := range l.slotsForKeys(keys) {
+		l.locks[i].Unlock()
+	}
+}
+
+// RLockMany acquires shared locks for all of the keys, see LockMany.
+func (l *LockRing) RLockMany(keys [][]byte) {
+	for _, i := range l.slotsForKeys(keys) {
+		l.locks[i].RLock()
+	}
+}
+
+func (l *LockRing) RUnlockMany(keys [][]byte) {
+	for _, i := range l.slotsForKeys(keys) {
+		l.locks[i].RUnlock()
+	}
+}
+
+func (l *LockRing) lockForKey(k []byte) *sync.RWMutex {
+	return &l.locks[l.slot(k)]
+}
+
+func (l *LockRing) slot(k []byte) int {
+	return int(crc32.ChecksumIEEE(k) % l.size)
+}
+
+// returns the sorted and deduplicated lock indexes for keys
+func (l *LockRing) slotsForKeys(keys [][]byte) []int {
+	slots := make([]int, len(keys))
+	for i, k := range keys {
+		slots[i] = l.slot(k)
+	}
+	sort.Ints(slots)
+	n := 0
+	for i, s := range slots {
+		if i > 0 && s == slots[n-1] {
+			continue
+		}
+		slots[n] = s
+		n++
+	}
+	return slots[:n]
 }
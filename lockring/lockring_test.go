@@ -0,0 +1,55 @@
+package lockring
+
+import (
+	"sync"
+	"testing"
+
+	. "launchpad.net/gocheck"
+)
+
+// Hook gocheck into the gotest runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type LockRingSuite struct{}
+
+var _ = Suite(&LockRingSuite{})
+
+func (s LockRingSuite) TestLockManySameSlot(c *C) {
+	// with a single lock every key shares the same slot
+	l := New(1)
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("a")}
+	l.LockMany(keys)
+	l.UnlockMany(keys)
+	l.RLockMany(keys)
+	l.RUnlockMany(keys)
+	c.Assert(l.slotsForKeys(keys), DeepEquals, []int{0})
+}
+
+func (s LockRingSuite) TestLockManyOrdering(c *C) {
+	l := New(1024)
+	a, b := []byte("a"), []byte("b")
+	var wg sync.WaitGroup
+	for _, keys := range [][][]byte{{a, b}, {b, a}} {
+		wg.Add(1)
+		go func(keys [][]byte) {
+			defer wg.Done()
+			for i := 0; i < 10000; i++ {
+				l.LockMany(keys)
+				l.UnlockMany(keys)
+			}
+		}(keys)
+	}
+	wg.Wait()
+}
+
+func (s LockRingSuite) TestSharedLocks(c *C) {
+	l := New(1024)
+	keys := [][]byte{[]byte("a")}
+	l.RLockMany(keys)
+	// a second shared lock doesn't block
+	l.RLockMany(keys)
+	l.RUnlockMany(keys)
+	l.RUnlockMany(keys)
+	l.LockMany(keys)
+	l.UnlockMany(keys)
+}
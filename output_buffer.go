@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Output buffer limits
+//
+// The replies to a client are queued until they are written, so a client that
+// reads slower than its replies are made, like a subscriber to a busy channel
+// or a client that pipelines large LRANGEs, would grow its queue forever.
+// client-output-buffer-limit sets limits on the size of the queue for each
+// class of client, like Redis:
+//
+//	client-output-buffer-limit <class> <hard limit> <soft limit> <soft seconds>
+//
+// The class is pubsub for clients with subscriptions and normal for the others.
+// A client is disconnected as soon as its queue is over the hard limit, or once
+// it has been over the soft limit for the soft seconds, and the replies that
+// haven't been written are dropped. 0 disables a limit.
+
+const (
+	normalClient = iota
+	pubsubClient
+	numClientClasses
+)
+
+var clientClassNames = [numClientClasses]string{"normal", "pubsub"}
+
+type outputBufferLimit struct {
+	hard, soft, softSeconds int64 // accessed atomically
+}
+
+var outputBufferDisconnections int64 // accessed atomically
+
+// Set the limits of the classes in s, which has a class and its limits for
+// each class that is changed
+func setOutputBufferLimits(s string) error {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields)%4 != 0 {
+		return fmt.Errorf("the limits must be <class> <hard limit> <soft limit> <soft seconds> for each class")
+	}
+	limits := make(map[int][3]int64)
+	for i := 0; i < len(fields); i += 4 {
+		class := -1
+		for c, name := range clientClassNames {
+			if strings.ToLower(fields[i]) == name {
+				class = c
+			}
+		}
+		if class < 0 {
+			return fmt.Errorf("'%s' must be normal or pubsub", fields[i])
+		}
+		hard, err := parseSize(fields[i+1])
+		if err != nil {
+			return err
+		}
+		soft, err := parseSize(fields[i+2])
+		if err != nil {
+			return err
+		}
+		seconds, err := strconv.ParseInt(fields[i+3], 10, 64)
+		if err != nil || seconds < 0 {
+			return fmt.Errorf("'%s' is not a number of seconds", fields[i+3])
+		}
+		limits[class] = [3]int64{int64(hard), int64(soft), seconds}
+	}
+	for class, l := range limits {
+		limit := &config.clientOutputBufferLimits[class]
+		atomic.StoreInt64(&limit.hard, l[0])
+		atomic.StoreInt64(&limit.soft, l[1])
+		atomic.StoreInt64(&limit.softSeconds, l[2])
+	}
+	return nil
+}
+
+func outputBufferLimitsString() string {
+	parts := make([]string, numClientClasses)
+	for class, name := range clientClassNames {
+		limit := &config.clientOutputBufferLimits[class]
+		parts[class] = fmt.Sprintf("%s %d %d %d", name, atomic.LoadInt64(&limit.hard),
+			atomic.LoadInt64(&limit.soft), atomic.LoadInt64(&limit.softSeconds))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Checks the size of a client's queue against the limits of its class, it's
+// only used by the client's responseQueue.
+type outputBufferLimiter struct {
+	c         *client
+	softSince time.Time        // when the queue went over the soft limit, zero if it isn't over it
+	softTimer <-chan time.Time // receives when the soft seconds are up
+}
+
+// returns true if the client's queue is over its limits
+func (l *outputBufferLimiter) exceeded() bool {
+	class := normalClient
+	if atomic.LoadInt32(&l.c.subscribed) > 0 {
+		class = pubsubClient
+	}
+	limit := &config.clientOutputBufferLimits[class]
+	size := atomic.LoadInt64(&l.c.writeQueueSize)
+	if hard := atomic.LoadInt64(&limit.hard); hard > 0 && size > hard {
+		return true
+	}
+	if soft := atomic.LoadInt64(&limit.soft); soft == 0 || size <= soft {
+		l.softSince, l.softTimer = time.Time{}, nil
+		return false
+	}
+	seconds := time.Duration(atomic.LoadInt64(&limit.softSeconds)) * time.Second
+	if l.softSince.IsZero() {
+		l.softSince = time.Now()
+		l.softTimer = time.After(seconds)
+	}
+	return time.Since(l.softSince) >= seconds
+}
+
+// Disconnect a client that is over its output buffer limits without writing
+// the rest of its replies
+func (c *client) closeSlowClient() {
+	atomic.AddInt64(&outputBufferDisconnections, 1)
+	log.Printf("Client %s closed for overcoming of output buffer limits", strings.TrimSpace(c.info()))
+	c.kill()
+	c.cn.Close()
+}
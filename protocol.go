@@ -3,12 +3,16 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
+	"fmt"
 	"io"
 	"net"
+	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/jmhodges/levigo"
 	"github.com/titanous/bconv"
 )
 
@@ -17,20 +21,102 @@ type client struct {
 	r  *bufio.Reader
 	w  chan []byte
 
-	writeQueueSize int // current queue size in bytes
+	id      int64
+	addr    string
+	created time.Time
+
+	writeQueueSize int64         // current queue size in bytes, accessed atomically
+	killed         int32         // 1 once the client has been killed, accessed atomically
+	killedCh       chan struct{} // closed when the client is killed
+	subscribed     int32         // the number of subscriptions, accessed atomically
+
+	// read by CLIENT LIST, so they are only changed with infoMtx held
+	infoMtx     sync.Mutex
+	db          int       // the selected database
+	user        string    // the ACL user the client is authenticated as, empty until it uses AUTH
+	name        string    // set by CLIENT SETNAME
+	lastCommand string    // the ACL name of the last command
+	lastActive  time.Time // when the last command was sent
+
+	multi      bool              // true if commands are being queued for EXEC
+	multiError bool              // true if a command was rejected while queuing, EXEC will abort
+	queued     [][][]byte        // the commands queued since MULTI
+	watched    map[string]uint64 // watched key -> version when it was watched
+
+	channels map[string]bool // subscribed channels
+	patterns map[string]bool // subscribed patterns
 }
 
 var (
-	clients    = make(map[string]*client) // ip:port -> client mapping
+	clients    = make(map[int64]*client) // id -> client mapping
 	clientsMtx = &sync.RWMutex{}
 )
 
+// Listen on the plain and TLS ports and the unix socket until the server shuts
+// down
 func listen() {
-	l, err := net.Listen("tcp", ":12345")
-	maybeFatal(err)
+	var listeners []net.Listener
+	if config.port != 0 {
+		l, err := net.Listen("tcp", listenAddr())
+		maybeFatal(err)
+		listeners = append(listeners, l)
+	}
+	if config.tlsPort != 0 {
+		maybeFatal(loadTLSConfig())
+		l, err := net.Listen("tcp", net.JoinHostPort(config.bind, strconv.Itoa(config.tlsPort)))
+		maybeFatal(err)
+		listeners = append(listeners, newTLSListener(l))
+	}
+	if config.unixSocket != "" {
+		l, err := listenUnix()
+		maybeFatal(err)
+		listeners = append(listeners, l)
+	}
+
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			serve(l)
+		}(l)
+	}
+	wg.Wait()
+}
+
+// Listen on the unix socket, replacing a socket file that was left by a server
+// that didn't shut down cleanly
+func listenUnix() (net.Listener, error) {
+	if fi, err := os.Lstat(config.unixSocket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(config.unixSocket)
+	}
+	l, err := net.Listen("unix", config.unixSocket)
+	if err != nil {
+		return nil, err
+	}
+	// the socket file is removed when the listener is closed on shutdown
+	l.(*net.UnixListener).SetUnlinkOnClose(true)
+	if config.unixSocketPerm != 0 {
+		if err := os.Chmod(config.unixSocket, os.FileMode(config.unixSocketPerm)); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// accept clients from l until the server shuts down
+func serve(l net.Listener) {
+	go func() {
+		<-shuttingDown
+		l.Close()
+	}()
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if isShuttingDown() {
+				return
+			}
 			// TODO: log error
 			continue
 		}
@@ -39,23 +125,63 @@ func listen() {
 }
 
 func handleClient(cn net.Conn) {
-	c := &client{cn: cn, r: bufio.NewReader(cn), w: make(chan []byte)}
+	user := initialUser()
+	if t, ok := cn.(*tls.Conn); ok {
+		certUser, err := tlsHandshake(t)
+		if err != nil {
+			cn.Close()
+			return
+		}
+		if certUser != "" {
+			user = certUser
+		}
+	}
+
+	now := time.Now()
+	c := &client{
+		cn:         cn,
+		r:          bufio.NewReader(cn),
+		w:          make(chan []byte),
+		id:         atomic.AddInt64(&lastClientID, 1),
+		addr:       cn.RemoteAddr().String(),
+		created:    now,
+		user:       user,
+		lastActive: now,
+		killedCh:   make(chan struct{}),
+		channels:   make(map[string]bool),
+		patterns:   make(map[string]bool),
+	}
 	defer close(c.w)
+	if _, ok := cn.(*net.UnixConn); ok {
+		// the clients of a unix socket don't have addresses
+		c.addr = fmt.Sprintf("%s:%d", cn.LocalAddr(), c.id)
+	}
 
-	addr := cn.RemoteAddr().String()
+	atomic.AddInt64(&totalConnections, 1)
 	clientsMtx.Lock()
-	clients[addr] = c
+	if int64(len(clients)) >= atomic.LoadInt64(&config.maxClients) {
+		clientsMtx.Unlock()
+		atomic.AddInt64(&rejectedConnections, 1)
+		cn.Write([]byte("-ERR max number of clients reached\r\n"))
+		cn.Close()
+		return
+	}
+	clients[c.id] = c
 	clientsMtx.Unlock()
 	defer func() {
 		clientsMtx.Lock()
-		delete(clients, addr)
+		delete(clients, c.id)
 		clientsMtx.Unlock()
 	}()
 
+	activeClients.Add(1)
 	o := make(chan []byte)
 	go responseQueue(c, o)
 	go responseWriter(c, o)
 
+	defer c.unwatch()
+	defer c.unsubscribeAll()
+
 	protocolHandler(c)
 }
 
@@ -90,43 +216,183 @@ func protocolHandler(c *client) {
 		return
 	}
 
+	// write an error for a command that can't be run, aborting the transaction if
+	// the client is in MULTI
+	commandError := func(msg string) {
+		if c.multi {
+			c.multiError = true
+		}
+		writeError(c.w, msg)
+	}
+
 	runCommand := func(args [][]byte) (err error) {
 		if len(args) == 0 {
 			writeProtocolError(c.w, "missing command")
 			return
 		}
 
-		// lookup the command
-		command, ok := commands[UnsafeBytesToString(bytes.ToLower(args[0]))]
-		if !ok {
-			writeError(c.w, "unknown command '"+string(args[0])+"'")
+		name := UnsafeBytesToString(bytes.ToLower(args[0]))
+		if name == "quit" {
+			writeReply(c.w, ReplyOK)
+			return io.EOF
+		}
+		c.commandStarted(name, args[1:])
+		// the commands that the client runs itself are recorded here, the
+		// commands from the command table are recorded when they are called
+		start := time.Now()
+		if name == "auth" {
+			if len(args) < 2 || len(args) > 3 {
+				commandError("wrong number of arguments for '" + string(args[0]) + "' command")
+				return
+			}
+			res := c.auth(args[1:])
+			recordCommand(name, args[1:], start)
+			writeReply(c.w, res)
 			return
 		}
 
-		// check command arity, negative arity means >= n
-		if (command.arity < 0 && len(args)-1 < -command.arity) || (command.arity >= 0 && len(args)-1 < command.arity) {
-			writeError(c.w, "wrong number of arguments for '"+string(args[0])+"' command")
+		if denied := c.checkPermissions(name, args[1:]); denied != nil {
+			if c.multi {
+				c.multiError = true
+			}
+			writeReply(c.w, denied)
 			return
 		}
 
-		// call the command and respond
-		var wb *levigo.WriteBatch
-		if command.writes {
-			wb = levigo.NewWriteBatch()
-			defer wb.Close()
-		}
-		command.lockKeys(args[1:])
-		res := command.function(args[1:], wb)
-		if command.writes {
-			if _, ok := res.(error); !ok { // only write the batch if the return value is not an error
-				err = DB.Write(DefaultWriteOptions, wb)
+		if name == "shutdown" {
+			save := true
+			if len(args) == 2 && EqualIgnoreCase(args[1], []byte("nosave")) {
+				save = false
+			} else if len(args) > 2 || len(args) == 2 && !EqualIgnoreCase(args[1], []byte("save")) {
+				writeError(c.w, SyntaxError.Error())
+				return
 			}
-			if err != nil {
-				writeError(c.w, "data write error: "+err.Error())
+			recordCommand(name, args[1:], start)
+			// the client is disconnected without a reply
+			go shutdownCommand(save)
+			return io.EOF
+		}
+
+		// a client with subscriptions can only manage its subscriptions
+		if c.subscriptions() > 0 {
+			if name == "ping" {
+				recordCommand(name, args[1:], start)
+				c.w <- pubsubReply([]byte("pong"), []byte{})
+				return
+			}
+			if _, ok := pubsubCommands[name]; !ok {
+				writeError(c.w, "only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT allowed in this context")
+				return
+			}
+		}
+
+		if arity, ok := pubsubCommands[name]; ok {
+			if !validArity(arity, len(args)-1) {
+				commandError("wrong number of arguments for '" + string(args[0]) + "' command")
+				return
+			}
+			// the subscriptions can't be queued, PUBLISH is queued from the
+			// command table
+			if c.multi {
+				commandError(string(bytes.ToUpper(args[0])) + " inside MULTI is not allowed")
+				return
+			}
+			c.pubsub(name, args[1:])
+			recordCommand(name, args[1:], start)
+			return
+		}
+
+		if arity, ok := transactionCommands[name]; ok {
+			if !validArity(arity, len(args)-1) {
+				commandError("wrong number of arguments for '" + string(args[0]) + "' command")
+				return
+			}
+			res := c.transaction(name, args[1:])
+			// UNWATCH inside MULTI is queued, EXEC records it
+			if !c.multi || name != "unwatch" {
+				recordCommand(name, args[1:], start)
+			}
+			writeReply(c.w, res)
+			return
+		}
+
+		if arity, ok := databaseCommands[name]; ok {
+			if !validArity(arity, len(args)-1) {
+				commandError("wrong number of arguments for '" + string(args[0]) + "' command")
+				return
+			}
+			// SELECT is queued and changes the database of the commands queued
+			// after it
+			if c.multi && name == "select" {
+				if _, indexErr := parseDBIndex(args[1]); indexErr != nil {
+					commandError(indexErr.Error())
+					return
+				}
+				c.queued = append(c.queued, append([][]byte{}, args...))
+				writeReply(c.w, ReplyQUEUED)
+				return
+			}
+			if c.multi {
+				commandError(string(bytes.ToUpper(args[0])) + " inside MULTI is not allowed")
+				return
+			}
+			res := c.database(name, args[1:])
+			recordCommand(name, args[1:], start)
+			writeReply(c.w, res)
+			return
+		}
+
+		if name == "acl" || name == "client" {
+			if len(args) < 2 {
+				commandError("wrong number of arguments for '" + string(args[0]) + "' command")
+				return
+			}
+			if c.multi {
+				commandError(string(bytes.ToUpper(args[0])) + " inside MULTI is not allowed")
 				return
 			}
+			var res interface{}
+			if name == "acl" {
+				res = c.acl(args[1:])
+			} else {
+				res = c.clientCommand(args[1:])
+			}
+			recordCommand(name, args[1:], start)
+			writeReply(c.w, res)
+			return
+		}
+
+		// lookup the command
+		command, ok := commands[name]
+		if !ok {
+			commandError("unknown command '" + string(args[0]) + "'")
+			return
+		}
+
+		if !validArity(command.arity, len(args)-1) {
+			commandError("wrong number of arguments for '" + string(args[0]) + "' command")
+			return
+		}
+
+		// inside MULTI the command is run later by EXEC, the args slice is reused
+		// for the next command so it is copied
+		if c.multi {
+			c.queued = append(c.queued, append([][]byte{}, args...))
+			writeReply(c.w, ReplyQUEUED)
+			return
+		}
+
+		// call the command and respond
+		var res interface{}
+		if blockingCommands[name] {
+			res, err = c.block(&command, args[1:])
+		} else {
+			res, err = c.call(&command, args[1:])
+		}
+		if err != nil {
+			writeError(c.w, "data write error: "+err.Error())
+			return
 		}
-		command.unlockKeys(args[1:])
 		writeReply(c.w, res)
 
 		return
@@ -141,47 +407,88 @@ func protocolHandler(c *client) {
 	}
 
 	scratch := make([]byte, 2)
-	args := [][]byte{}
-	// Client event loop, each iteration handles a command
-	for {
-		// check if we're using the old inline protocol
-		b, err := c.r.Peek(1)
-		if err != nil {
-			return
-		}
-		if b[0] != '*' {
-			err = processInline()
-			if err != nil {
-				return
-			}
-			continue
-		}
-
+	// Read the arguments of a multi-bulk command, appending them to args
+	readArgs := func(args [][]byte) ([][]byte, error) {
 		// Step 1: get the number of arguments
 		argCount, err := readLength('*')
 		if err != nil {
-			return
+			return nil, err
 		}
 
 		// read the arguments
 		for i := 0; i < argCount; i++ {
 			length, err := readLength('$')
 			if err != nil {
-				return
+				return nil, err
 			}
 
 			// Read the argument bytes
 			args = append(args, make([]byte, length))
 			_, err = io.ReadFull(c.r, args[i])
 			if err != nil {
-				return
+				return nil, err
 			}
 
 			// The argument has a trailing \r\n that we need to discard
 			c.r.Read(scratch) // TODO: make sure these bytes are read
 		}
+		return args, nil
+	}
+
+	// Run a write command along with the write commands that were pipelined
+	// after it and are already buffered, so that their batches are committed
+	// together. The first buffered command that can't be pipelined is run after
+	// them.
+	runPipeline := func(args [][]byte) error {
+		pipeline := [][][]byte{append([][]byte{}, args...)}
+		for c.r.Buffered() > 0 && len(pipeline) < maxCommitGroup {
+			// inline commands are run on their own
+			if b, _ := c.r.Peek(1); b[0] != '*' {
+				break
+			}
+			args, err := readArgs(nil)
+			if err != nil {
+				c.callPipeline(pipeline)
+				return err
+			}
+			if !c.canPipeline(args) {
+				c.callPipeline(pipeline)
+				return runCommand(args)
+			}
+			c.commandStarted(UnsafeBytesToString(bytes.ToLower(args[0])), args[1:])
+			pipeline = append(pipeline, args)
+		}
+		c.callPipeline(pipeline)
+		return nil
+	}
 
-		err = runCommand(args)
+	args := [][]byte{}
+	// Client event loop, each iteration handles a command
+	for !isShuttingDown() && atomic.LoadInt32(&c.killed) == 0 {
+		// check if we're using the old inline protocol
+		b, err := c.r.Peek(1)
+		if err != nil {
+			return
+		}
+		if b[0] != '*' {
+			err = processInline()
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		args, err = readArgs(args)
+		if err != nil {
+			return
+		}
+
+		if c.r.Buffered() > 0 && c.canPipeline(args) {
+			c.commandStarted(UnsafeBytesToString(bytes.ToLower(args[0])), args[1:])
+			err = runPipeline(args)
+		} else {
+			err = runCommand(args)
+		}
 		if err != nil {
 			return
 		}
@@ -191,33 +498,179 @@ func protocolHandler(c *client) {
 	}
 }
 
+// Run a command in the client's database with its keys locked and commit its
+// writes. err is only set if the writes couldn't be committed.
+func (c *client) call(command *cmdDesc, userArgs [][]byte) (res interface{}, err error) {
+	dbBarrier.RLock()
+	defer dbBarrier.RUnlock()
+	args := c.dbArgs(command, userArgs)
+
+	// delete any keys that have expired before the command sees them
+	if expErr := expireKeys(command.getKeys(args)); expErr != nil {
+		return fmt.Errorf("data write error: %s", expErr), nil
+	}
+
+	var wb *Batch
+	if command.writes {
+		wb = NewBatch()
+		defer wb.Close()
+	}
+	command.lockKeys(args)
+	start := time.Now()
+	res = command.function(args, wb)
+	recordCommand(command.name, userArgs, start)
+	if command.writes {
+		if _, ok := res.(error); !ok { // only write the batch if the return value is not an error
+			err = wb.Write()
+			if err == nil {
+				touchKeys(command.getKeys(args), c)
+			}
+		}
+	}
+	command.unlockKeys(args)
+	return
+}
+
+// returns true if args is a write command that can be run in a pipeline: a
+// command with keys that doesn't block, which the client can run right away
+func (c *client) canPipeline(args [][]byte) bool {
+	if len(args) == 0 || c.multi || c.subscriptions() > 0 {
+		return false
+	}
+	name := UnsafeBytesToString(bytes.ToLower(args[0]))
+	command, ok := commands[name]
+	if !ok || !command.writes || blockingCommands[name] || keyspaceCommands[name] ||
+		!validArity(command.arity, len(args)-1) || len(command.getKeys(args[1:])) == 0 {
+		return false
+	}
+	return c.checkPermissions(name, args[1:]) == nil
+}
+
+// Run pipelined write commands and reply to them, like call. The keys of all of
+// the commands are locked while they run, and the batches of the commands are
+// all queued to be committed before waiting for any of them, so that they can
+// be committed in one write. A command that uses a key written by an earlier
+// command waits for the earlier batches to be committed, so that it reads
+// their writes.
+func (c *client) callPipeline(pipeline [][][]byte) {
+	dbBarrier.RLock()
+	defer dbBarrier.RUnlock()
+
+	cmds := make([]cmdDesc, len(pipeline))
+	cmdArgs := make([][][]byte, len(pipeline))
+	var keys [][]byte
+	for i, args := range pipeline {
+		cmds[i] = commands[UnsafeBytesToString(bytes.ToLower(args[0]))]
+		cmdArgs[i] = c.dbArgs(&cmds[i], args[1:])
+		keys = append(keys, cmds[i].getKeys(cmdArgs[i])...)
+	}
+
+	// delete any keys that have expired before the commands see them
+	if err := expireKeys(keys); err != nil {
+		for range pipeline {
+			writeReply(c.w, fmt.Errorf("data write error: %s", err))
+		}
+		return
+	}
+
+	KeyMutex.LockMany(keys)
+	defer KeyMutex.UnlockMany(keys)
+
+	replies := make([]interface{}, len(pipeline))
+	waits := make([]func() error, len(pipeline))
+	waited := 0
+	// wait for the batches of the commands before n
+	waitFor := func(n int) {
+		for ; waited < n; waited++ {
+			if waits[waited] == nil {
+				continue
+			}
+			if err := waits[waited](); err != nil {
+				replies[waited] = fmt.Errorf("data write error: %s", err)
+				continue
+			}
+			touchKeys(cmds[waited].getKeys(cmdArgs[waited]), c)
+		}
+	}
+
+	written := make(map[string]bool) // keys written by the batches that haven't been waited for
+	for i, args := range pipeline {
+		cmdKeys := cmds[i].getKeys(cmdArgs[i])
+		for _, k := range cmdKeys {
+			if written[string(k)] {
+				waitFor(i)
+				written = make(map[string]bool)
+				break
+			}
+		}
+		wb := NewBatch()
+		start := time.Now()
+		replies[i] = cmds[i].function(cmdArgs[i], wb)
+		recordCommand(cmds[i].name, args[1:], start)
+		// only write the batch if the return value is not an error
+		if _, ok := replies[i].(error); !ok {
+			waits[i] = wb.startCommit(wb.writes)
+			for _, k := range cmdKeys {
+				written[string(k)] = true
+			}
+		}
+	}
+	waitFor(len(pipeline))
+
+	for _, res := range replies {
+		writeReply(c.w, res)
+	}
+}
+
+// check command arity, negative arity means >= n
+func validArity(arity, n int) bool {
+	if arity < 0 {
+		return n >= -arity
+	}
+	return n >= arity
+}
+
 func responseQueue(c *client, out chan<- []byte) {
 	defer close(out)
 
 	queue := [][]byte{}
+	limiter := &outputBufferLimiter{c: c}
+	add := func(v []byte) {
+		queue = append(queue, v)
+		atomic.AddInt64(&c.writeQueueSize, int64(len(v)))
+	}
 
 receive:
 	for {
+		if limiter.exceeded() {
+			c.closeSlowClient()
+			atomic.StoreInt64(&c.writeQueueSize, 0)
+			// the client and the publishers keep sending until in is closed
+			for range c.w {
+			}
+			return
+		}
+
 		// ensure that the queue always has an item in it
 		if len(queue) == 0 {
 			v, ok := <-c.w
 			if !ok {
 				break // in is closed, we're done
 			}
-			queue = append(queue, v)
-			c.writeQueueSize += len(v)
+			add(v)
+			continue
 		}
 
 		select {
 		case out <- queue[0]:
-			c.writeQueueSize -= len(queue[0])
+			atomic.AddInt64(&c.writeQueueSize, -int64(len(queue[0])))
 			queue = queue[1:]
 		case v, ok := <-c.w:
 			if !ok {
 				break receive // in is closed, we're done
 			}
-			queue = append(queue, v)
-			c.writeQueueSize += len(v)
+			add(v)
+		case <-limiter.softTimer:
 		}
 	}
 
@@ -227,9 +680,12 @@ receive:
 }
 
 func responseWriter(c *client, out <-chan []byte) {
+	defer activeClients.Done()
 	for v := range out {
 		c.cn.Write(v)
 	}
+	// the client is done once all of the replies have been written
+	c.cn.Close()
 }
 
 func writeReply(w chan<- []byte, reply interface{}) {
@@ -276,6 +732,7 @@ func writeInt(w chan<- []byte, n int64) {
 func writeBulk(w chan<- []byte, b []byte) {
 	if b == nil {
 		w <- []byte("$-1\r\n")
+		return
 	}
 	// TODO: find a more efficient way of doing this
 	w <- append(strconv.AppendInt([]byte{'$'}, int64(len(b)), 10), "\r\n"...)
@@ -293,6 +750,7 @@ func writeMultibulkStream(w chan<- []byte, reply *cmdReplyStream) {
 func writeMultibulk(w chan<- []byte, reply []interface{}) {
 	if reply == nil {
 		writeMultibulkLength(w, -1)
+		return
 	}
 	writeMultibulkLength(w, int64(len(reply)))
 	for _, r := range reply {
@@ -1,8 +1,23 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
 	"net"
+	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	. "launchpad.net/gocheck"
 )
@@ -51,6 +66,15 @@ func (s ProtocolSuite) TestArity(c *C) {
 			"*3\r\n$5\r\nLPUSH\r\n$3\r\nfoo\r\n$1\r\nA\r\n",
 			":1\r\n",
 		},
+		// SHUTDOWN only takes SAVE or NOSAVE
+		{
+			"*3\r\n$8\r\nSHUTDOWN\r\n$4\r\nSAVE\r\n$6\r\nNOSAVE\r\n",
+			"-ERR syntax error\r\n",
+		},
+		{
+			"*2\r\n$8\r\nSHUTDOWN\r\n$3\r\nnow\r\n",
+			"-ERR syntax error\r\n",
+		},
 	}
 
 	var res []byte
@@ -62,6 +86,30 @@ func (s ProtocolSuite) TestArity(c *C) {
 	}
 }
 
+func (s ProtocolSuite) TestShutdown(c *C) {
+	saves := make(chan bool, 1)
+	shutdownCommand = func(save bool) { saves <- save }
+	defer func() { shutdownCommand = shutdown }()
+
+	for _, t := range []struct {
+		cmd  string
+		save bool
+	}{
+		{"SHUTDOWN", true},
+		{"SHUTDOWN save", true},
+		{"SHUTDOWN NOSAVE", false},
+	} {
+		a, b := net.Pipe()
+		go handleClient(b)
+		// the client is disconnected without a reply
+		sendCommand(a, t.cmd)
+		_, err := a.Read(make([]byte, 1))
+		c.Assert(err, Equals, io.EOF)
+		c.Assert(<-saves, Equals, t.save)
+		a.Close()
+	}
+}
+
 func BenchmarkProtocolParserSimple(b *testing.B) {
 	b.StopTimer()
 	client, server := net.Pipe()
@@ -109,3 +157,849 @@ func BenchmarkProtocolParserInline(b *testing.B) {
 		client.Write([]byte("PING\r\n"))
 	}
 }
+
+type protocolTest struct {
+	cmd      string
+	expected string
+}
+
+// send each command and check the response
+func runProtocolTests(c *C, conn net.Conn, tests []protocolTest) {
+	for _, t := range tests {
+		sendCommand(conn, t.cmd)
+		readReply(c, conn, t.expected)
+	}
+}
+
+func sendCommand(conn net.Conn, command string) {
+	args := strings.Split(command, " ")
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	conn.Write([]byte(cmd))
+}
+
+func readReply(c *C, conn net.Conn, expected string) {
+	res := make([]byte, len(expected))
+	_, err := io.ReadFull(conn, res)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, expected)
+}
+
+func (s ProtocolSuite) TestMulti(c *C) {
+	a, b := net.Pipe()
+	defer a.Close()
+	go handleClient(b)
+
+	runProtocolTests(c, a, []protocolTest{
+		{"MULTI", "+OK\r\n"},
+		{"SET tx foo", "+QUEUED\r\n"},
+		{"APPEND tx bar", "+QUEUED\r\n"},
+		{"GET tx", "+QUEUED\r\n"},
+		{"SADD txset a b", "+QUEUED\r\n"},
+		{"SMEMBERS txset", "+QUEUED\r\n"},
+		{"EXEC", "*5\r\n+OK\r\n:6\r\n$6\r\nfoobar\r\n:2\r\n*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{"GET tx", "$6\r\nfoobar\r\n"},
+
+		// DISCARD throws away the queued commands
+		{"MULTI", "+OK\r\n"},
+		{"SET tx baz", "+QUEUED\r\n"},
+		{"DISCARD", "+OK\r\n"},
+		{"GET tx", "$6\r\nfoobar\r\n"},
+
+		// a command that fails while queuing aborts the transaction
+		{"MULTI", "+OK\r\n"},
+		{"SET tx baz", "+QUEUED\r\n"},
+		{"SET tx", "-ERR wrong number of arguments for 'SET' command\r\n"},
+		{"EXEC", "-EXECABORT Transaction discarded because of previous errors.\r\n"},
+		{"GET tx", "$6\r\nfoobar\r\n"},
+
+		{"EXEC", "-ERR EXEC without MULTI\r\n"},
+		{"DISCARD", "-ERR DISCARD without MULTI\r\n"},
+	})
+}
+
+// every command is counted once in the command stats, whether it's run by the
+// client or from the command table
+func (s ProtocolSuite) TestCommandStats(c *C) {
+	a, b := net.Pipe()
+	defer a.Close()
+	go handleClient(b)
+
+	names := []string{"multi", "set", "unwatch", "exec", "select", "client", "subscribe", "ping", "unsubscribe"}
+	calls := make(map[string]int64)
+	for _, name := range names {
+		calls[name] = atomic.LoadInt64(&cmdStats[name].calls)
+	}
+	runProtocolTests(c, a, []protocolTest{
+		{"MULTI", "+OK\r\n"},
+		{"SET stats a", "+QUEUED\r\n"},
+		{"UNWATCH", "+QUEUED\r\n"},
+		{"EXEC", "*2\r\n+OK\r\n+OK\r\n"},
+		{"SELECT 0", "+OK\r\n"},
+		{"CLIENT SETNAME stats", "+OK\r\n"},
+		{"SUBSCRIBE stats", "*3\r\n$9\r\nsubscribe\r\n$5\r\nstats\r\n:1\r\n"},
+		{"PING", "*2\r\n$4\r\npong\r\n$0\r\n\r\n"},
+		{"UNSUBSCRIBE", "*3\r\n$11\r\nunsubscribe\r\n$5\r\nstats\r\n:0\r\n"},
+	})
+	for _, name := range names {
+		c.Assert(atomic.LoadInt64(&cmdStats[name].calls)-calls[name], Equals, int64(1), Commentf("%s", name))
+	}
+}
+
+func (s ProtocolSuite) TestPipeline(c *C) {
+	a, b := net.Pipe()
+	defer a.Close()
+	go handleClient(b)
+
+	// the buffered write commands of a client are committed together
+	const n = 100
+	var cmds, expected string
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("pipeline%d", i)
+		cmds += fmt.Sprintf("*3\r\n$3\r\nSET\r\n$%d\r\n%s\r\n$1\r\na\r\n", len(key), key)
+		expected += "+OK\r\n"
+	}
+	// a command that uses a key written earlier in the pipeline reads the write
+	cmds += "*3\r\n$6\r\nAPPEND\r\n$9\r\npipeline0\r\n$1\r\nb\r\n"
+	expected += ":2\r\n"
+	cmds += "*2\r\n$3\r\nGET\r\n$9\r\npipeline0\r\n"
+	expected += "$2\r\nab\r\n"
+
+	groups := atomic.LoadInt64(&groupsCommitted)
+	go a.Write([]byte(cmds))
+	readReply(c, a, expected)
+	c.Assert(atomic.LoadInt64(&groupsCommitted)-groups < n/2, Equals, true)
+	runProtocolTests(c, a, []protocolTest{{"GET pipeline99", "$1\r\na\r\n"}})
+}
+
+func (s ProtocolSuite) TestWatch(c *C) {
+	a, b := net.Pipe()
+	defer a.Close()
+	go handleClient(b)
+	other, otherServer := net.Pipe()
+	defer other.Close()
+	go handleClient(otherServer)
+
+	// EXEC runs if the watched keys aren't modified
+	runProtocolTests(c, a, []protocolTest{
+		{"WATCH w1 w2", "+OK\r\n"},
+		{"MULTI", "+OK\r\n"},
+		{"WATCH w1", "-ERR WATCH inside MULTI is not allowed\r\n"},
+		{"SET w1 a", "+QUEUED\r\n"},
+		{"EXEC", "*1\r\n+OK\r\n"},
+	})
+
+	// the client's own writes don't abort EXEC
+	runProtocolTests(c, a, []protocolTest{
+		{"WATCH w1", "+OK\r\n"},
+		{"SET w1 b", "+OK\r\n"},
+		{"MULTI", "+OK\r\n"},
+		{"GET w1", "+QUEUED\r\n"},
+		{"EXEC", "*1\r\n$1\r\nb\r\n"},
+	})
+
+	// a write from another client aborts EXEC
+	runProtocolTests(c, a, []protocolTest{{"WATCH w1 w2", "+OK\r\n"}})
+	runProtocolTests(c, other, []protocolTest{{"SET w2 c", "+OK\r\n"}})
+	runProtocolTests(c, a, []protocolTest{
+		{"MULTI", "+OK\r\n"},
+		{"SET w1 c", "+QUEUED\r\n"},
+		{"EXEC", "*-1\r\n"},
+		{"GET w1", "$1\r\nb\r\n"},
+	})
+
+	// EXEC unwatches the keys
+	runProtocolTests(c, other, []protocolTest{{"SET w2 d", "+OK\r\n"}})
+	runProtocolTests(c, a, []protocolTest{
+		{"MULTI", "+OK\r\n"},
+		{"SET w1 d", "+QUEUED\r\n"},
+		{"EXEC", "*1\r\n+OK\r\n"},
+	})
+
+	// UNWATCH
+	runProtocolTests(c, a, []protocolTest{{"WATCH w1", "+OK\r\n"}, {"UNWATCH", "+OK\r\n"}})
+	runProtocolTests(c, other, []protocolTest{{"SET w1 e", "+OK\r\n"}})
+	runProtocolTests(c, a, []protocolTest{
+		{"MULTI", "+OK\r\n"},
+		{"UNWATCH", "+QUEUED\r\n"},
+		{"GET w1", "+QUEUED\r\n"},
+		{"EXEC", "*2\r\n+OK\r\n$1\r\ne\r\n"},
+	})
+	c.Assert(watchedKeys, HasLen, 0)
+}
+
+func (s ProtocolSuite) TestPubsub(c *C) {
+	sub, subServer := net.Pipe()
+	defer sub.Close()
+	go handleClient(subServer)
+	pub, pubServer := net.Pipe()
+	defer pub.Close()
+	go handleClient(pubServer)
+
+	runProtocolTests(c, sub, []protocolTest{
+		{"SUBSCRIBE news weather", "*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n*3\r\n$9\r\nsubscribe\r\n$7\r\nweather\r\n:2\r\n"},
+		{"PSUBSCRIBE n*", "*3\r\n$10\r\npsubscribe\r\n$2\r\nn*\r\n:3\r\n"},
+		{"GET news", "-ERR only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT allowed in this context\r\n"},
+		{"PING", "*2\r\n$4\r\npong\r\n$0\r\n\r\n"},
+	})
+	runProtocolTests(c, pub, []protocolTest{
+		{"PUBLISH news hello", ":2\r\n"},
+		{"PUBLISH sports hello", ":0\r\n"},
+		{"PUBSUB CHANNELS", "*2\r\n$4\r\nnews\r\n$7\r\nweather\r\n"},
+		{"PUBSUB CHANNELS w*", "*1\r\n$7\r\nweather\r\n"},
+		{"PUBSUB NUMSUB news sports", "*4\r\n$4\r\nnews\r\n:1\r\n$6\r\nsports\r\n:0\r\n"},
+		{"PUBSUB NUMPAT", ":1\r\n"},
+	})
+
+	expected := "*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\nhello\r\n*4\r\n$8\r\npmessage\r\n$2\r\nn*\r\n$4\r\nnews\r\n$5\r\nhello\r\n"
+	readReply(c, sub, expected)
+
+	// PUBLISH is queued by MULTI, the subscription commands abort the transaction
+	runProtocolTests(c, pub, []protocolTest{
+		{"MULTI", "+OK\r\n"},
+		{"PUBLISH weather sunny", "+QUEUED\r\n"},
+		{"EXEC", "*1\r\n:1\r\n"},
+		{"MULTI", "+OK\r\n"},
+		{"PUBLISH weather rain", "+QUEUED\r\n"},
+		{"SUBSCRIBE weather", "-ERR SUBSCRIBE inside MULTI is not allowed\r\n"},
+		{"PUNSUBSCRIBE", "-ERR PUNSUBSCRIBE inside MULTI is not allowed\r\n"},
+		{"EXEC", "-EXECABORT Transaction discarded because of previous errors.\r\n"},
+	})
+	readReply(c, sub, "*3\r\n$7\r\nmessage\r\n$7\r\nweather\r\n$5\r\nsunny\r\n")
+
+	runProtocolTests(c, sub, []protocolTest{
+		{"UNSUBSCRIBE news", "*3\r\n$11\r\nunsubscribe\r\n$4\r\nnews\r\n:2\r\n"},
+		{"PUNSUBSCRIBE", "*3\r\n$12\r\npunsubscribe\r\n$2\r\nn*\r\n:1\r\n"},
+		{"UNSUBSCRIBE", "*3\r\n$11\r\nunsubscribe\r\n$7\r\nweather\r\n:0\r\n"},
+		{"UNSUBSCRIBE", "*3\r\n$11\r\nunsubscribe\r\n$-1\r\n:0\r\n"},
+		{"PING", "+PONG\r\n"},
+	})
+	runProtocolTests(c, pub, []protocolTest{{"PUBLISH news hello", ":0\r\n"}})
+}
+
+func (s ProtocolSuite) TestKeyspaceEvents(c *C) {
+	c.Assert(setNotifyFlags("KEA"), IsNil)
+	defer setNotifyFlags("")
+
+	sub, subServer := net.Pipe()
+	defer sub.Close()
+	go handleClient(subServer)
+	cl, clServer := net.Pipe()
+	defer cl.Close()
+	go handleClient(clServer)
+
+	runProtocolTests(c, sub, []protocolTest{
+		{"SUBSCRIBE __keyspace@0__:ev __keyevent@0__:del __keyspace@3__:ev", "*3\r\n$9\r\nsubscribe\r\n$17\r\n__keyspace@0__:ev\r\n:1\r\n*3\r\n$9\r\nsubscribe\r\n$18\r\n__keyevent@0__:del\r\n:2\r\n*3\r\n$9\r\nsubscribe\r\n$17\r\n__keyspace@3__:ev\r\n:3\r\n"},
+	})
+	runProtocolTests(c, cl, []protocolTest{
+		{"SET ev foo", "+OK\r\n"},
+		{"LPUSH evlist a", ":1\r\n"},
+		{"LPOP evlist", "$1\r\na\r\n"},
+		{"DEL ev", ":1\r\n"},
+		// the channels have the number of the database
+		{"SELECT 3", "+OK\r\n"},
+		{"SET ev foo", "+OK\r\n"},
+		{"DEL ev", ":1\r\n"},
+	})
+
+	expected := "*3\r\n$7\r\nmessage\r\n$17\r\n__keyspace@0__:ev\r\n$3\r\nset\r\n" +
+		"*3\r\n$7\r\nmessage\r\n$18\r\n__keyevent@0__:del\r\n$6\r\nevlist\r\n" +
+		"*3\r\n$7\r\nmessage\r\n$17\r\n__keyspace@0__:ev\r\n$3\r\ndel\r\n" +
+		"*3\r\n$7\r\nmessage\r\n$18\r\n__keyevent@0__:del\r\n$2\r\nev\r\n" +
+		"*3\r\n$7\r\nmessage\r\n$17\r\n__keyspace@3__:ev\r\n$3\r\nset\r\n" +
+		"*3\r\n$7\r\nmessage\r\n$17\r\n__keyspace@3__:ev\r\n$3\r\ndel\r\n"
+	readReply(c, sub, expected)
+}
+
+func (s ProtocolSuite) TestBlockingPop(c *C) {
+	conns := make([]net.Conn, 3)
+	for i := range conns {
+		client, server := net.Pipe()
+		defer client.Close()
+		go handleClient(server)
+		conns[i] = client
+	}
+	a, b, pusher := conns[0], conns[1], conns[2]
+
+	// waiters are served in the order that they blocked
+	sendCommand(a, "BLPOP bl1 bl2 0")
+	waitForListWaiters(c, "bl1", 1)
+	sendCommand(b, "BRPOP bl1 0")
+	waitForListWaiters(c, "bl1", 2)
+	runProtocolTests(c, pusher, []protocolTest{{"RPUSH bl1 x y", ":2\r\n"}})
+	readReply(c, a, "*2\r\n$3\r\nbl1\r\n$1\r\nx\r\n")
+	readReply(c, b, "*2\r\n$3\r\nbl1\r\n$1\r\ny\r\n")
+
+	sendCommand(a, "BRPOPLPUSH bl2 bl3 0")
+	waitForListWaiters(c, "bl2", 1)
+	runProtocolTests(c, pusher, []protocolTest{{"LPUSH bl2 z", ":1\r\n"}})
+	readReply(c, a, "$1\r\nz\r\n")
+	runProtocolTests(c, a, []protocolTest{
+		{"LRANGE bl3 0 -1", "*1\r\n$1\r\nz\r\n"},
+		{"BLPOP bl1 1", "*-1\r\n"},
+		{"BLPOP bl1 -1", "-ERR timeout is negative\r\n"},
+		// inside a transaction the commands don't block
+		{"MULTI", "+OK\r\n"},
+		{"BLPOP bl1 0", "+QUEUED\r\n"},
+		{"EXEC", "*1\r\n*-1\r\n"},
+	})
+
+	// a client that disconnects stops waiting
+	d, server := net.Pipe()
+	go handleClient(server)
+	sendCommand(d, "BLPOP bl4 0")
+	waitForListWaiters(c, "bl4", 1)
+	d.Close()
+	waitForListWaiters(c, "bl4", 0)
+}
+
+func (s ProtocolSuite) TestDatabases(c *C) {
+	a, b := net.Pipe()
+	defer a.Close()
+	go handleClient(b)
+	other, otherServer := net.Pipe()
+	defer other.Close()
+	go handleClient(otherServer)
+
+	runProtocolTests(c, a, []protocolTest{
+		{"SELECT 1", "+OK\r\n"},
+		{"FLUSHDB", "+OK\r\n"},
+		{"SET dbkey one", "+OK\r\n"},
+		{"SELECT 2", "+OK\r\n"},
+		{"FLUSHDB", "+OK\r\n"},
+		{"GET dbkey", "$-1\r\n"},
+		{"SET dbkey two", "+OK\r\n"},
+		{"DBSIZE", ":1\r\n"},
+		{"KEYS *", "*1\r\n$5\r\ndbkey\r\n"},
+		{"SCAN 0", "*2\r\n$1\r\n0\r\n*1\r\n$5\r\ndbkey\r\n"},
+		{"SELECT 16", "-ERR DB index is out of range\r\n"},
+		{"SELECT x", "-ERR invalid DB index\r\n"},
+
+		// MOVE doesn't replace a key that exists
+		{"MOVE dbkey 1", ":0\r\n"},
+		{"MOVE dbkey 2", "-ERR source and destination objects are the same\r\n"},
+		{"SADD moved a b", ":2\r\n"},
+		{"EXPIRE moved 100", ":1\r\n"},
+		{"MOVE moved 1", ":1\r\n"},
+		{"MOVE moved 1", ":0\r\n"},
+
+		// COPY only replaces a key that exists with REPLACE
+		{"COPY dbkey copied", ":1\r\n"},
+		{"COPY moved copied", ":0\r\n"},
+		{"SET dbkey three", "+OK\r\n"},
+		{"COPY dbkey copied REPLACE", ":1\r\n"},
+		{"GET copied", "$5\r\nthree\r\n"},
+		{"COPY dbkey dbkey", "-ERR source and destination objects are the same\r\n"},
+		{"COPY dbkey dbkey db 3", ":1\r\n"},
+		{"COPY dbkey other DB 16", "-ERR DB index is out of range\r\n"},
+		{"COPY dbkey other NX", "-ERR syntax error\r\n"},
+		{"DEL copied", ":1\r\n"},
+		{"SET dbkey two", "+OK\r\n"},
+		{"SELECT 3", "+OK\r\n"},
+		{"GET dbkey", "$5\r\nthree\r\n"},
+		{"FLUSHDB", "+OK\r\n"},
+		{"SELECT 1", "+OK\r\n"},
+		{"SCARD moved", ":2\r\n"},
+		{"TTL moved", ":100\r\n"},
+		{"GET dbkey", "$3\r\none\r\n"},
+		{"DBSIZE", ":2\r\n"},
+
+		// SWAPDB swaps the keys for every client
+		{"SWAPDB 1 2", "+OK\r\n"},
+		{"GET dbkey", "$3\r\ntwo\r\n"},
+		{"EXISTS moved", ":0\r\n"},
+		{"SWAPDB 2 1", "+OK\r\n"},
+
+		// SELECT is queued and changes the database of the commands after it
+		{"MULTI", "+OK\r\n"},
+		{"GET dbkey", "+QUEUED\r\n"},
+		{"SELECT 2", "+QUEUED\r\n"},
+		{"GET dbkey", "+QUEUED\r\n"},
+		{"SET txselect a", "+QUEUED\r\n"},
+		{"EXEC", "*4\r\n$3\r\none\r\n+OK\r\n$3\r\ntwo\r\n+OK\r\n"},
+		{"GET dbkey", "$3\r\ntwo\r\n"},
+		{"DEL txselect", ":1\r\n"},
+		{"SELECT 1", "+OK\r\n"},
+		{"EXISTS txselect", ":0\r\n"},
+		{"MULTI", "+OK\r\n"},
+		{"SELECT 2", "+QUEUED\r\n"},
+		{"SELECT 100", "-ERR DB index is out of range\r\n"},
+		{"EXEC", "-EXECABORT Transaction discarded because of previous errors.\r\n"},
+		{"GET dbkey", "$3\r\none\r\n"},
+
+		// COPY and MOVE are queued by MULTI like the other commands
+		{"MULTI", "+OK\r\n"},
+		{"COPY dbkey txcopy DB 3", "+QUEUED\r\n"},
+		{"COPY dbkey txcopy DB 3", "+QUEUED\r\n"},
+		{"COPY dbkey txmove", "+QUEUED\r\n"},
+		{"MOVE txmove 3", "+QUEUED\r\n"},
+		{"MOVE txmove x", "+QUEUED\r\n"},
+		{"EXEC", "*5\r\n:1\r\n:0\r\n:1\r\n:1\r\n-ERR invalid DB index\r\n"},
+		{"EXISTS txmove", ":0\r\n"},
+
+		// FLUSHDB only deletes the keys of the selected database
+		{"FLUSHDB", "+OK\r\n"},
+		{"DBSIZE", ":0\r\n"},
+		{"SELECT 2", "+OK\r\n"},
+		{"GET dbkey", "$3\r\ntwo\r\n"},
+	})
+	c.Assert(atomic.LoadInt64(&cmdStats["copy"].calls) > 0, Equals, true)
+	c.Assert(atomic.LoadInt64(&cmdStats["move"].calls) > 0, Equals, true)
+
+	// swapping the database of a watched key aborts EXEC
+	runProtocolTests(c, a, []protocolTest{{"WATCH dbkey", "+OK\r\n"}})
+	runProtocolTests(c, other, []protocolTest{{"SWAPDB 2 3", "+OK\r\n"}, {"SWAPDB 2 3", "+OK\r\n"}})
+	runProtocolTests(c, a, []protocolTest{
+		{"MULTI", "+OK\r\n"},
+		{"GET dbkey", "+QUEUED\r\n"},
+		{"EXEC", "*-1\r\n"},
+		{"FLUSHDB", "+OK\r\n"},
+
+		{"FLUSHDB now", "-ERR syntax error\r\n"},
+		{"SET dbkey three", "+OK\r\n"},
+		{"FLUSHDB ASYNC", "+OK\r\n"},
+		{"EXISTS dbkey", ":0\r\n"},
+
+		// FLUSHALL deletes the keys of every database
+		{"SET dbkey four", "+OK\r\n"},
+		{"SELECT 4", "+OK\r\n"},
+		{"SET dbkey five", "+OK\r\n"},
+		{"FLUSHALL SYNC", "+OK\r\n"},
+		{"DBSIZE", ":0\r\n"},
+		{"SELECT 2", "+OK\r\n"},
+		{"DBSIZE", ":0\r\n"},
+	})
+}
+
+func waitForListWaiters(c *C, key string, n int) {
+	for i := 0; i < 1000; i++ {
+		listWaitersMtx.Lock()
+		waiting := len(listWaiters[string(testKey(key))])
+		listWaitersMtx.Unlock()
+		if waiting == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.Fatalf("%d clients aren't blocked on %s", n, key)
+}
+
+func (s ProtocolSuite) TestMaxClients(c *C) {
+	defer atomic.StoreInt64(&config.maxClients, config.maxClients)
+	atomic.StoreInt64(&config.maxClients, 0)
+
+	a, b := net.Pipe()
+	defer a.Close()
+	go handleClient(b)
+	readReply(c, a, "-ERR max number of clients reached\r\n")
+}
+
+func (s ProtocolSuite) TestACL(c *C) {
+	aclMtx.RLock()
+	saved := aclUsers
+	aclMtx.RUnlock()
+	defer func() {
+		aclMtx.Lock()
+		aclUsers = saved
+		aclMtx.Unlock()
+		config.aclfile = ""
+		config.requirepass = ""
+	}()
+	config.aclfile = c.MkDir() + "/users.acl"
+
+	connect := func() net.Conn {
+		a, b := net.Pipe()
+		go handleClient(b)
+		return a
+	}
+	bulk := func(s string) string {
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+	}
+	hash := hashPassword("secret")
+	reader := "user reader on #" + hash + " ~cache:* -@all +@read -keys +@connection"
+
+	admin := connect()
+	defer admin.Close()
+	runProtocolTests(c, admin, []protocolTest{
+		{"ACL WHOAMI", bulk("default")},
+		{"ACL SETUSER reader on >secret ~cache:* +@read +keys", "+OK\r\n"},
+		{"ACL SETUSER reader -keys +@connection", "+OK\r\n"},
+		{"ACL GETUSER reader", "*8\r\n" + bulk("flags") + "*1\r\n" + bulk("on") +
+			bulk("passwords") + "*1\r\n" + bulk(hash) +
+			bulk("commands") + bulk("-@all +@read -keys +@connection") +
+			bulk("keys") + bulk("~cache:*")},
+		{"ACL GETUSER nobody", "$-1\r\n"},
+		{"ACL SETUSER reader +nothing", "-ERR Error in ACL SETUSER modifier '+nothing': Unknown command or category name in ACL\r\n"},
+		{"ACL SETUSER reader ~[", "-ERR Error in ACL SETUSER modifier '~[': Invalid key pattern\r\n"},
+		{"ACL SETUSER reader <wrong", "-ERR Error in ACL SETUSER modifier '<wrong': no such password\r\n"},
+		{"ACL SETUSER temp", "+OK\r\n"},
+		{"ACL DELUSER temp nobody", ":1\r\n"},
+		{"ACL DELUSER default", "-ERR The 'default' user cannot be removed\r\n"},
+		{"ACL LIST", "*2\r\n" + bulk("user default on nopass ~* +@all") + bulk(reader)},
+		{"ACL NOTHING", "-ERR Unknown ACL subcommand or wrong number of arguments for 'NOTHING'\r\n"},
+	})
+
+	// the users are saved when they change
+	data, err := ioutil.ReadFile(config.aclfile)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "user default on nopass ~* +@all\n"+reader+"\n")
+
+	user := connect()
+	defer user.Close()
+	runProtocolTests(c, user, []protocolTest{
+		{"AUTH reader wrong", "-WRONGPASS invalid username-password pair or user is disabled.\r\n"},
+		{"AUTH secret", "-ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?\r\n"},
+		{"AUTH reader secret", "+OK\r\n"},
+		{"GET cache:a", "$-1\r\n"},
+		{"PING", "+PONG\r\n"},
+		{"SUNION cache:a other", "-NOPERM No permissions to access a key\r\n"},
+		{"SET cache:a 1", "-NOPERM User reader has no permissions to run the 'set' command\r\n"},
+		{"KEYS *", "-NOPERM User reader has no permissions to run the 'keys' command\r\n"},
+		{"ACL WHOAMI", "-NOPERM User reader has no permissions to run the 'acl' command\r\n"},
+		{"SHUTDOWN", "-NOPERM User reader has no permissions to run the 'shutdown' command\r\n"},
+	})
+
+	// a disabled user can't authenticate
+	runProtocolTests(c, admin, []protocolTest{{"ACL SETUSER reader off", "+OK\r\n"}})
+	runProtocolTests(c, user, []protocolTest{
+		{"AUTH reader secret", "-WRONGPASS invalid username-password pair or user is disabled.\r\n"},
+	})
+
+	c.Assert(ioutil.WriteFile(config.aclfile, []byte("# users\nuser writer on nopass ~* +@write\n"), 0600), IsNil)
+	runProtocolTests(c, admin, []protocolTest{
+		{"ACL LOAD", "+OK\r\n"},
+		{"ACL USERS", "*2\r\n" + bulk("default") + bulk("writer")},
+		{"CONFIG SET requirepass pass", "+OK\r\n"},
+	})
+
+	// new clients need the password of the default user
+	other := connect()
+	defer other.Close()
+	runProtocolTests(c, other, []protocolTest{
+		{"GET a", "-NOAUTH Authentication required.\r\n"},
+		{"AUTH wrong", "-WRONGPASS invalid username-password pair or user is disabled.\r\n"},
+		{"AUTH pass", "+OK\r\n"},
+		{"GET a", "$-1\r\n"},
+		{"CONFIG SET requirepass ", "+OK\r\n"},
+	})
+	runProtocolTests(c, connect(), []protocolTest{{"PING", "+PONG\r\n"}})
+}
+
+// Create a certificate for name signed by parent, or a self-signed CA if parent
+// is nil, and write it and its key to dir/name.crt and dir/name.key.
+func writeTestCert(c *C, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	c.Assert(err, IsNil)
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, IsNil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(dir+"/"+name+".crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600), IsNil)
+	c.Assert(ioutil.WriteFile(dir+"/"+name+".key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600), IsNil)
+	return cert, key
+}
+
+func (s ProtocolSuite) TestTLS(c *C) {
+	tlsPort, certFile, keyFile, caFile := config.tlsPort, config.tlsCertFile, config.tlsKeyFile, config.tlsCACertFile
+	aclMtx.RLock()
+	savedUsers := aclUsers
+	aclMtx.RUnlock()
+	defer func() {
+		config.tlsPort, config.tlsCertFile, config.tlsKeyFile, config.tlsCACertFile = tlsPort, certFile, keyFile, caFile
+		config.tlsAuthClientsUser = "off"
+		aclMtx.Lock()
+		aclUsers = savedUsers
+		aclMtx.Unlock()
+	}()
+
+	dir := c.MkDir()
+	ca, caKey := writeTestCert(c, dir, "ca", nil, nil)
+	writeTestCert(c, dir, "server", ca, caKey)
+	writeTestCert(c, dir, "certuser", ca, caKey)
+	config.tlsPort = 1
+	config.tlsCertFile, config.tlsKeyFile = dir+"/server.crt", dir+"/server.key"
+	config.tlsCACertFile = dir + "/ca.crt"
+	config.tlsAuthClientsUser = "cn"
+	c.Assert(loadTLSConfig(), IsNil)
+	c.Assert(setACLUser("certuser", [][]byte{[]byte("on"), []byte("allkeys"), []byte("+@all")}), DeepEquals, ReplyOK)
+
+	plain, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer plain.Close()
+	l := newTLSListener(plain)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handleClient(conn)
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	clientCert, err := tls.LoadX509KeyPair(dir+"/certuser.crt", dir+"/certuser.key")
+	c.Assert(err, IsNil)
+	dial := func(certs ...tls.Certificate) *tls.Conn {
+		conn, err := tls.Dial("tcp", plain.Addr().String(), &tls.Config{RootCAs: roots, Certificates: certs})
+		c.Assert(err, IsNil)
+		return conn
+	}
+
+	// the client certificate authenticates the client as the user with its CN
+	conn := dial(clientCert)
+	runProtocolTests(c, conn, []protocolTest{
+		{"ACL WHOAMI", "$8\r\ncertuser\r\n"},
+		{"PING", "+PONG\r\n"},
+	})
+	c.Assert(conn.ConnectionState().PeerCertificates[0].Subject.CommonName, Equals, "server")
+	conn.Close()
+
+	// a client without a certificate is rejected
+	conn = dial()
+	sendCommand(conn, "PING")
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, NotNil)
+	conn.Close()
+
+	// reloading picks up the new server certificate for new connections
+	writeTestCert(c, dir, "reloaded", ca, caKey)
+	config.tlsCertFile, config.tlsKeyFile = dir+"/reloaded.crt", dir+"/reloaded.key"
+	c.Assert(reloadTLSConfig(), IsNil)
+	conn = dial(clientCert)
+	runProtocolTests(c, conn, []protocolTest{{"PING", "+PONG\r\n"}})
+	c.Assert(conn.ConnectionState().PeerCertificates[0].Subject.CommonName, Equals, "reloaded")
+	conn.Close()
+
+	config.tlsKeyFile = dir + "/missing.key"
+	c.Assert(reloadTLSConfig(), NotNil)
+}
+
+func (s ProtocolSuite) TestUnixSocket(c *C) {
+	defer func(path string, perm int) {
+		config.unixSocket, config.unixSocketPerm = path, perm
+	}(config.unixSocket, config.unixSocketPerm)
+	config.unixSocket = c.MkDir() + "/setdb.sock"
+	config.unixSocketPerm = 0700
+
+	// a socket file left behind is replaced
+	stale, err := net.Listen("unix", config.unixSocket)
+	c.Assert(err, IsNil)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := listenUnix()
+	c.Assert(err, IsNil)
+	fi, err := os.Stat(config.unixSocket)
+	c.Assert(err, IsNil)
+	c.Assert(fi.Mode(), Equals, os.ModeSocket|0700)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handleClient(conn)
+		}
+	}()
+
+	// each client is tracked separately even though they don't have addresses
+	a, err := net.Dial("unix", config.unixSocket)
+	c.Assert(err, IsNil)
+	defer a.Close()
+	b, err := net.Dial("unix", config.unixSocket)
+	c.Assert(err, IsNil)
+	defer b.Close()
+	runProtocolTests(c, a, []protocolTest{{"SET unixkey a", "+OK\r\n"}})
+	runProtocolTests(c, b, []protocolTest{{"GET unixkey", "$1\r\na\r\n"}})
+	clientsMtx.RLock()
+	unixClients := 0
+	for _, client := range clients {
+		if strings.HasPrefix(client.addr, config.unixSocket+":") {
+			unixClients++
+		}
+	}
+	clientsMtx.RUnlock()
+	c.Assert(unixClients, Equals, 2)
+
+	l.Close()
+	_, err = os.Stat(config.unixSocket)
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+// read a line of a reply, without the \r\n
+func readLine(c *C, conn net.Conn) string {
+	var line []byte
+	b := make([]byte, 1)
+	for !strings.HasSuffix(string(line), "\r\n") {
+		_, err := conn.Read(b)
+		c.Assert(err, IsNil)
+		line = append(line, b[0])
+	}
+	return string(line[:len(line)-2])
+}
+
+func (s ProtocolSuite) TestClient(c *C) {
+	aclMtx.RLock()
+	saved := aclUsers
+	aclMtx.RUnlock()
+	defer func() {
+		aclMtx.Lock()
+		aclUsers = saved
+		aclMtx.Unlock()
+	}()
+
+	connect := func() (net.Conn, string) {
+		a, b := net.Pipe()
+		go handleClient(b)
+		sendCommand(a, "CLIENT ID")
+		return a, readLine(c, a)[1:]
+	}
+	a, aID := connect()
+	defer a.Close()
+	b, bID := connect()
+	defer b.Close()
+
+	runProtocolTests(c, a, []protocolTest{
+		{"CLIENT SETNAME worker", "+OK\r\n"},
+		{"CLIENT GETNAME", "$6\r\nworker\r\n"},
+		{"CLIENT SETNAME bad\nname", "-ERR Client names cannot contain spaces, newlines or special characters.\r\n"},
+		{"SELECT 3", "+OK\r\n"},
+		{"CLIENT NOTHING", "-ERR Unknown CLIENT subcommand or wrong number of arguments for 'NOTHING'\r\n"},
+		{"MULTI", "+OK\r\n"},
+		{"CLIENT ID", "-ERR CLIENT inside MULTI is not allowed\r\n"},
+		{"DISCARD", "+OK\r\n"},
+	})
+	runProtocolTests(c, b, []protocolTest{{"CLIENT GETNAME", "$-1\r\n"}})
+
+	sendCommand(a, "CLIENT INFO")
+	readLine(c, a)
+	c.Assert(readLine(c, a), Equals, "id="+aID+" addr=pipe laddr=pipe name=worker age=0 idle=0 db=3 omem=0 cmd=client|info user=default\n")
+	sendCommand(a, "CLIENT LIST ID "+aID+" "+bID)
+	c.Assert(readLine(c, a), Matches, `\$\d+`)
+	c.Assert(readLine(c, a), Matches, "id="+aID+" .* name=worker .*\nid="+bID+" .* name= .* db=0 .* cmd=client\\|getname user=default\n")
+
+	// a blocked client stops waiting when it's killed
+	sendCommand(b, "BLPOP clientkill 0")
+	waitForListWaiters(c, "clientkill", 1)
+	runProtocolTests(c, a, []protocolTest{
+		{"CLIENT KILL ID " + bID + " USER default", ":1\r\n"},
+		{"CLIENT KILL USER nobody", "-ERR No such user 'nobody'\r\n"},
+		{"CLIENT KILL ID x", "-ERR client-id should be greater than 0\r\n"},
+		{"CLIENT KILL ID 1 NAME x", "-ERR syntax error\r\n"},
+		{"CLIENT KILL 1.2.3.4:5", "-ERR No such client\r\n"},
+		{"CLIENT KILL ID " + aID, ":0\r\n"},
+	})
+	readReply(c, b, "*-1\r\n")
+	_, err := b.Read(make([]byte, 1))
+	c.Assert(err, Equals, io.EOF)
+
+	// and when it has pipelined another command after the blocking one
+	p, pID := connect()
+	defer p.Close()
+	p.Write([]byte("*3\r\n$5\r\nBLPOP\r\n$11\r\nclientkill2\r\n$1\r\n0\r\n*1\r\n$4\r\nPING\r\n"))
+	waitForListWaiters(c, "clientkill2", 1)
+	runProtocolTests(c, a, []protocolTest{{"CLIENT KILL ID " + pID, ":1\r\n"}})
+	readReply(c, p, "*-1\r\n")
+	_, err = p.Read(make([]byte, 1))
+	c.Assert(err, Equals, io.EOF)
+
+	// the clients that aren't admins can only manage their own connection
+	runProtocolTests(c, a, []protocolTest{
+		{"ACL SETUSER limited on nopass +@connection", "+OK\r\n"},
+		{"AUTH limited any", "+OK\r\n"},
+		{"CLIENT GETNAME", "$6\r\nworker\r\n"},
+		{"CLIENT LIST", "-NOPERM User limited has no permissions to run the 'client|list' command\r\n"},
+		{"CLIENT KILL ID " + aID + " SKIPME no", "-NOPERM User limited has no permissions to run the 'client|kill' command\r\n"},
+		{"AUTH default any", "+OK\r\n"},
+		{"CLIENT KILL ID " + aID + " SKIPME no", ":1\r\n"},
+	})
+	_, err = a.Read(make([]byte, 1))
+	c.Assert(err, Equals, io.EOF)
+}
+
+func (s ProtocolSuite) TestOutputBufferLimits(c *C) {
+	defer setOutputBufferLimits(outputBufferLimitsString())
+	disconnections := func() int64 { return atomic.LoadInt64(&outputBufferDisconnections) }
+	waitForDisconnections := func(n int64) {
+		for i := 0; i < 3000 && disconnections() < n; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		c.Assert(disconnections(), Equals, n)
+	}
+	value := strings.Repeat("x", 200)
+
+	a, b := net.Pipe()
+	defer a.Close()
+	go handleClient(b)
+	runProtocolTests(c, a, []protocolTest{{"SET outputbuffer " + value, "+OK\r\n"}})
+
+	// a client that doesn't read its replies is disconnected once they are
+	// over the hard limit
+	c.Assert(setOutputBufferLimits("normal 300 0 0"), IsNil)
+	before := disconnections()
+	for i := 0; i < 3; i++ {
+		sendCommand(a, "GET outputbuffer")
+	}
+	waitForDisconnections(before + 1)
+	_, err := ioutil.ReadAll(a)
+	c.Assert(err, IsNil)
+
+	// the soft limit allows the replies to be over it for a while
+	c.Assert(setOutputBufferLimits("normal 0 300 1"), IsNil)
+	a, b = net.Pipe()
+	defer a.Close()
+	go handleClient(b)
+	for i := 0; i < 3; i++ {
+		sendCommand(a, "GET outputbuffer")
+	}
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(disconnections(), Equals, before+1)
+	waitForDisconnections(before + 2)
+	ioutil.ReadAll(a)
+
+	// subscribers have their own limits, and publishers aren't slowed down
+	c.Assert(setOutputBufferLimits("normal 0 0 0 pubsub 300 0 0"), IsNil)
+	sub, subServer := net.Pipe()
+	defer sub.Close()
+	go handleClient(subServer)
+	runProtocolTests(c, sub, []protocolTest{{"SUBSCRIBE slow", "*3\r\n$9\r\nsubscribe\r\n$4\r\nslow\r\n:1\r\n"}})
+	a, b = net.Pipe()
+	defer a.Close()
+	go handleClient(b)
+	runProtocolTests(c, a, []protocolTest{
+		{"GET outputbuffer", "$200\r\n" + value + "\r\n"},
+		{"PUBLISH slow " + value, ":1\r\n"},
+		{"PUBLISH slow " + value, ":1\r\n"},
+	})
+	// the subscriber can be disconnected before the third message is published
+	sendCommand(a, "PUBLISH slow "+value)
+	c.Assert(readLine(c, a), Matches, ":[01]")
+	waitForDisconnections(before + 3)
+	ioutil.ReadAll(sub)
+	sendCommand(a, "INFO stats")
+	var size int
+	fmt.Sscanf(readLine(c, a), "$%d", &size)
+	info := make([]byte, size+2)
+	_, err = io.ReadFull(a, info)
+	c.Assert(err, IsNil)
+	c.Assert(string(info), Matches, fmt.Sprintf("(?s).*\r\nclient_output_buffer_limit_disconnections:%d\r\n.*", before+3))
+}
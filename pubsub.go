@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Pub/Sub
+//
+// Subscriptions are kept in memory in a registry of channel (or pattern) ->
+// subscribed clients. Messages are encoded once and sent to each subscriber's
+// write channel. Patterns use the same matching as KEYS.
+//
+// A client with at least one subscription is in subscriber mode, where it can
+// only run the subscription commands, PING and QUIT.
+
+var (
+	pubsubChannels = make(map[string]map[*client]bool) // channel -> subscribers
+	pubsubPatterns = make(map[string]map[*client]bool) // pattern -> subscribers
+	pubsubMtx      = &sync.RWMutex{}
+)
+
+// Subscription commands change the state of the client, so they are handled by
+// the client instead of the command table. -n arity means >= n
+var pubsubCommands = map[string]int{
+	"subscribe":    -1,
+	"unsubscribe":  0,
+	"psubscribe":   -1,
+	"punsubscribe": 0,
+}
+
+// handles the subscription commands for the client, a reply is sent for each
+// channel or pattern
+func (c *client) pubsub(name string, args [][]byte) {
+	switch name {
+	case "subscribe":
+		c.subscribe(name, pubsubChannels, c.channels, args)
+	case "psubscribe":
+		c.subscribe(name, pubsubPatterns, c.patterns, args)
+	case "unsubscribe":
+		c.unsubscribe(name, pubsubChannels, c.channels, args)
+	case "punsubscribe":
+		c.unsubscribe(name, pubsubPatterns, c.patterns, args)
+	}
+}
+
+func (c *client) subscribe(kind string, registry map[string]map[*client]bool, subscriptions map[string]bool, names [][]byte) {
+	pubsubMtx.Lock()
+	defer pubsubMtx.Unlock()
+	for _, name := range names {
+		n := string(name)
+		if !subscriptions[n] {
+			subscriptions[n] = true
+			if registry[n] == nil {
+				registry[n] = make(map[*client]bool)
+			}
+			registry[n][c] = true
+		}
+		c.w <- pubsubReply([]byte(kind), name, c.subscriptions())
+	}
+	atomic.StoreInt32(&c.subscribed, int32(c.subscriptions()))
+}
+
+// unsubscribe from names, or from everything if names is empty
+func (c *client) unsubscribe(kind string, registry map[string]map[*client]bool, subscriptions map[string]bool, names [][]byte) {
+	pubsubMtx.Lock()
+	defer pubsubMtx.Unlock()
+	if len(names) == 0 {
+		if len(subscriptions) == 0 {
+			c.w <- pubsubReply([]byte(kind), nil, c.subscriptions())
+			return
+		}
+		for n := range subscriptions {
+			names = append(names, []byte(n))
+		}
+	}
+	for _, name := range names {
+		n := string(name)
+		if subscriptions[n] {
+			delete(subscriptions, n)
+			delete(registry[n], c)
+			if len(registry[n]) == 0 {
+				delete(registry, n)
+			}
+		}
+		c.w <- pubsubReply([]byte(kind), name, c.subscriptions())
+	}
+	atomic.StoreInt32(&c.subscribed, int32(c.subscriptions()))
+}
+
+// remove all of the client's subscriptions without replying, this must be done
+// before the client's write channel is closed
+func (c *client) unsubscribeAll() {
+	pubsubMtx.Lock()
+	defer pubsubMtx.Unlock()
+	for n := range c.channels {
+		delete(pubsubChannels[n], c)
+		if len(pubsubChannels[n]) == 0 {
+			delete(pubsubChannels, n)
+		}
+	}
+	for n := range c.patterns {
+		delete(pubsubPatterns[n], c)
+		if len(pubsubPatterns[n]) == 0 {
+			delete(pubsubPatterns, n)
+		}
+	}
+	c.channels = make(map[string]bool)
+	c.patterns = make(map[string]bool)
+	atomic.StoreInt32(&c.subscribed, 0)
+}
+
+// the number of channels and patterns the client is subscribed to
+func (c *client) subscriptions() int {
+	return len(c.channels) + len(c.patterns)
+}
+
+func Publish(args [][]byte, wb *Batch) interface{} {
+	return publish(args[0], args[1])
+}
+
+// send message to the subscribers of channel, and return the number of clients
+// that received it
+func publish(channel, message []byte) int {
+	pubsubMtx.RLock()
+	defer pubsubMtx.RUnlock()
+	receivers := 0
+	if subscribers := pubsubChannels[string(channel)]; len(subscribers) > 0 {
+		msg := pubsubReply([]byte("message"), channel, message)
+		for c := range subscribers {
+			c.w <- msg
+			receivers++
+		}
+	}
+	for pattern, subscribers := range pubsubPatterns {
+		if matched, _ := filepath.Match(pattern, string(channel)); !matched {
+			continue
+		}
+		msg := pubsubReply([]byte("pmessage"), []byte(pattern), channel, message)
+		for c := range subscribers {
+			c.w <- msg
+			receivers++
+		}
+	}
+	return receivers
+}
+
+func Pubsub(args [][]byte, wb *Batch) interface{} {
+	pubsubMtx.RLock()
+	defer pubsubMtx.RUnlock()
+	switch {
+	case EqualIgnoreCase(args[0], []byte("channels")) && len(args) <= 2:
+		names := []string{}
+		for n := range pubsubChannels {
+			if len(args) == 2 {
+				matched, err := filepath.Match(string(args[1]), n)
+				if err != nil {
+					return fmt.Errorf("invalid pattern for 'pubsub' command")
+				}
+				if !matched {
+					continue
+				}
+			}
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		res := make([]interface{}, len(names))
+		for i, n := range names {
+			res[i] = []byte(n)
+		}
+		return res
+	case EqualIgnoreCase(args[0], []byte("numsub")):
+		res := make([]interface{}, 0, 2*(len(args)-1))
+		for _, n := range args[1:] {
+			res = append(res, n, len(pubsubChannels[string(n)]))
+		}
+		return res
+	case EqualIgnoreCase(args[0], []byte("numpat")) && len(args) == 1:
+		return len(pubsubPatterns)
+	}
+	return fmt.Errorf("Unknown PUBSUB subcommand or wrong number of arguments for '%s'", args[0])
+}
+
+// Encode a multi-bulk reply of bulk strings, integers and nils into a single buffer.
+// Messages are written by other clients, so they have to be sent to the write
+// channel in one piece to avoid being interleaved with the client's replies.
+func pubsubReply(items ...interface{}) rawReply {
+	buf := strconv.AppendInt([]byte{'*'}, int64(len(items)), 10)
+	buf = append(buf, "\r\n"...)
+	for _, item := range items {
+		switch v := item.(type) {
+		case nil:
+			buf = append(buf, "$-1"...)
+		case []byte:
+			buf = strconv.AppendInt(append(buf, '$'), int64(len(v)), 10)
+			buf = append(buf, "\r\n"...)
+			buf = append(buf, v...)
+		case int:
+			buf = strconv.AppendInt(append(buf, ':'), int64(v), 10)
+		}
+		buf = append(buf, "\r\n"...)
+	}
+	return buf
+}
@@ -10,20 +10,37 @@ import (
 )
 
 type rdbDecoder struct {
-	wb *levigo.WriteBatch
-	i  int64
+	wb  *Batch
+	i   int64
+	err error
 	nopdecoder.NopDecoder
 }
 
+// expiry is an absolute unix time in milliseconds, 0 means the key doesn't expire
+func (p *rdbDecoder) setExpire(key []byte, expiry int64) {
+	if expiry > 0 && p.err == nil {
+		p.err = setExpire(key, expiry, p.wb)
+	}
+}
+
+// delete any existing key that is being replaced
+func (p *rdbDecoder) del(key []byte) {
+	if _, err := delKey(metaKey(key), p.wb); err != nil && p.err == nil {
+		p.err = err
+	}
+}
+
 func (p *rdbDecoder) Set(key, value []byte, expiry int64) {
-	Del([][]byte{key}, p.wb)
+	p.del(key)
 	setStringLen(metaKey(key), len(value), p.wb)
 	p.wb.Put(stringKey(key), value)
+	p.setExpire(key, expiry)
 }
 
 func (p *rdbDecoder) StartHash(key []byte, length, expiry int64) {
-	Del([][]byte{key}, p.wb)
+	p.del(key)
 	setHlen(metaKey(key), uint32(length), p.wb)
+	p.setExpire(key, expiry)
 }
 
 func (p *rdbDecoder) Hset(key, field, value []byte) {
@@ -31,8 +48,9 @@ func (p *rdbDecoder) Hset(key, field, value []byte) {
 }
 
 func (p *rdbDecoder) StartSet(key []byte, cardinality, expiry int64) {
-	Del([][]byte{key}, p.wb)
+	p.del(key)
 	setCard(metaKey(key), uint32(cardinality), p.wb)
+	p.setExpire(key, expiry)
 }
 
 func (p *rdbDecoder) Sadd(key, member []byte) {
@@ -41,8 +59,10 @@ func (p *rdbDecoder) Sadd(key, member []byte) {
 
 func (p *rdbDecoder) StartList(key []byte, length, expiry int64) {
 	p.i = 0
-	Del([][]byte{key}, p.wb)
-	setLlen(metaKey(key), &listDetails{length: uint32(length), right: length + 2}, p.wb)
+	p.del(key)
+	setLlen(metaKey(key), &listDetails{length: uint32(length), right: length + 1}, p.wb)
+	p.wb.ListPushed(key)
+	p.setExpire(key, expiry)
 }
 
 func (p *rdbDecoder) Rpush(key, value []byte) {
@@ -53,8 +73,9 @@ func (p *rdbDecoder) Rpush(key, value []byte) {
 }
 
 func (p *rdbDecoder) StartZSet(key []byte, cardinality, expiry int64) {
-	Del([][]byte{key}, p.wb)
+	p.del(key)
 	setZcard(metaKey(key), uint32(cardinality), p.wb)
+	p.setExpire(key, expiry)
 }
 
 func (p *rdbDecoder) Zadd(key []byte, score float64, member []byte) {
@@ -68,7 +89,8 @@ func (p *rdbDecoder) Zadd(key []byte, score float64, member []byte) {
 }
 
 type rdbEncoder struct {
-	r *rdb.Encoder
+	r  *rdb.Encoder
+	wb *Batch
 }
 
 func (e *rdbEncoder) encodeKey(key []byte, dump bool) error {
@@ -78,7 +100,7 @@ func (e *rdbEncoder) encodeKey(key []byte, dump bool) error {
 	defer DB.ReleaseSnapshot(snapshot)
 	defer opts.Close()
 
-	res, err := DB.Get(opts, metaKey(key))
+	res, err := e.wb.Get(opts, metaKey(key))
 	if err != nil {
 		return err
 	}
@@ -89,6 +111,17 @@ func (e *rdbEncoder) encodeKey(key []byte, dump bool) error {
 		return InvalidDataError
 	}
 
+	// dumps don't include the expiry, it is sent separately
+	if !dump {
+		expiry, err := getExpire(key, opts, e.wb)
+		if err != nil {
+			return err
+		}
+		if expiry > 0 {
+			e.r.EncodeExpiry(uint64(expiry))
+		}
+	}
+
 	length := binary.BigEndian.Uint32(res[1:])
 	switch res[0] {
 	case StringLengthValue:
@@ -130,7 +163,7 @@ func (e *rdbEncoder) encodeKey(key []byte, dump bool) error {
 }
 
 func (e *rdbEncoder) encodeString(key []byte, opts *levigo.ReadOptions) error {
-	res, err := DB.Get(opts, stringKey(key))
+	res, err := e.wb.Get(opts, stringKey(key))
 	if err != nil {
 		return err
 	}
@@ -144,7 +177,7 @@ func (e *rdbEncoder) encodeHash(key []byte, length uint32, opts *levigo.ReadOpti
 	}
 
 	iterKey := NewKeyBuffer(HashKey, key, 0)
-	it := DB.NewIterator(opts)
+	it := e.wb.NewIterator(opts)
 	defer it.Close()
 
 	for it.Seek(iterKey.Key()); it.Valid(); it.Next() {
@@ -172,7 +205,7 @@ func (e *rdbEncoder) encodeList(key []byte, length uint32, opts *levigo.ReadOpti
 	}
 
 	iterKey := NewKeyBuffer(ListKey, key, 0)
-	it := DB.NewIterator(opts)
+	it := e.wb.NewIterator(opts)
 	defer it.Close()
 
 	for it.Seek(iterKey.Key()); it.Valid(); it.Next() {
@@ -195,7 +228,7 @@ func (e *rdbEncoder) encodeSet(key []byte, cardinality uint32, opts *levigo.Read
 	}
 
 	iterKey := NewKeyBuffer(SetKey, key, 0)
-	it := DB.NewIterator(opts)
+	it := e.wb.NewIterator(opts)
 	defer it.Close()
 
 	for it.Seek(iterKey.Key()); it.Valid(); it.Next() {
@@ -220,7 +253,7 @@ func (e *rdbEncoder) encodeZSet(key []byte, cardinality uint32, opts *levigo.Rea
 
 	iterKey := NewKeyBuffer(ZScoreKey, key, 0)
 	iterKey.ReverseIterKey()
-	it := DB.NewIterator(opts)
+	it := e.wb.NewIterator(opts)
 	defer it.Close()
 	it.Seek(iterKey.Key())
 
@@ -229,7 +262,7 @@ func (e *rdbEncoder) encodeZSet(key []byte, cardinality uint32, opts *levigo.Rea
 		if !iterKey.IsPrefixOf(k) {
 			break
 		}
-		score, member := parseZScoreKey(k, len(iterKey.Key())-5)
+		score, member := parseZScoreKey(k, key)
 		err = e.r.EncodeString(member)
 		if err != nil {
 			return err
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+)
+
+// Renaming and copying keys
+//
+// The elements of every type are stored under the name of their key, so
+// RENAME, COPY and MOVE rewrite each element under the new name. The elements
+// are read with an iterator and written to the command's batch one at a time,
+// and the whole rewrite is committed in the same write, so a collection is
+// renamed atomically. The expiry moves with the key.
+//
+// The batch is kept in memory until it's committed, so it holds a copy of every
+// element. copy-max-size limits the bytes of elements that a command rewrites,
+// and a larger collection is an error that leaves both keys unchanged.
+
+var NoSuchKeyError = fmt.Errorf("no such key")
+
+// the key types that the elements of each type of key are stored under, a
+// string is stored under its StringKey without a suffix
+var elementKeyTypes = map[byte][]byte{
+	HashLengthValue: {HashKey},
+	ListLengthValue: {ListKey},
+	SetCardValue:    {SetKey},
+	ZCardValue:      {ZSetKey, ZScoreKey},
+}
+
+func Rename(args [][]byte, wb *Batch) interface{} {
+	res := rename(args[0], args[1], true, wb)
+	if _, ok := res.(error); ok {
+		return res
+	}
+	return ReplyOK
+}
+
+func Renamenx(args [][]byte, wb *Batch) interface{} {
+	return rename(args[0], args[1], false, wb)
+}
+
+func rename(src, dst []byte, replace bool, wb *Batch) interface{} {
+	res, err := wb.Get(DefaultReadOptions, metaKey(src))
+	if err != nil {
+		return err
+	}
+	if res == nil {
+		return NoSuchKeyError
+	}
+	if bytes.Equal(src, dst) {
+		return 0
+	}
+	copied, err := copyKey(src, dst, replace, wb)
+	if err != nil {
+		return err
+	}
+	if !copied {
+		return 0
+	}
+	if _, err := delKey(metaKey(src), wb); err != nil {
+		return err
+	}
+	wb.Notify(notifyGeneric, "rename_from", src)
+	wb.Notify(notifyGeneric, "rename_to", dst)
+	return 1
+}
+
+// Copy src with its expiry to dst, which must be a different key. If dst
+// exists it's deleted first when replace is set, otherwise nothing is copied.
+// Returns false if nothing was copied.
+func copyKey(src, dst []byte, replace bool, wb *Batch) (bool, error) {
+	meta, err := wb.Get(DefaultReadOptions, metaKey(src))
+	if err != nil || meta == nil {
+		return false, err
+	}
+	if typeName(meta) == "" {
+		return false, InvalidDataError
+	}
+	expiry, err := getExpire(src, nil, wb)
+	if err != nil {
+		return false, err
+	}
+	dstMeta := metaKey(dst)
+	res, err := wb.Get(DefaultReadOptions, dstMeta)
+	if err != nil {
+		return false, err
+	}
+	if res != nil {
+		if !replace {
+			return false, nil
+		}
+		if _, err := delKey(dstMeta, wb); err != nil {
+			return false, err
+		}
+	}
+
+	if meta[0] == StringLengthValue {
+		v, err := wb.Get(DefaultReadOptions, stringKey(src))
+		if err != nil {
+			return false, err
+		}
+		wb.Put(stringKey(dst), v)
+	}
+	var size int64
+	for _, t := range elementKeyTypes[meta[0]] {
+		if err := copyElements(t, src, dst, &size, wb); err != nil {
+			return false, err
+		}
+	}
+	wb.Put(dstMeta, meta)
+	if expiry > 0 {
+		if err := setExpire(dst, expiry, wb); err != nil {
+			return false, err
+		}
+	}
+	if meta[0] == ListLengthValue {
+		wb.ListPushed(dst)
+	}
+	return true, nil
+}
+
+// write each element of type t stored under src under dst, adding the bytes
+// written to size until it's over copy-max-size
+func copyElements(t byte, src, dst []byte, size *int64, wb *Batch) error {
+	max := atomic.LoadInt64(&config.copyMaxSize)
+	it := wb.NewIterator(ReadWithoutCacheFill)
+	defer it.Close()
+	iterKey := NewKeyBuffer(t, src, 0)
+	dstKey := NewKeyBuffer(t, dst, 0)
+	for it.Seek(iterKey.Key()); it.Valid(); it.Next() {
+		k := it.Key()
+		if !iterKey.IsPrefixOf(k) {
+			break
+		}
+		dstKey.SetSuffix(keySuffix(src, k))
+		*size += int64(len(dstKey.Key()) + len(it.Value()))
+		if max > 0 && *size > max {
+			return fmt.Errorf("the key is larger than copy-max-size (%d bytes)", max)
+		}
+		wb.Put(dstKey.Key(), it.Value())
+	}
+	return it.GetError()
+}
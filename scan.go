@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/titanous/bconv"
+)
+
+// Cursor-based iteration
+//
+// A scan resumes from the LevelDB key that the last call stopped at. Keys are
+// sorted, so seeking to that key continues after the keys that have already
+// been returned even if keys were added or deleted in between. Keys that exist
+// for the whole scan are returned exactly once.
+//
+// Clients expect a 64 bit integer, so the key is kept in a table on the server
+// and the cursor is a number that refers to it, which also keeps the keys out
+// of the cursors. 0 starts a scan, and is returned when the scan is done. A
+// cursor is removed when it's used and the next call returns a new one, so a
+// scan only holds one cursor however many keys it visits. A cursor expires if
+// it isn't used for scanCursorTTL, and the oldest cursors are dropped when
+// there are maxScanCursors of them. Using one after that, or using a cursor a
+// second time, is an invalid cursor.
+
+const defaultScanCount = 10
+
+const scanCursorTTL = 10 * time.Minute
+
+// the number of cursors that are kept, only changed by the tests
+var maxScanCursors = 100000
+
+type scanCursor struct {
+	prefix  []byte // the prefix of the keys that are scanned
+	key     []byte // the key that the scan resumes from, without the prefix
+	expires time.Time
+}
+
+var (
+	scanCursors      = make(map[uint64]*scanCursor) // cursor -> where the scan resumes
+	lastScanCursor   uint64
+	oldestScanCursor = uint64(1) // cursors before this one have been removed
+	scanCursorsMtx   = &sync.Mutex{}
+)
+
+type scanOptions struct {
+	pattern string // MATCH
+	count   int64  // COUNT, the number of keys visited per call
+	typ     string // TYPE, only for SCAN
+}
+
+// SCAN is a keyspace command, args[0] is the prefix of the database
+func Scan(args [][]byte, wb *Batch) interface{} {
+	cursor, opts, err := parseScanArgs(args[1:], true)
+	if err != nil {
+		return err
+	}
+	now := unixMilli(time.Now())
+	keys := []interface{}{}
+	prefix := append([]byte{MetaKey}, args[0]...)
+	inRange := func(k []byte) bool {
+		return len(k) > len(prefix) && bytes.HasPrefix(k, prefix)
+	}
+	next, err := scanKeys(prefix, inRange, cursor, opts, wb, func(k, v []byte) error {
+		if opts.typ != "" && typeName(v) != opts.typ {
+			return nil
+		}
+		// skip keys that have expired but haven't been reaped yet
+		expiry, err := getExpire(dbKey(args[0], k), nil, wb)
+		if err != nil {
+			return err
+		}
+		if expiry > 0 && expiry <= now {
+			return nil
+		}
+		keys = append(keys, k)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return []interface{}{next, keys}
+}
+
+func Sscan(args [][]byte, wb *Batch) interface{} {
+	return scanCollection(SetKey, args, wb, func(member, v []byte) []interface{} {
+		return []interface{}{member}
+	})
+}
+
+func Hscan(args [][]byte, wb *Batch) interface{} {
+	return scanCollection(HashKey, args, wb, func(field, value []byte) []interface{} {
+		return []interface{}{field, value}
+	})
+}
+
+func Zscan(args [][]byte, wb *Batch) interface{} {
+	return scanCollection(ZSetKey, args, wb, func(member, score []byte) []interface{} {
+		return []interface{}{member, ftoa(btof(score))}
+	})
+}
+
+// Scan the items of a set, hash or zset stored with keys of type t, reply
+// converts a matching item to the reply items.
+func scanCollection(t byte, args [][]byte, wb *Batch, reply func(k, v []byte) []interface{}) interface{} {
+	cursor, opts, err := parseScanArgs(args[1:], false)
+	if err != nil {
+		return err
+	}
+	items := []interface{}{}
+	iterKey := NewKeyBuffer(t, args[0], 0)
+	next, err := scanKeys(iterKey.Key(), iterKey.IsPrefixOf, cursor, opts, wb, func(k, v []byte) error {
+		items = append(items, reply(k, v)...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return []interface{}{next, items}
+}
+
+// Visit up to opts.count keys starting where cursor resumes, while inRange
+// returns true. f is called with the keys that match the pattern, without the
+// prefix. Returns the cursor for the next call.
+func scanKeys(prefix []byte, inRange func([]byte) bool, cursor uint64, opts *scanOptions, wb *Batch, f func(k, v []byte) error) ([]byte, error) {
+	var resume []byte
+	if cursor != 0 {
+		var ok bool
+		if resume, ok = lookupScanCursor(cursor, prefix); !ok {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+	}
+	it := wb.NewIterator(ReadWithoutCacheFill)
+	defer it.Close()
+	var n int64
+	start := append(append([]byte{}, prefix...), resume...)
+	for it.Seek(start); it.Valid(); it.Next() {
+		k := it.Key()
+		if !inRange(k) {
+			break
+		}
+		if n == opts.count {
+			return strconv.AppendUint(nil, newScanCursor(prefix, k[len(prefix):]), 10), nil
+		}
+		n++
+		if opts.pattern != "" {
+			// filepath.Match() implements the same pattern syntax as KEYS
+			if matched, _ := filepath.Match(opts.pattern, string(k[len(prefix):])); !matched {
+				continue
+			}
+		}
+		if err := f(k[len(prefix):], it.Value()); err != nil {
+			return nil, err
+		}
+	}
+	return []byte("0"), nil
+}
+
+// parse the cursor and the options that follow it
+func parseScanArgs(args [][]byte, allowType bool) (uint64, *scanOptions, error) {
+	cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid cursor")
+	}
+	opts := &scanOptions{count: defaultScanCount}
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return 0, nil, SyntaxError
+		}
+		switch {
+		case EqualIgnoreCase(args[i], []byte("match")):
+			opts.pattern = string(args[i+1])
+			if _, err := filepath.Match(opts.pattern, ""); err != nil {
+				return 0, nil, fmt.Errorf("invalid pattern")
+			}
+		case EqualIgnoreCase(args[i], []byte("count")):
+			opts.count, err = bconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return 0, nil, InvalidIntError
+			}
+			if opts.count < 1 {
+				return 0, nil, SyntaxError
+			}
+		case allowType && EqualIgnoreCase(args[i], []byte("type")):
+			opts.typ = string(bytes.ToLower(args[i+1]))
+		default:
+			return 0, nil, SyntaxError
+		}
+	}
+	return cursor, opts, nil
+}
+
+// Returns a new cursor for a scan of the keys with prefix that resumes from key
+func newScanCursor(prefix, key []byte) uint64 {
+	scanCursorsMtx.Lock()
+	defer scanCursorsMtx.Unlock()
+	now := time.Now()
+	// the cursors are made in the order they expire, so the oldest ones are
+	// removed first, skipping the ones that have been used
+	for oldestScanCursor <= lastScanCursor {
+		c := scanCursors[oldestScanCursor]
+		if c != nil && now.Before(c.expires) && len(scanCursors) < maxScanCursors {
+			break
+		}
+		delete(scanCursors, oldestScanCursor)
+		oldestScanCursor++
+	}
+	lastScanCursor++
+	scanCursors[lastScanCursor] = &scanCursor{
+		prefix:  append([]byte{}, prefix...),
+		key:     append([]byte{}, key...),
+		expires: now.Add(scanCursorTTL),
+	}
+	return lastScanCursor
+}
+
+// Returns the key that cursor resumes from and removes the cursor, false if the
+// cursor doesn't exist, has expired, or was made by a scan of other keys
+func lookupScanCursor(cursor uint64, prefix []byte) ([]byte, bool) {
+	scanCursorsMtx.Lock()
+	defer scanCursorsMtx.Unlock()
+	c := scanCursors[cursor]
+	if c == nil || !time.Now().Before(c.expires) || !bytes.Equal(c.prefix, prefix) {
+		return nil, false
+	}
+	delete(scanCursors, cursor)
+	return c.key, true
+}
@@ -16,11 +16,11 @@ import (
 // For each member:
 // SetKey | key length uint32 | key | member = empty
 
-func Sadd(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Sadd(args [][]byte, wb *Batch) interface{} {
 	var newMembers uint32
 	key := NewKeyBuffer(SetKey, args[0], len(args[1]))
 	mk := metaKey(args[0])
-	card, err := scard(mk, nil)
+	card, err := scard(mk, nil, wb)
 	if err != nil {
 		return err
 	}
@@ -28,7 +28,7 @@ func Sadd(args [][]byte, wb *levigo.WriteBatch) interface{} {
 	for _, member := range args[1:] {
 		key.SetSuffix(member)
 		if card > 0 {
-			res, err := DB.Get(DefaultReadOptions, key.Key())
+			res, err := wb.Get(DefaultReadOptions, key.Key())
 			if err != nil {
 				return err
 			}
@@ -41,21 +41,22 @@ func Sadd(args [][]byte, wb *levigo.WriteBatch) interface{} {
 	}
 	if newMembers > 0 {
 		setCard(mk, card+newMembers, wb)
+		wb.Notify(notifySet, "sadd", args[0])
 	}
 	return newMembers
 }
 
-func Scard(args [][]byte, wb *levigo.WriteBatch) interface{} {
-	card, err := scard(metaKey(args[0]), nil)
+func Scard(args [][]byte, wb *Batch) interface{} {
+	card, err := scard(metaKey(args[0]), nil, wb)
 	if err != nil {
 		return err
 	}
 	return card
 }
 
-func Srem(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Srem(args [][]byte, wb *Batch) interface{} {
 	mk := metaKey(args[0])
-	card, err := scard(mk, nil)
+	card, err := scard(mk, nil, wb)
 	if err != nil {
 		return err
 	}
@@ -66,7 +67,7 @@ func Srem(args [][]byte, wb *levigo.WriteBatch) interface{} {
 	key := NewKeyBuffer(SetKey, args[0], len(args[1]))
 	for _, member := range args[1:] {
 		key.SetSuffix(member)
-		res, err := DB.Get(ReadWithoutCacheFill, key.Key())
+		res, err := wb.Get(ReadWithoutCacheFill, key.Key())
 		if err != nil {
 			return err
 		}
@@ -76,16 +77,23 @@ func Srem(args [][]byte, wb *levigo.WriteBatch) interface{} {
 		wb.Delete(key.Key())
 		deleted++
 	}
+	if deleted > 0 {
+		wb.Notify(notifySet, "srem", args[0])
+	}
 	if deleted == card {
-		wb.Delete(mk)
+		err = delMetaKey(mk, wb)
+		if err != nil {
+			return err
+		}
+		wb.Notify(notifyGeneric, "del", args[0])
 	} else if deleted > 0 { // decrement the cardinality
 		setCard(mk, card-deleted, wb)
 	}
 	return deleted
 }
 
-func Sismember(args [][]byte, wb *levigo.WriteBatch) interface{} {
-	res, err := DB.Get(DefaultReadOptions, NewKeyBufferWithSuffix(SetKey, args[0], args[1]).Key())
+func Sismember(args [][]byte, wb *Batch) interface{} {
+	res, err := wb.Get(DefaultReadOptions, NewKeyBufferWithSuffix(SetKey, args[0], args[1]).Key())
 	if err != nil {
 		return err
 	}
@@ -95,13 +103,13 @@ func Sismember(args [][]byte, wb *levigo.WriteBatch) interface{} {
 	return 1
 }
 
-func Smembers(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Smembers(args [][]byte, wb *Batch) interface{} {
 	// use a snapshot so that the cardinality is consistent with the iterator
 	snapshot := DB.NewSnapshot()
 	opts := levigo.NewReadOptions()
 	opts.SetSnapshot(snapshot)
 
-	card, err := scard(metaKey(args[0]), opts)
+	card, err := scard(metaKey(args[0]), opts, wb)
 	if err != nil {
 		return err
 		DB.ReleaseSnapshot(snapshot)
@@ -117,7 +125,7 @@ func Smembers(args [][]byte, wb *levigo.WriteBatch) interface{} {
 	stream := &cmdReplyStream{int64(card), make(chan interface{})}
 	go func() {
 		defer close(stream.items)
-		it := DB.NewIterator(opts)
+		it := wb.NewIterator(opts)
 		defer it.Close()
 		iterKey := NewKeyBuffer(SetKey, args[0], 0)
 
@@ -136,9 +144,9 @@ func Smembers(args [][]byte, wb *levigo.WriteBatch) interface{} {
 	return stream
 }
 
-func Spop(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Spop(args [][]byte, wb *Batch) interface{} {
 	mk := metaKey(args[0])
-	card, err := scard(mk, nil)
+	card, err := scard(mk, nil, wb)
 	if err != nil {
 		return err
 	}
@@ -146,22 +154,27 @@ func Spop(args [][]byte, wb *levigo.WriteBatch) interface{} {
 		return nil
 	}
 	key := NewKeyBuffer(SetKey, args[0], 1)
-	member := srand(key)
+	member := srand(key, wb)
 	if member == nil {
 		return nil
 	}
 	key.SetSuffix(member)
 	wb.Delete(key.Key())
+	wb.Notify(notifySet, "spop", args[0])
 	if card == 1 { // we're removing the last remaining member
-		wb.Delete(mk)
+		err = delMetaKey(mk, wb)
+		if err != nil {
+			return err
+		}
+		wb.Notify(notifyGeneric, "del", args[0])
 	} else {
 		setCard(mk, card-1, wb)
 	}
 	return member
 }
 
-func Smove(args [][]byte, wb *levigo.WriteBatch) interface{} {
-	resp, err := DB.Get(DefaultReadOptions, NewKeyBufferWithSuffix(SetKey, args[0], args[2]).Key())
+func Smove(args [][]byte, wb *Batch) interface{} {
+	resp, err := wb.Get(DefaultReadOptions, NewKeyBufferWithSuffix(SetKey, args[0], args[2]).Key())
 	if err != nil {
 		return err
 	}
@@ -186,49 +199,62 @@ const (
 	setDiff
 )
 
-func Sunion(args [][]byte, wb *levigo.WriteBatch) interface{} {
-	return combineSet(args, setUnion, nil)
+// keyspace events for the *STORE commands
+var setStoreEvents = []string{"sunionstore", "sinterstore", "sdiffstore"}
+
+func Sunion(args [][]byte, wb *Batch) interface{} {
+	return combineSet(args, setUnion, false, wb)
 }
 
-func Sinter(args [][]byte, wb *levigo.WriteBatch) interface{} {
-	return combineSet(args, setInter, nil)
+func Sinter(args [][]byte, wb *Batch) interface{} {
+	return combineSet(args, setInter, false, wb)
 }
 
-func Sdiff(args [][]byte, wb *levigo.WriteBatch) interface{} {
-	return combineSet(args, setDiff, nil)
+func Sdiff(args [][]byte, wb *Batch) interface{} {
+	return combineSet(args, setDiff, false, wb)
 }
 
-func Sunionstore(args [][]byte, wb *levigo.WriteBatch) interface{} {
-	return combineSet(args, setUnion, wb)
+func Sunionstore(args [][]byte, wb *Batch) interface{} {
+	return combineSet(args, setUnion, true, wb)
 }
 
-func Sinterstore(args [][]byte, wb *levigo.WriteBatch) interface{} {
-	return combineSet(args, setInter, wb)
+func Sinterstore(args [][]byte, wb *Batch) interface{} {
+	return combineSet(args, setInter, true, wb)
 }
 
-func Sdiffstore(args [][]byte, wb *levigo.WriteBatch) interface{} {
-	return combineSet(args, setDiff, wb)
+func Sdiffstore(args [][]byte, wb *Batch) interface{} {
+	return combineSet(args, setDiff, true, wb)
 }
 
-func combineSet(keys [][]byte, op int, wb *levigo.WriteBatch) interface{} {
+func combineSet(keys [][]byte, op int, store bool, wb *Batch) interface{} {
 	var count uint32
 	res := []interface{}{}
 	members := make(chan *iterSetMember)
 	var storeKey *KeyBuffer
 	var mk []byte
+	var destKey []byte
+	var destDeleted bool
 
-	if wb != nil {
-		mk = metaKey(keys[0])
-		_, err := delKey(mk, wb)
+	if store {
+		destKey = keys[0]
+		mk = metaKey(destKey)
+		storeKey = NewKeyBuffer(SetKey, destKey, 0)
+		keys = keys[1:]
+	}
+
+	// the destination is deleted after the iterators are created, because it
+	// may also be one of the source keys
+	multiSetIter(keys, members, op != setUnion, wb)
+	if store {
+		var err error
+		destDeleted, err = delKey(mk, wb)
 		if err != nil {
+			for _ = range members {
+			}
 			return err
 		}
-		storeKey = NewKeyBuffer(SetKey, keys[0], 0)
-		keys = keys[1:]
 	}
 
-	go multiSetIter(keys, members, op != setUnion)
-
 combine:
 	for m := range members {
 		switch op {
@@ -245,7 +271,7 @@ combine:
 				}
 			}
 		}
-		if wb != nil {
+		if store {
 			storeKey.SetSuffix(m.member)
 			wb.Put(storeKey.Key(), []byte{})
 			count++
@@ -254,9 +280,12 @@ combine:
 		}
 	}
 
-	if wb != nil {
+	if store {
 		if count > 0 {
 			setCard(mk, count, wb)
+			wb.Notify(notifySet, setStoreEvents[op], destKey)
+		} else if destDeleted {
+			wb.Notify(notifyGeneric, "del", destKey)
 		}
 		return count
 	}
@@ -288,86 +317,92 @@ func (m setMembers) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
 // The member list is then checked for any other keys that have the same member.
 // The first member is sent to out, and all keys that had that member are iterated
 // forward. This is repeated until all keys have run out of members.
-func multiSetIter(keys [][]byte, out chan<- *iterSetMember, stopEarly bool) {
-	defer close(out)
+func multiSetIter(keys [][]byte, out chan<- *iterSetMember, stopEarly bool, wb *Batch) {
 	// Set up a snapshot so that we have a consistent view of the data
 	snapshot := DB.NewSnapshot()
 	opts := levigo.NewReadOptions()
-	defer opts.Close()
 	opts.SetSnapshot(snapshot)
-	defer DB.ReleaseSnapshot(snapshot)
 
 	members := make(setMembers, len(keys)) // a list of the current member for each key iterator
 	iterKeys := make([]*KeyBuffer, len(keys))
-	iterators := make([]*levigo.Iterator, len(keys))
+	iterators := make([]*Iterator, len(keys))
 	for i, k := range keys {
 		iterKeys[i] = NewKeyBuffer(SetKey, k, 0)
-		it := DB.NewIterator(opts)
-		defer it.Close()
-		it.Seek(iterKeys[i].Key())
-		iterators[i] = it
+		iterators[i] = wb.NewIterator(opts)
+		iterators[i].Seek(iterKeys[i].Key())
 	}
 
-	getMember := func(i int) []byte {
-		// If the iterator is done, we remove the iterator and ignore it in future runs
-		if iterators[i] == nil || !iterators[i].Valid() {
-			iterators[i] = nil
-			return nil
-		}
-		k := iterators[i].Key()
-		if !iterKeys[i].IsPrefixOf(k) {
-			iterators[i] = nil
-			return nil
+	// The iterators are created before the members are sent, so that the
+	// caller can write to the keys without changing the members
+	go func() {
+		defer close(out)
+		defer DB.ReleaseSnapshot(snapshot)
+		defer opts.Close()
+		for _, it := range iterators {
+			defer it.Close()
 		}
-		// Strip the key prefix from the key and return the member
-		return k[len(iterKeys[i].Key()):]
-	}
 
-	// Initialize the members list
-	for i := 0; i < len(members); i++ {
-		members[i] = &setMember{getMember(i), i}
-	}
+		getMember := func(i int) []byte {
+			// If the iterator is done, we remove the iterator and ignore it in future runs
+			if iterators[i] == nil || !iterators[i].Valid() {
+				iterators[i] = nil
+				return nil
+			}
+			k := iterators[i].Key()
+			if !iterKeys[i].IsPrefixOf(k) {
+				iterators[i] = nil
+				return nil
+			}
+			// Strip the key prefix from the key and return the member
+			return k[len(iterKeys[i].Key()):]
+		}
 
-	// This loop runs until we run out of keys
-iter:
-	for {
-		im := &iterSetMember{exists: make([]bool, len(members))}
-		first := true
-		sort.Sort(members)
+		// Initialize the members list
+		for i := 0; i < len(members); i++ {
+			members[i] = &setMember{getMember(i), i}
+		}
 
-		for _, m := range members {
-			// The member will be nil if the key it is from has no more members
-			if m.member == nil {
-				if m.key == 0 && stopEarly {
-					break iter
+		// This loop runs until we run out of keys
+	iter:
+		for {
+			im := &iterSetMember{exists: make([]bool, len(members))}
+			first := true
+			sort.Sort(members)
+
+			for _, m := range members {
+				// The member will be nil if the key it is from has no more members
+				if m.member == nil {
+					if m.key == 0 && stopEarly {
+						break iter
+					}
+					continue
+				}
+				// The first member is the one that we will send out on this iteration
+				if first {
+					im.member = m.member
+					first = false
+				}
+				if first || bytes.Compare(im.member, m.member) == 0 {
+					im.exists[m.key] = true
+					iterators[m.key].Next()
+					m.member = getMember(m.key)
+				} else {
+					// If the member isn't first or the same as the one we are
+					// looking for, it's not in the list
+					break
 				}
-				continue
-			}
-			// The first member is the one that we will send out on this iteration
-			if first {
-				im.member = m.member
-				first = false
 			}
-			if first || bytes.Compare(im.member, m.member) == 0 {
-				im.exists[m.key] = true
-				iterators[m.key].Next()
-				m.member = getMember(m.key)
-			} else {
-				// If the member isn't first or the same as the one we are
-				// looking for, it's not in the list
+			// When the result member is nil, there are no members left in any of the sets
+			if im.member == nil {
 				break
 			}
+			out <- im
 		}
-		// When the result member is nil, there are no members left in any of the sets
-		if im.member == nil {
-			break
-		}
-		out <- im
-	}
+	}()
 }
 
-func DelSet(key []byte, wb *levigo.WriteBatch) {
-	it := DB.NewIterator(ReadWithoutCacheFill)
+func DelSet(key []byte, wb *Batch) {
+	it := wb.NewIterator(ReadWithoutCacheFill)
 	defer it.Close()
 	iterKey := NewKeyBuffer(SetKey, key, 0)
 	for it.Seek(iterKey.Key()); it.Valid(); it.Next() {
@@ -381,11 +416,11 @@ func DelSet(key []byte, wb *levigo.WriteBatch) {
 	}
 }
 
-func scard(key []byte, opts *levigo.ReadOptions) (uint32, error) {
+func scard(key []byte, opts *levigo.ReadOptions, wb *Batch) (uint32, error) {
 	if opts == nil {
 		opts = DefaultReadOptions
 	}
-	res, err := DB.Get(opts, key)
+	res, err := wb.Get(opts, key)
 	if err != nil {
 		return 0, err
 	}
@@ -401,8 +436,8 @@ func scard(key []byte, opts *levigo.ReadOptions) (uint32, error) {
 	return binary.BigEndian.Uint32(res[1:]), nil
 }
 
-func srand(key *KeyBuffer) []byte {
-	it := DB.NewIterator(DefaultReadOptions)
+func srand(key *KeyBuffer, wb *Batch) []byte {
+	it := wb.NewIterator(DefaultReadOptions)
 	defer it.Close()
 	rand.Read(key.SuffixForRead(1))
 	it.Seek(key.Key())
@@ -422,7 +457,7 @@ func srand(key *KeyBuffer) []byte {
 	return parseMemberFromSetKey(k)
 }
 
-func setCard(key []byte, card uint32, wb *levigo.WriteBatch) {
+func setCard(key []byte, card uint32, wb *Batch) {
 	data := make([]byte, 5)
 	data[0] = SetCardValue
 	binary.BigEndian.PutUint32(data[1:], card)
@@ -430,8 +465,8 @@ func setCard(key []byte, card uint32, wb *levigo.WriteBatch) {
 }
 
 func parseMemberFromSetKey(key []byte) []byte {
-	keyLen := binary.BigEndian.Uint32(key[1:])
-	return key[5+int(keyLen):]
+	keyLen := binary.BigEndian.Uint32(key[1+dbPrefixSize:])
+	return key[keyPrefixSize+int(keyLen):]
 }
 
 // SRANDMEMBER
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Shutdown
+//
+// SHUTDOWN, SIGTERM and SIGINT stop the server cleanly: the listener is closed,
+// the clients finish the commands they are running and are disconnected once
+// their replies have been written, the background work stops, and the writes
+// are synced before LevelDB is closed.
+//
+// SHUTDOWN NOSAVE only skips that last sync to exit sooner. Every write that was
+// replied to is already in LevelDB's log and is read back after a restart, but
+// with appendfsync everysec or no the writes since the last sync can be lost if
+// the machine crashes before the OS writes them to disk. With appendfsync
+// always NOSAVE is the same as SAVE.
+//
+// A second signal exits immediately.
+
+// how long the clients have to finish their commands and read their replies
+const shutdownTimeout = 10 * time.Second
+
+var ShuttingDownError = fmt.Errorf("the server is shutting down")
+
+var (
+	shuttingDown = make(chan struct{}) // closed when the server starts shutting down
+	shutdownDone = make(chan struct{}) // closed when the database has been closed
+	shutdownOnce sync.Once
+
+	// held for reading by the goroutines that use the database outside of
+	// commands, and for writing once the database is being closed
+	dbClose = &sync.RWMutex{}
+
+	activeClients sync.WaitGroup // clients that haven't been disconnected
+)
+
+func isShuttingDown() bool {
+	select {
+	case <-shuttingDown:
+		return true
+	default:
+		return false
+	}
+}
+
+func handleSignals() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			log.Println("Received hangup, reloading the TLS certificates")
+			if err := reloadTLSConfig(); err != nil {
+				log.Printf("Error reloading the TLS certificates, the old ones are still used: %s", err)
+			}
+		}
+	}()
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		log.Printf("Received %s", <-signals)
+		go shutdown(true)
+		log.Printf("Received %s while shutting down, exiting now", <-signals)
+		os.Exit(1)
+	}()
+}
+
+// run by SHUTDOWN, the tests replace it to check the command without stopping
+// the server
+var shutdownCommand = shutdown
+
+// Shutdown the server, syncing the writes if save is set. Returns once the
+// database has been closed.
+func shutdown(save bool) {
+	shutdownOnce.Do(func() {
+		log.Println("Shutting down")
+		close(shuttingDown)
+
+		// interrupt the clients that are waiting for commands, the commands that
+		// are running are finished
+		clientsMtx.RLock()
+		for _, c := range clients {
+			c.cn.SetReadDeadline(time.Now())
+		}
+		clientsMtx.RUnlock()
+		disconnected := make(chan struct{})
+		go func() {
+			activeClients.Wait()
+			close(disconnected)
+		}()
+		select {
+		case <-disconnected:
+		case <-time.After(shutdownTimeout):
+			log.Println("Timed out waiting for the clients to disconnect")
+		}
+
+		// stop the background work and the commands that are still running
+		dbClose.Lock()
+		dbBarrier.Lock()
+		if err := closeWrites(save); err != nil {
+			log.Printf("Error closing the database: %s", err)
+		}
+		log.Println("SetDB is now ready to exit, bye bye")
+		close(shutdownDone)
+	})
+	<-shutdownDone
+}
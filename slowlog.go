@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/titanous/bconv"
+)
+
+// Slow log
+//
+// Commands that run for longer than slowlog-log-slower-than microseconds are
+// kept in memory, up to the newest slowlog-max-len of them. The time only
+// includes running the command, not reading the request or writing the reply.
+// The passwords given to AUTH, ACL SETUSER and CONFIG SET requirepass are
+// replaced with (redacted).
+
+const (
+	slowlogMaxArgs   = 32  // the number of arguments that are kept
+	slowlogMaxArgLen = 128 // the number of bytes of each argument that are kept
+)
+
+// replaces passwords in the slow log and CONFIG GET
+var redacted = []byte("(redacted)")
+
+type slowlogEntry struct {
+	id       int64
+	time     int64 // unix time in seconds
+	duration int64 // microseconds
+	args     [][]byte
+}
+
+var slowlog = struct {
+	sync.Mutex
+	entries []slowlogEntry // oldest first
+	nextID  int64
+}{}
+
+// add the command to the slow log if it took too long
+func logSlowCommand(name string, args [][]byte, start time.Time) {
+	threshold := atomic.LoadInt64(&config.slowlogSlowerThan)
+	duration := int64(time.Since(start) / time.Microsecond)
+	if threshold < 0 || duration < threshold {
+		return
+	}
+
+	entry := slowlogEntry{time: start.Unix(), duration: duration}
+	entry.args = append(entry.args, []byte(name))
+	for i, arg := range redactArgs(name, args) {
+		if i == slowlogMaxArgs-1 {
+			entry.args = append(entry.args, []byte(fmt.Sprintf("... (%d more arguments)", len(args)-i)))
+			break
+		}
+		if len(arg) > slowlogMaxArgLen {
+			arg = []byte(fmt.Sprintf("%s... (%d more bytes)", arg[:slowlogMaxArgLen], len(arg)-slowlogMaxArgLen))
+		}
+		entry.args = append(entry.args, append([]byte{}, arg...))
+	}
+
+	slowlog.Lock()
+	defer slowlog.Unlock()
+	entry.id = slowlog.nextID
+	slowlog.nextID++
+	slowlog.entries = append(slowlog.entries, entry)
+	trimSlowlog()
+}
+
+// args with the passwords in them replaced, args isn't modified
+func redactArgs(name string, args [][]byte) [][]byte {
+	secret := func(i int) bool { return false }
+	switch {
+	case name == "auth":
+		secret = func(i int) bool { return true }
+	case name == "acl" && len(args) > 2 && EqualIgnoreCase(args[0], []byte("setuser")):
+		secret = func(i int) bool {
+			return i > 1 && len(args[i]) > 0 && strings.IndexByte("><#!", args[i][0]) >= 0
+		}
+	case name == "config" && len(args) == 3 && EqualIgnoreCase(args[0], []byte("set")):
+		o := findConfigOption(strings.ToLower(string(args[1])))
+		secret = func(i int) bool { return i == 2 && o != nil && o.secret }
+	}
+	var res [][]byte
+	for i := range args {
+		if secret(i) {
+			if res == nil {
+				res = append([][]byte{}, args...)
+			}
+			res[i] = redacted
+		}
+	}
+	if res == nil {
+		return args
+	}
+	return res
+}
+
+// remove the oldest entries over slowlog-max-len, slowlog must be locked
+func trimSlowlog() {
+	max := int(atomic.LoadInt64(&config.slowlogMaxLen))
+	if n := len(slowlog.entries); n > max {
+		slowlog.entries = append(slowlog.entries[:0], slowlog.entries[n-max:]...)
+	}
+}
+
+func Slowlog(args [][]byte, wb *Batch) interface{} {
+	slowlog.Lock()
+	defer slowlog.Unlock()
+	// slowlog-max-len may have been lowered
+	trimSlowlog()
+	switch {
+	case EqualIgnoreCase(args[0], []byte("get")) && len(args) <= 2:
+		count := int64(10)
+		if len(args) == 2 {
+			var err error
+			count, err = bconv.ParseInt(args[1], 10, 64)
+			if err != nil {
+				return InvalidIntError
+			}
+		}
+		// newest first
+		res := []interface{}{}
+		for i := len(slowlog.entries) - 1; i >= 0 && int64(len(res)) != count; i-- {
+			e := slowlog.entries[i]
+			cmd := make([]interface{}, len(e.args))
+			for j, arg := range e.args {
+				cmd[j] = arg
+			}
+			res = append(res, []interface{}{e.id, e.time, e.duration, cmd})
+		}
+		return res
+	case EqualIgnoreCase(args[0], []byte("len")) && len(args) == 1:
+		return len(slowlog.entries)
+	case EqualIgnoreCase(args[0], []byte("reset")) && len(args) == 1:
+		slowlog.entries = nil
+		return ReplyOK
+	}
+	return fmt.Errorf("Unknown SLOWLOG subcommand or wrong number of arguments for '%s'", args[0])
+}
@@ -2,8 +2,6 @@ package main
 
 import (
 	"encoding/binary"
-
-	"github.com/jmhodges/levigo"
 )
 
 // Keys stored in LevelDB for strings
@@ -13,27 +11,33 @@ import (
 // For each key:
 // StringKey | key = value
 
-func Set(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Set(args [][]byte, wb *Batch) interface{} {
 	err := set(args[0], args[1], wb)
 	if err != nil {
 		return err
 	}
+	// SET discards any existing expiry
+	err = delExpire(args[0], wb)
+	if err != nil {
+		return err
+	}
+	wb.Notify(notifyString, "set", args[0])
 	return ReplyOK
 }
 
-func Get(args [][]byte, wb *levigo.WriteBatch) interface{} {
-	res, err := DB.Get(DefaultReadOptions, stringKey(args[0]))
+func Get(args [][]byte, wb *Batch) interface{} {
+	res, err := wb.Get(DefaultReadOptions, stringKey(args[0]))
 	if err != nil {
 		return err
 	}
 	return res
 }
 
-func DelString(key []byte, wb *levigo.WriteBatch) {
+func DelString(key []byte, wb *Batch) {
 	wb.Delete(stringKey(key))
 }
 
-func setStringLen(key []byte, length int, wb *levigo.WriteBatch) {
+func setStringLen(key []byte, length int, wb *Batch) {
 	meta := make([]byte, 5)
 	meta[0] = StringLengthValue
 	binary.BigEndian.PutUint32(meta[1:], uint32(length))
@@ -41,16 +45,12 @@ func setStringLen(key []byte, length int, wb *levigo.WriteBatch) {
 }
 
 func stringKey(k []byte) []byte {
-	key := make([]byte, 5+len(k))
-	key[0] = StringKey
-	binary.BigEndian.PutUint32(key[1:], uint32(len(k)))
-	copy(key[5:], k)
-	return key
+	return NewKeyBuffer(StringKey, k, 0).Key()
 }
 
-func set(k []byte, v []byte, wb *levigo.WriteBatch) error {
+func set(k []byte, v []byte, wb *Batch) error {
 	mk := metaKey(k)
-	res, err := DB.Get(DefaultReadOptions, mk)
+	res, err := wb.Get(DefaultReadOptions, mk)
 	if err != nil {
 		return err
 	}
@@ -67,11 +67,11 @@ func set(k []byte, v []byte, wb *levigo.WriteBatch) error {
 }
 
 // APPEND
-func Append(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Append(args [][]byte, wb *Batch) interface{} {
 	k := args[0]
 	appendVal := args[1]
 
-	res, err := DB.Get(DefaultReadOptions, stringKey(k))
+	res, err := wb.Get(DefaultReadOptions, stringKey(k))
 	if err != nil {
 		return err
 	}
@@ -80,6 +80,7 @@ func Append(args [][]byte, wb *levigo.WriteBatch) interface{} {
 	if err != nil {
 		return err
 	}
+	wb.Notify(notifyString, "append", k)
 
 	return len(concat)
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+// TLS
+//
+// With tls-port, clients can connect with TLS on that port alongside the plain
+// port, which can be disabled with port 0. The server's certificate and key are
+// read from tls-cert-file and tls-key-file, and the certificates of the clients
+// are verified with the CAs in tls-ca-cert-file. tls-auth-clients decides if
+// the clients need a certificate: yes, optional or no.
+//
+// With tls-auth-clients-user CN, a client with a verified certificate is
+// authenticated as the ACL user named by the certificate's Common Name, if the
+// user exists and is enabled, without AUTH.
+//
+// SIGHUP reloads the files. New connections use the new certificates, and the
+// clients that are connected keep their sessions.
+
+// how long a client has to finish the TLS handshake
+const tlsHandshakeTimeout = 10 * time.Second
+
+var (
+	tlsConfig    *tls.Config // replaced when the certificates are reloaded
+	tlsConfigMtx = &sync.RWMutex{}
+)
+
+// Read the certificate, key and CA files and use them for new connections
+func loadTLSConfig() error {
+	cert, err := tls.LoadX509KeyPair(config.tlsCertFile, config.tlsKeyFile)
+	if err != nil {
+		return err
+	}
+	c := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	switch config.tlsAuthClients {
+	case "yes":
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if config.tlsCACertFile != "" {
+		pem, err := ioutil.ReadFile(config.tlsCACertFile)
+		if err != nil {
+			return err
+		}
+		c.ClientCAs = x509.NewCertPool()
+		if !c.ClientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", config.tlsCACertFile)
+		}
+	}
+	tlsConfigMtx.Lock()
+	tlsConfig = c
+	tlsConfigMtx.Unlock()
+	return nil
+}
+
+// reload the TLS files after a SIGHUP
+func reloadTLSConfig() error {
+	if config.tlsPort == 0 {
+		return nil
+	}
+	return loadTLSConfig()
+}
+
+// Wrap l so that its connections use the current TLS config
+func newTLSListener(l net.Listener) net.Listener {
+	return tls.NewListener(l, &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			tlsConfigMtx.RLock()
+			defer tlsConfigMtx.RUnlock()
+			return tlsConfig, nil
+		},
+	})
+}
+
+// Finish the handshake of a TLS client, returns the ACL user that the client's
+// certificate authenticates it as, or an empty string.
+func tlsHandshake(cn *tls.Conn) (string, error) {
+	cn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := cn.Handshake(); err != nil {
+		return "", err
+	}
+	cn.SetDeadline(time.Time{})
+	state := cn.ConnectionState()
+	if config.tlsAuthClientsUser != "cn" || len(state.VerifiedChains) == 0 {
+		return "", nil
+	}
+	name := state.PeerCertificates[0].Subject.CommonName
+	if u := getACLUser(name); u != nil && u.enabled {
+		return name, nil
+	}
+	return "", nil
+}
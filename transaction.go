@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Transactions
+//
+// MULTI starts queuing the client's commands instead of running them, and a
+// queued SELECT changes the database of the commands queued after it. EXEC runs
+// all of the queued commands while holding the locks for the union of their
+// keys, and commits all of their writes with a single WriteBatch. Each command
+// runs against an overlay of the writes made by the commands before it, so
+// reads inside the transaction see the earlier writes.
+//
+// WATCH records the version of keys, and EXEC aborts without running any of the
+// commands if one of the watched keys has been modified by another client since
+// it was watched. The versions are only tracked for keys that are being watched.
+
+var ReplyEXECABORT = rawReply("-EXECABORT Transaction discarded because of previous errors.\r\n")
+
+// Transaction commands change the state of the client, so they are handled by
+// the client instead of the command table. -n arity means >= n
+var transactionCommands = map[string]int{
+	"multi":   0,
+	"exec":    0,
+	"discard": 0,
+	"watch":   -1,
+	"unwatch": 0,
+}
+
+// handles the transaction commands for the client
+func (c *client) transaction(name string, args [][]byte) interface{} {
+	switch name {
+	case "watch":
+		if c.multi {
+			return fmt.Errorf("WATCH inside MULTI is not allowed")
+		}
+		// the databases can't be swapped or flushed before the keys are watched
+		dbBarrier.RLock()
+		c.watch(c.dbKeys(args))
+		dbBarrier.RUnlock()
+		return ReplyOK
+	case "unwatch":
+		if c.multi {
+			c.queued = append(c.queued, [][]byte{[]byte(name)})
+			return ReplyQUEUED
+		}
+		c.unwatch()
+		return ReplyOK
+	case "multi":
+		if c.multi {
+			return fmt.Errorf("MULTI calls can not be nested")
+		}
+		c.multi = true
+		return ReplyOK
+	case "discard":
+		if !c.multi {
+			return fmt.Errorf("DISCARD without MULTI")
+		}
+		c.resetTransaction()
+		return ReplyOK
+	}
+
+	if !c.multi {
+		return fmt.Errorf("EXEC without MULTI")
+	}
+	defer c.resetTransaction()
+	// if a command was rejected while queuing, none of the commands are run
+	if c.multiError {
+		return ReplyEXECABORT
+	}
+	return execTransaction(c.queued, c)
+}
+
+// UNWATCH is only run from the command table when it was queued by MULTI, where
+// it does nothing since EXEC unwatches the keys
+func Unwatch(args [][]byte, wb *Batch) interface{} {
+	return ReplyOK
+}
+
+func (c *client) resetTransaction() {
+	c.multi = false
+	c.multiError = false
+	c.queued = nil
+	c.unwatch()
+}
+
+// Run the queued commands (including the command name) atomically and return
+// a multi-bulk reply with the result of each command, or a nil multi-bulk reply
+// if any of the keys watched by c were modified.
+func execTransaction(queued [][][]byte, c *client) interface{} {
+	dbBarrier.RLock()
+	defer dbBarrier.RUnlock()
+
+	cmds := make([]cmdDesc, len(queued))
+	cmdArgs := make([][][]byte, len(queued))
+	var keys, writtenKeys [][]byte
+	writes := false
+	db := c.db
+	for i, args := range queued {
+		name := UnsafeBytesToString(bytes.ToLower(args[0]))
+		// SELECT changes the database of the commands after it, its index was
+		// checked when it was queued
+		if name == "select" {
+			db, _ = parseDBIndex(args[1])
+			cmds[i].name = name
+			continue
+		}
+		cmds[i] = commands[name]
+		cmdArgs[i] = argsInDB(db, &cmds[i], args[1:])
+		cmdKeys := cmds[i].getKeys(cmdArgs[i])
+		keys = append(keys, cmdKeys...)
+		if cmds[i].writes {
+			writtenKeys = append(writtenKeys, cmdKeys...)
+			writes = true
+		}
+	}
+
+	// delete any keys that have expired before the commands see them
+	if err := expireKeys(keys); err != nil {
+		return fmt.Errorf("data write error: %s", err)
+	}
+
+	// the watched keys are locked as well so that they can't be modified
+	// between checking their versions and committing the transaction
+	for k := range c.watched {
+		keys = append(keys, []byte(k))
+	}
+
+	if writes {
+		KeyMutex.LockMany(keys)
+		defer KeyMutex.UnlockMany(keys)
+	} else {
+		KeyMutex.RLockMany(keys)
+		defer KeyMutex.RUnlockMany(keys)
+	}
+
+	if c.watchedKeysModified() {
+		return []interface{}(nil)
+	}
+
+	tx := newOverlayBatch(nil)
+	replies := make([]interface{}, len(queued))
+	for i, args := range queued {
+		start := time.Now()
+		if cmds[i].name == "select" {
+			recordCommand(cmds[i].name, args[1:], start)
+			replies[i] = ReplyOK
+			continue
+		}
+		// each command gets its own overlay so that the writes of a command
+		// that returns an error can be discarded
+		wb := newOverlayBatch(tx)
+		res := cmds[i].function(cmdArgs[i], wb)
+		recordCommand(cmds[i].name, args[1:], start)
+		// streams are read while the keys are still locked
+		if stream, ok := res.(*cmdReplyStream); ok {
+			items := make([]interface{}, 0, stream.size)
+			for item := range stream.items {
+				items = append(items, item)
+			}
+			res = items
+		}
+		if _, ok := res.(error); !ok {
+			wb.Write()
+		}
+		replies[i] = res
+	}
+
+	if err := tx.Write(); err != nil {
+		return fmt.Errorf("data write error: %s", err)
+	}
+	touchKeys(writtenKeys, c)
+	// the client stays in the database of the last SELECT
+	if db != c.db {
+		c.infoMtx.Lock()
+		c.db = db
+		c.infoMtx.Unlock()
+	}
+	return replies
+}
+
+// Increment the version of the watched keys in the databases with ids, after
+// the keys of the databases were swapped or flushed.
+func touchDatabases(ids []uint16) {
+	watchedKeysMtx.Lock()
+	defer watchedKeysMtx.Unlock()
+	for k, v := range watchedKeys {
+		id := keyDB([]byte(k))
+		for _, changed := range ids {
+			if id == changed {
+				v.version++
+				break
+			}
+		}
+	}
+}
+
+type keyVersion struct {
+	version  uint64 // incremented every time the key is modified
+	watchers int    // the number of clients watching the key
+}
+
+var (
+	watchedKeys    = make(map[string]*keyVersion) // key -> version
+	watchedKeysMtx = &sync.Mutex{}
+)
+
+func (c *client) watch(keys [][]byte) {
+	watchedKeysMtx.Lock()
+	defer watchedKeysMtx.Unlock()
+	if c.watched == nil {
+		c.watched = make(map[string]uint64)
+	}
+	for _, k := range keys {
+		if _, ok := c.watched[string(k)]; ok {
+			continue
+		}
+		v, ok := watchedKeys[string(k)]
+		if !ok {
+			v = &keyVersion{}
+			watchedKeys[string(k)] = v
+		}
+		v.watchers++
+		c.watched[string(k)] = v.version
+	}
+}
+
+func (c *client) unwatch() {
+	watchedKeysMtx.Lock()
+	defer watchedKeysMtx.Unlock()
+	for k := range c.watched {
+		v := watchedKeys[k]
+		v.watchers--
+		if v.watchers == 0 {
+			delete(watchedKeys, k)
+		}
+	}
+	c.watched = nil
+}
+
+// returns true if any of the keys watched by the client have been modified
+func (c *client) watchedKeysModified() bool {
+	watchedKeysMtx.Lock()
+	defer watchedKeysMtx.Unlock()
+	for k, version := range c.watched {
+		if watchedKeys[k].version != version {
+			return true
+		}
+	}
+	return false
+}
+
+// Increment the version of any of the keys that are being watched. This must be
+// called after the write is committed, before the keys are unlocked.
+// c is the client that modified the keys (nil if it wasn't a client), it keeps
+// the new versions of keys that it is watching since only modifications made by
+// other clients abort its transaction.
+func touchKeys(keys [][]byte, c *client) {
+	watchedKeysMtx.Lock()
+	defer watchedKeysMtx.Unlock()
+	if len(watchedKeys) == 0 {
+		return
+	}
+	for _, k := range keys {
+		v, ok := watchedKeys[string(k)]
+		if !ok {
+			continue
+		}
+		v.version++
+		if c == nil {
+			continue
+		}
+		if version, ok := c.watched[string(k)]; ok && version == v.version-1 {
+			c.watched[string(k)] = v.version
+		}
+	}
+}
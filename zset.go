@@ -20,26 +20,27 @@ import (
 // ZSetKey   | key length uint32 | key | member = score float64
 // ZScoreKey | key length uint32 | key | score float64 | member = empty
 
-func Zadd(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Zadd(args [][]byte, wb *Batch) interface{} {
 	if (len(args)-1)%2 != 0 {
 		return fmt.Errorf("wrong number of arguments for 'zadd' command")
 	}
 	return zadd(args, wb, false)
 }
 
-func Zincrby(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Zincrby(args [][]byte, wb *Batch) interface{} {
 	return zadd(args, wb, true)
 }
 
-func zadd(args [][]byte, wb *levigo.WriteBatch, incr bool) interface{} {
+func zadd(args [][]byte, wb *Batch, incr bool) interface{} {
 	var newMembers uint32
+	var changed bool
 	var score float64
 	scoreBytes := make([]byte, 8)
 	setKey := NewKeyBuffer(ZSetKey, args[0], len(args[2]))
 	scoreKey := NewKeyBuffer(ZScoreKey, args[0], 8+len(args[2]))
 
 	mk := metaKey(args[0])
-	card, err := zcard(mk, nil)
+	card, err := zcard(mk, nil, wb)
 	if err != nil {
 		return err
 	}
@@ -56,7 +57,7 @@ func zadd(args [][]byte, wb *levigo.WriteBatch, incr bool) interface{} {
 		setKey.SetSuffix(args[i+1])
 		var res []byte
 		if card > 0 {
-			res, err = DB.Get(DefaultReadOptions, setKey.Key())
+			res, err = wb.Get(DefaultReadOptions, setKey.Key())
 			if err != nil {
 				return err
 			}
@@ -88,6 +89,7 @@ func zadd(args [][]byte, wb *levigo.WriteBatch, incr bool) interface{} {
 		setZScoreKeyScore(scoreKey, score)
 		wb.Put(setKey.Key(), scoreBytes)
 		wb.Put(scoreKey.Key(), []byte{}) // The score key is only used for sorting, the value is empty
+		changed = true
 	}
 
 	// Update the set metadata with the new cardinality
@@ -95,14 +97,20 @@ func zadd(args [][]byte, wb *levigo.WriteBatch, incr bool) interface{} {
 		setZcard(mk, card+newMembers, wb)
 	}
 
+	if changed && incr {
+		wb.Notify(notifyZset, "zincr", args[0])
+	} else if changed {
+		wb.Notify(notifyZset, "zadd", args[0])
+	}
+
 	if incr { // This is a ZINCRBY, return the new score
 		return ftoa(score)
 	}
 	return newMembers
 }
 
-func Zscore(args [][]byte, wb *levigo.WriteBatch) interface{} {
-	res, err := DB.Get(DefaultReadOptions, NewKeyBufferWithSuffix(ZSetKey, args[0], args[1]).Key())
+func Zscore(args [][]byte, wb *Batch) interface{} {
+	res, err := wb.Get(DefaultReadOptions, NewKeyBufferWithSuffix(ZSetKey, args[0], args[1]).Key())
 	if err != nil {
 		return err
 	}
@@ -116,19 +124,19 @@ func Zscore(args [][]byte, wb *levigo.WriteBatch) interface{} {
 	return ftoa(btof(res))
 }
 
-func Zcard(args [][]byte, wb *levigo.WriteBatch) interface{} {
-	c, err := zcard(metaKey(args[0]), nil)
+func Zcard(args [][]byte, wb *Batch) interface{} {
+	c, err := zcard(metaKey(args[0]), nil, wb)
 	if err != nil {
 		return err
 	}
 	return c
 }
 
-func zcard(key []byte, opts *levigo.ReadOptions) (uint32, error) {
+func zcard(key []byte, opts *levigo.ReadOptions, wb *Batch) (uint32, error) {
 	if opts == nil {
 		opts = DefaultReadOptions
 	}
-	res, err := DB.Get(opts, key)
+	res, err := wb.Get(opts, key)
 	if err != nil {
 		return 0, err
 	}
@@ -144,9 +152,9 @@ func zcard(key []byte, opts *levigo.ReadOptions) (uint32, error) {
 	return binary.BigEndian.Uint32(res[1:]), nil
 }
 
-func Zrem(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Zrem(args [][]byte, wb *Batch) interface{} {
 	mk := metaKey(args[0])
-	card, err := zcard(mk, nil)
+	card, err := zcard(mk, nil, wb)
 	if err != nil {
 		return err
 	}
@@ -160,7 +168,7 @@ func Zrem(args [][]byte, wb *levigo.WriteBatch) interface{} {
 	// Delete each of the members
 	for _, member := range args[1:] {
 		setKey.SetSuffix(member)
-		res, err := DB.Get(ReadWithoutCacheFill, setKey.Key())
+		res, err := wb.Get(ReadWithoutCacheFill, setKey.Key())
 		if err != nil {
 			return nil
 		}
@@ -178,8 +186,15 @@ func Zrem(args [][]byte, wb *levigo.WriteBatch) interface{} {
 		wb.Delete(scoreKey.Key())
 		deleted++
 	}
+	if deleted > 0 {
+		wb.Notify(notifyZset, "zrem", args[0])
+	}
 	if deleted == card { // We deleted all of the members, so delete the meta key
-		wb.Delete(mk)
+		err = delMetaKey(mk, wb)
+		if err != nil {
+			return err
+		}
+		wb.Notify(notifyGeneric, "del", args[0])
 	} else if deleted > 0 { // Decrement the cardinality
 		setZcard(mk, card-deleted, wb)
 	}
@@ -187,11 +202,11 @@ func Zrem(args [][]byte, wb *levigo.WriteBatch) interface{} {
 	return deleted
 }
 
-func Zunionstore(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Zunionstore(args [][]byte, wb *Batch) interface{} {
 	return combineZset(args, zsetUnion, wb)
 }
 
-func Zinterstore(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Zinterstore(args [][]byte, wb *Batch) interface{} {
 	return combineZset(args, zsetInter, wb)
 }
 
@@ -200,13 +215,16 @@ const (
 	zsetInter
 )
 
+// keyspace events for the *STORE commands
+var zsetStoreEvents = []string{"zunionstore", "zinterstore"}
+
 const (
 	zsetAggSum int = iota
 	zsetAggMin
 	zsetAggMax
 )
 
-func combineZset(args [][]byte, op int, wb *levigo.WriteBatch) interface{} {
+func combineZset(args [][]byte, op int, wb *Batch) interface{} {
 	var count uint32
 	res := []interface{}{}
 	members := make(chan *iterZsetMember)
@@ -215,10 +233,6 @@ func combineZset(args [][]byte, op int, wb *levigo.WriteBatch) interface{} {
 	mk := metaKey(args[0])
 
 	if wb != nil {
-		_, err := delKey(mk, wb)
-		if err != nil {
-			return err
-		}
 		setKey = NewKeyBuffer(ZSetKey, args[0], 0)
 		scoreKey = NewKeyBuffer(ZScoreKey, args[0], 0)
 	}
@@ -269,7 +283,18 @@ func combineZset(args [][]byte, op int, wb *levigo.WriteBatch) interface{} {
 		}
 	}
 
-	go multiZsetIter(args[2:numKeys+2], members, op != zsetUnion)
+	// the destination is deleted after the iterators are created, because it
+	// may also be one of the source keys
+	multiZsetIter(args[2:numKeys+2], members, op != zsetUnion, wb)
+	var destDeleted bool
+	if wb != nil {
+		destDeleted, err = delKey(mk, wb)
+		if err != nil {
+			for _ = range members {
+			}
+			return err
+		}
+	}
 
 combine:
 	for m := range members {
@@ -320,6 +345,9 @@ combine:
 	if wb != nil {
 		if count > 0 {
 			setZcard(mk, count, wb)
+			wb.Notify(notifyZset, zsetStoreEvents[op], args[0])
+		} else if destDeleted {
+			wb.Notify(notifyGeneric, "del", args[0])
 		}
 		return count
 	}
@@ -346,114 +374,117 @@ func (m zsetMembers) Less(i, j int) bool { return bytes.Compare(m[i].member, m[j
 func (m zsetMembers) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
 
 // See set.go's multiSetIter() for details on how this works
-func multiZsetIter(keys [][]byte, out chan<- *iterZsetMember, stopEarly bool) {
-	defer close(out)
+func multiZsetIter(keys [][]byte, out chan<- *iterZsetMember, stopEarly bool, wb *Batch) {
 	snapshot := DB.NewSnapshot()
 	opts := levigo.NewReadOptions()
-	defer opts.Close()
 	opts.SetSnapshot(snapshot)
-	defer DB.ReleaseSnapshot(snapshot)
 
 	members := make(zsetMembers, len(keys))
 	iterKeys := make([]*KeyBuffer, len(keys))
-	iterators := make([]*levigo.Iterator, len(keys))
+	iterators := make([]*Iterator, len(keys))
 	for i, k := range keys {
-		if card, _ := zcard(metaKey(k), opts); card > 0 {
+		if card, _ := zcard(metaKey(k), opts, wb); card > 0 {
 			iterKeys[i] = NewKeyBuffer(ZSetKey, k, 0)
 		} else {
 			// If the zset is not found, we'll assume that it is actually a set.
 			// There is a slight edge case that an error could be raised by
-			// zcard(), but since this function is run by a goroutine, there
-			// isn't a clean way of handling it.
+			// zcard(), but it is treated the same as a missing key.
 			iterKeys[i] = NewKeyBuffer(SetKey, k, 0)
 		}
-		it := DB.NewIterator(opts)
-		defer it.Close()
-		it.Seek(iterKeys[i].Key())
-		iterators[i] = it
+		iterators[i] = wb.NewIterator(opts)
+		iterators[i].Seek(iterKeys[i].Key())
 	}
 
-	getMember := func(i int) ([]byte, float64) {
-		// If the iterator is done, we remove the iterator and ignore it in future runs
-		if iterators[i] == nil || !iterators[i].Valid() {
-			iterators[i] = nil
-			return nil, 0
-		}
-		k := iterators[i].Key()
-		if !iterKeys[i].IsPrefixOf(k) {
-			iterators[i] = nil
-			return nil, 0
-		}
+	go func() {
+		defer close(out)
+		defer DB.ReleaseSnapshot(snapshot)
+		defer opts.Close()
+		for _, it := range iterators {
+			defer it.Close()
+		}
+
+		getMember := func(i int) ([]byte, float64) {
+			// If the iterator is done, we remove the iterator and ignore it in future runs
+			if iterators[i] == nil || !iterators[i].Valid() {
+				iterators[i] = nil
+				return nil, 0
+			}
+			k := iterators[i].Key()
+			if !iterKeys[i].IsPrefixOf(k) {
+				iterators[i] = nil
+				return nil, 0
+			}
 
-		// Default non-sorted set members to score 1.0
-		var score float64 = 1
-		if iterKeys[i].Type() == ZSetKey {
-			score = btof(iterators[i].Value())
+			// Default non-sorted set members to score 1.0
+			var score float64 = 1
+			if iterKeys[i].Type() == ZSetKey {
+				score = btof(iterators[i].Value())
+			}
+			// Strip the key prefix from the key and return the member and score
+			return k[len(iterKeys[i].Key()):], score
 		}
-		// Strip the key prefix from the key and return the member and score
-		return k[len(iterKeys[i].Key()):], score
-	}
 
-	// Initialize the members list
-	for i := 0; i < len(members); i++ {
-		m := &zsetMember{key: i}
-		m.member, m.score = getMember(i)
-		members[i] = m
-	}
+		// Initialize the members list
+		for i := 0; i < len(members); i++ {
+			m := &zsetMember{key: i}
+			m.member, m.score = getMember(i)
+			members[i] = m
+		}
 
-iter:
-	for {
-		im := &iterZsetMember{exists: make([]bool, len(members)), scores: make([]float64, len(members))}
-		first := true
-		sort.Sort(members)
+	iter:
+		for {
+			im := &iterZsetMember{exists: make([]bool, len(members)), scores: make([]float64, len(members))}
+			first := true
+			sort.Sort(members)
 
-		for _, m := range members {
-			// The member will be nil if the key it is from has no more members
-			if m.member == nil {
-				if m.key == 0 && stopEarly {
-					break iter
+			for _, m := range members {
+				// The member will be nil if the key it is from has no more members
+				if m.member == nil {
+					if m.key == 0 && stopEarly {
+						break iter
+					}
+					continue
+				}
+				// The first member is the one that we will send out on this iteration
+				if first {
+					im.member = m.member
+					first = false
+				}
+				if first || bytes.Compare(im.member, m.member) == 0 {
+					im.exists[m.key] = true
+					im.scores[m.key] = m.score
+					iterators[m.key].Next()
+					m.member, m.score = getMember(m.key)
+				} else {
+					// If the member isn't first or the same as the one we are
+					// looking for, it's not in the list
+					break
 				}
-				continue
-			}
-			// The first member is the one that we will send out on this iteration
-			if first {
-				im.member = m.member
-				first = false
 			}
-			if first || bytes.Compare(im.member, m.member) == 0 {
-				im.exists[m.key] = true
-				im.scores[m.key] = m.score
-				iterators[m.key].Next()
-				m.member, m.score = getMember(m.key)
-			} else {
-				// If the member isn't first or the same as the one we are
-				// looking for, it's not in the list
+			// When the result member is nil, there are no members left in any of the sets
+			if im.member == nil {
 				break
 			}
+			out <- im
 		}
-		// When the result member is nil, there are no members left in any of the sets
-		if im.member == nil {
-			break
-		}
-		out <- im
-	}
+	}()
 }
 
-func Zrange(args [][]byte, wb *levigo.WriteBatch) interface{} {
-	return zrange(args, false)
+func Zrange(args [][]byte, wb *Batch) interface{} {
+	return zrange(args, false, wb)
 }
 
-func Zrevrange(args [][]byte, wb *levigo.WriteBatch) interface{} {
-	return zrange(args, true)
+func Zrevrange(args [][]byte, wb *Batch) interface{} {
+	return zrange(args, true, wb)
 }
 
-func zrange(args [][]byte, reverse bool) interface{} {
+func zrange(args [][]byte, reverse bool, wb *Batch) interface{} {
 	// use a snapshot for this read so that the zcard is consistent
 	snapshot := DB.NewSnapshot()
 	opts := levigo.NewReadOptions()
 	opts.SetSnapshot(snapshot)
 
-	count, err := zcard(metaKey(args[0]), opts)
+	count, err := zcard(metaKey(args[0]), opts, wb)
 	if err != nil {
 		DB.ReleaseSnapshot(snapshot)
 		opts.Close()
@@ -491,7 +522,7 @@ func zrange(args [][]byte, reverse bool) interface{} {
 
 	go func() {
 		defer close(stream.items)
-		it := DB.NewIterator(opts)
+		it := wb.NewIterator(opts)
 		defer it.Close()
 
 		var i int64
@@ -504,7 +535,7 @@ func zrange(args [][]byte, reverse bool) interface{} {
 				it.Prev()
 			}
 			if i >= start {
-				score, member := parseZScoreKey(it.Key(), len(args[0]))
+				score, member := parseZScoreKey(it.Key(), args[0])
 				stream.items <- member
 				if withscores {
 					stream.items <- ftoa(score)
@@ -530,23 +561,23 @@ const (
 	zrangeCount
 )
 
-func Zrangebyscore(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Zrangebyscore(args [][]byte, wb *Batch) interface{} {
 	return zrangebyscore(args, zrangeForward, wb)
 }
 
-func Zrevrangebyscore(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Zrevrangebyscore(args [][]byte, wb *Batch) interface{} {
 	return zrangebyscore(args, zrangeReverse, wb)
 }
 
-func Zremrangebyscore(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Zremrangebyscore(args [][]byte, wb *Batch) interface{} {
 	return zrangebyscore(args, zrangeDelete, wb)
 }
 
-func Zcount(args [][]byte, wb *levigo.WriteBatch) interface{} {
+func Zcount(args [][]byte, wb *Batch) interface{} {
 	return zrangebyscore(args, zrangeCount, wb)
 }
 
-func zrangebyscore(args [][]byte, flag zrangeFlag, wb *levigo.WriteBatch) interface{} {
+func zrangebyscore(args [][]byte, flag zrangeFlag, wb *Batch) interface{} {
 	// use a snapshot for this read so that the zcard is consistent
 	snapshot := DB.NewSnapshot()
 	opts := levigo.NewReadOptions()
@@ -555,7 +586,7 @@ func zrangebyscore(args [][]byte, flag zrangeFlag, wb *levigo.WriteBatch) interf
 	defer DB.ReleaseSnapshot(snapshot)
 
 	mk := metaKey(args[0])
-	card, err := zcard(mk, opts)
+	card, err := zcard(mk, opts, wb)
 	if err != nil {
 		return err
 	}
@@ -618,7 +649,7 @@ func zrangebyscore(args [][]byte, flag zrangeFlag, wb *levigo.WriteBatch) interf
 		}
 	}
 
-	it := DB.NewIterator(opts)
+	it := wb.NewIterator(opts)
 	defer it.Close()
 
 	var deleted, count uint32
@@ -648,7 +679,7 @@ func zrangebyscore(args [][]byte, flag zrangeFlag, wb *levigo.WriteBatch) interf
 			if !iterKey.IsPrefixOf(k) {
 				break
 			}
-			score, member := parseZScoreKey(it.Key(), len(args[0]))
+			score, member := parseZScoreKey(it.Key(), args[0])
 			if (!minExclusive && score < min) || (minExclusive && score <= min) {
 				if flag != zrangeReverse {
 					it.Next()
@@ -679,8 +710,17 @@ func zrangebyscore(args [][]byte, flag zrangeFlag, wb *levigo.WriteBatch) interf
 		}
 	}
 
+	if deleted > 0 {
+		wb.Notify(notifyZset, "zremrangebyscore", args[0])
+	}
 	if flag == zrangeDelete && deleted == card {
-		wb.Delete(mk)
+		err = delMetaKey(mk, wb)
+		if err != nil {
+			return err
+		}
+		if deleted > 0 {
+			wb.Notify(notifyGeneric, "del", args[0])
+		}
 	} else if deleted > 0 {
 		setZcard(mk, card-deleted, wb)
 	}
@@ -694,15 +734,15 @@ func zrangebyscore(args [][]byte, flag zrangeFlag, wb *levigo.WriteBatch) interf
 	return res
 }
 
-func Zrank(args [][]byte, wb *levigo.WriteBatch) interface{} {
-	return zrank(args, false)
+func Zrank(args [][]byte, wb *Batch) interface{} {
+	return zrank(args, false, wb)
 }
 
-func Zrevrank(args [][]byte, wb *levigo.WriteBatch) interface{} {
-	return zrank(args, true)
+func Zrevrank(args [][]byte, wb *Batch) interface{} {
+	return zrank(args, true, wb)
 }
 
-func zrank(args [][]byte, reverse bool) interface{} {
+func zrank(args [][]byte, reverse bool, wb *Batch) interface{} {
 	// use a snapshot for this read so that the zcard is consistent
 	snapshot := DB.NewSnapshot()
 	opts := levigo.NewReadOptions()
@@ -710,7 +750,7 @@ func zrank(args [][]byte, reverse bool) interface{} {
 	defer opts.Close()
 	defer DB.ReleaseSnapshot(snapshot)
 
-	card, err := zcard(metaKey(args[0]), opts)
+	card, err := zcard(metaKey(args[0]), opts, wb)
 	if err != nil {
 		return err
 	}
@@ -719,7 +759,7 @@ func zrank(args [][]byte, reverse bool) interface{} {
 	}
 
 	iterKey := NewKeyBuffer(ZScoreKey, args[0], 0)
-	it := DB.NewIterator(opts)
+	it := wb.NewIterator(opts)
 	defer it.Close()
 
 	if reverse {
@@ -734,7 +774,7 @@ func zrank(args [][]byte, reverse bool) interface{} {
 		if !iterKey.IsPrefixOf(k) {
 			break
 		}
-		if bytes.Equal(args[1], k[len(args[0])+13:]) {
+		if bytes.Equal(args[1], keySuffix(args[0], k)[8:]) {
 			return i
 		}
 		if !reverse {
@@ -745,9 +785,9 @@ func zrank(args [][]byte, reverse bool) interface{} {
 	return nil
 }
 
-func DelZset(key []byte, wb *levigo.WriteBatch) {
+func DelZset(key []byte, wb *Batch) {
 	// TODO: count keys to verify everything works as expected?
-	it := DB.NewIterator(ReadWithoutCacheFill)
+	it := wb.NewIterator(ReadWithoutCacheFill)
 	defer it.Close()
 	iterKey := NewKeyBuffer(ZSetKey, key, 0)
 	scoreKey := NewKeyBuffer(ZScoreKey, key, 0)
@@ -766,7 +806,7 @@ func DelZset(key []byte, wb *levigo.WriteBatch) {
 	}
 }
 
-func setZcard(key []byte, card uint32, wb *levigo.WriteBatch) {
+func setZcard(key []byte, card uint32, wb *Batch) {
 	data := make([]byte, 5)
 	data[0] = ZCardValue
 	binary.BigEndian.PutUint32(data[1:], card)
@@ -781,8 +821,10 @@ func setZScoreKeyMember(key *KeyBuffer, member []byte) {
 	key.SetSuffix(append(make([]byte, 8, 8+len(member)), member...))
 }
 
-func parseZScoreKey(b []byte, keyLen int) (float64, []byte) {
-	return readByteSortableFloat(b[keyLen+5:]), b[keyLen+13:]
+// parse a ZScoreKey b of key
+func parseZScoreKey(b []byte, key []byte) (float64, []byte) {
+	suffix := keySuffix(key, b)
+	return readByteSortableFloat(suffix), suffix[8:]
 }
 
 func btof(b []byte) float64 {
@@ -836,25 +878,17 @@ func readByteSortableFloat(b []byte) float64 {
 	return -math.Float64frombits(binary.BigEndian.Uint64(b))
 }
 
-func ZunionInterKeys(args [][]byte) [][]byte {
+func ZunionInterKeys(args [][]byte) []int {
 	numKeys, err := bconv.Atoi(args[1])
 	// don't return any keys if the response will be a syntax error
-	if err != nil || len(args) < 2+numKeys {
+	if err != nil || numKeys < 0 || len(args) < 2+numKeys {
 		return nil
 	}
-	keys := make([][]byte, 1, 1+numKeys)
-	keys[0] = args[0]
-keyloop:
-	for _, k := range args[2 : 2+numKeys] {
-		for _, key := range keys {
-			// skip keys that are already in the array
-			if bytes.Equal(k, key) {
-				continue keyloop
-			}
-		}
-		keys = append(keys, k)
+	indexes := make([]int, 1, 1+numKeys)
+	for i := 2; i < 2+numKeys; i++ {
+		indexes = append(indexes, i)
 	}
-	return keys
+	return indexes
 }
 
 // ZREMRANGEBYRANK